@@ -1,14 +1,32 @@
 package main
 
 import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
 	"net"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,6 +38,12 @@ json加密，
 *@param Data:消息内容
 *@param Sender：发送者，在用户名域
 *@param Receiver：接受者，在用户名域
+*@param Token：登录时服务器下发的会话令牌，仅在发往服务器的消息中携带
+*@param Key：身份公钥，登录时上报给服务器
+*@param Nonce：端到端加密随机数，非空时Data为密文
+*@param Codec：connect时协商的编解码，客户端按优先顺序列出，服务器返回选中的一个
+*@param Payload：json编码的结构化负载，见Payload
+*@param ID：需要确认的消息的ID，见Reliable
 *****************************************************/
 
 type Message struct {
@@ -27,429 +51,3894 @@ type Message struct {
 	Data     string
 	Sender   string
 	Receiver string
+	Token    string
+	Key      string
+	Nonce    string
+	Codec    string
+	Payload  string
+	ID       string
+}
+
+/****************************************************
+*@brief 定义结构化消息负载，编码为json后放在
+Message.Payload中，每条消息只使用其中一个字段。Data中
+仍保留旧的斜杠分隔格式，兼容旧客户端
+*****************************************************
+*@param List：在线用户列表
+*@param Offer：两人会话建立时对方的地址与公钥
+*@param Invite：等待接受的会话邀请
+*@param Room：群聊房间及成员
+*@param Rooms：所有群聊房间
+*@param Error：带错误码的错误
+*@param Status：用户状态
+*@param Note：服务器代为投递的单条消息或离线留言
+*****************************************************/
+type Payload struct {
+	List   *UserList     `json:",omitempty"`
+	Offer  *SessionOffer `json:",omitempty"`
+	Invite *InviteInfo   `json:",omitempty"`
+	Room   *RoomInfo     `json:",omitempty"`
+	Rooms  *RoomList     `json:",omitempty"`
+	Error  *ErrorInfo    `json:",omitempty"`
+	Status *UserStatus   `json:",omitempty"`
+	Note   *NoteInfo     `json:",omitempty"`
+}
+
+/****************************************************
+*@brief 定义在线用户列表
+*****************************************************
+*@param Users：在线用户名
+*@param Statuses：在线用户的状态，顺序与Users相同
+*****************************************************/
+type UserList struct {
+	Users    []string
+	Statuses []UserStatus `json:",omitempty"`
+}
+
+/****************************************************
+*@brief 定义用户状态，Text为可选的状态说明
+*****************************************************
+*@param Name：用户名
+*@param Status：状态，见StatusAvailable等
+*@param Text：状态说明
+*****************************************************/
+type UserStatus struct {
+	Name   string
+	Status string
+	Text   string
+}
+
+/****************************************************
+*@brief 定义两人会话的建立信息，被叫方接受邀请后服务器
+同时发给发起方与被叫方
+*****************************************************
+*@param Sponsor：收到邀请的一方是否为发起方
+*@param Name：对方用户名
+*@param PublicAddr：服务器观察到的对方公网udp地址
+*@param PrivateAddr：对方上报的内网udp地址
+*@param Key：对方身份公钥
+*****************************************************/
+type SessionOffer struct {
+	Sponsor     bool
+	Name        string
+	PublicAddr  string
+	PrivateAddr string
+	Key         string
+}
+
+/****************************************************
+*@brief 定义会话邀请通知，服务器同时发给发起方与被叫方
+*****************************************************
+*@param From：发起者
+*@param To：被邀请者
+*@param Timeout：邀请有效的秒数
+*****************************************************/
+type InviteInfo struct {
+	From    string
+	To      string
+	Timeout int
+}
+
+/****************************************************
+*@brief 定义群聊房间及成员
+*****************************************************
+*@param Name：房间名
+*@param Members：成员用户名
+*****************************************************/
+type RoomInfo struct {
+	Name    string
+	Members []string
+}
+
+/****************************************************
+*@brief 定义服务器代为投递的单条消息或离线留言。这类
+消息以server为Sender可靠投递，接收方的ack发给服务器，
+作者放在From中
+*****************************************************
+*@param From：作者
+*@param Text：内容
+*@param Time：留言时间，单条消息为空
+*****************************************************/
+type NoteInfo struct {
+	From string
+	Text string
+	Time string `json:",omitempty"`
+}
+
+/****************************************************
+*@brief 定义所有群聊房间
+*****************************************************
+*@param Rooms：群聊房间
+*****************************************************/
+type RoomList struct {
+	Rooms []RoomInfo
+}
+
+/****************************************************
+*@brief 定义带错误码的错误
+*****************************************************
+*@param Code：错误码
+*@param Text：错误描述
+*****************************************************/
+type ErrorInfo struct {
+	Code int
+	Text string
+}
+
+/****************************************************
+*@brief 定义错误码
+*****************************************************/
+const (
+	CodeNotOnline     = 1
+	CodeBusy          = 2
+	CodeNotTalking    = 3
+	CodeNotRegistered = 4
+	CodeNotInRoom     = 5
+	CodeMailbox       = 6
+	CodeNotDelivered  = 7
+	CodeNoInvite      = 8
+	CodeDeclined      = 9
+	CodeExpired       = 10
+	CodeBadStatus     = 11
+	CodeNotWatching   = 12
+)
+
+/****************************************************
+*@brief 定义用户状态，dnd为请勿打扰，offline表示不在线，
+只出现在联系人状态中，不能设置
+*****************************************************/
+const (
+	StatusAvailable = "available"
+	StatusAway      = "away"
+	StatusBusy      = "busy"
+	StatusDND       = "dnd"
+	StatusOffline   = "offline"
+)
+
+/****************************************************
+*@function ValidStatus(status string) bool
+*****************************************************
+*@brief 判断是否为可设置的用户状态
+*****************************************************
+*@access Public
+*****************************************************
+*@param status：状态
+*****************************************************
+*@return bool：是否合法
+*****************************************************/
+func ValidStatus(status string) bool {
+	switch status {
+	case StatusAvailable, StatusAway, StatusBusy, StatusDND:
+		return true
+	}
+	return false
+}
+
+/****************************************************
+*@function FormatStatus(status UserStatus) string
+*****************************************************
+*@brief 输出用于显示的用户状态：用户名 [状态] 状态说明
+*****************************************************
+*@access Public
+*****************************************************
+*@param status：用户状态
+*****************************************************
+*@return string：显示内容
+*****************************************************/
+func FormatStatus(status UserStatus) string {
+	line := fmt.Sprintf("%s [%s]", status.Name, status.Status)
+	if status.Text != "" {
+		line += " " + status.Text
+	}
+	return line
+}
+
+/****************************************************
+*@function NewPayload(payload Payload) string
+*****************************************************
+*@brief 把结构化负载编码为Message.Payload
+*****************************************************
+*@access Public
+*****************************************************
+*@param payload：结构化负载
+*****************************************************
+*@return string：json编码的负载
+*****************************************************/
+func NewPayload(payload Payload) string {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+/****************************************************
+*@function ParsePayload(mess Message) (Payload, bool)
+*****************************************************
+*@brief 解析消息中的结构化负载，旧版本对端不携带负载
+*****************************************************
+*@access Public
+*****************************************************
+*@param mess：消息
+*****************************************************
+*@return Payload：结构化负载
+*@return bool：是否携带合法的负载，为false时需解析Data
+*****************************************************/
+func ParsePayload(mess Message) (Payload, bool) {
+	var payload Payload
+	if mess.Payload == "" {
+		return payload, false
+	}
+	err := json.Unmarshal([]byte(mess.Payload), &payload)
+	return payload, err == nil
+}
+
+/****************************************************
+*@brief 定义消息编解码接口，ID写入帧头的负载类型，
+接收方据此选择解码方式
+*****************************************************
+*@param Name：编解码名称，connect时协商使用
+*@param ID：负载类型
+*@param Marshal：编码一条消息
+*@param Unmarshal：解码一条消息
+*****************************************************/
+type Codec interface {
+	Name() string
+	ID() byte
+	Marshal(mess Message) ([]byte, error)
+	Unmarshal(data []byte, mess *Message) error
+}
+
+/****************************************************
+*@brief 定义已支持的编解码，顺序即默认的优先顺序
+*****************************************************/
+var Codecs = []Codec{BinaryCodec{}, CBORCodec{}, JSONCodec{}}
+
+/****************************************************
+*@function CodecByName(name string) Codec
+*****************************************************
+*@brief 按名称查找编解码
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：编解码名称
+*****************************************************
+*@return Codec：编解码，不支持时为nil
+*****************************************************/
+func CodecByName(name string) Codec {
+	for _, codec := range Codecs {
+		if codec.Name() == name {
+			return codec
+		}
+	}
+	return nil
+}
+
+/****************************************************
+*@function CodecByID(id byte) Codec
+*****************************************************
+*@brief 按帧头的负载类型查找编解码
+*****************************************************
+*@access Public
+*****************************************************
+*@param id：负载类型
+*****************************************************
+*@return Codec：编解码，不支持时为nil
+*****************************************************/
+func CodecByID(id byte) Codec {
+	for _, codec := range Codecs {
+		if codec.ID() == id {
+			return codec
+		}
+	}
+	return nil
+}
+
+/****************************************************
+*@brief 定义json编解码，兼容只支持json的客户端
+*****************************************************/
+type JSONCodec struct{}
+
+/****************************************************
+*@function func (JSONCodec) Name() string
+*****************************************************
+*@brief 输出编解码名称
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return string：json
+*****************************************************/
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+/****************************************************
+*@function func (JSONCodec) ID() byte
+*****************************************************
+*@brief 输出负载类型
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return byte：0
+*****************************************************/
+func (JSONCodec) ID() byte {
+	return 0
+}
+
+/****************************************************
+*@function func (JSONCodec) Marshal(mess Message) ([]byte, error)
+*****************************************************
+*@brief 把消息编码为json
+*****************************************************
+*@access Public
+*****************************************************
+*@param mess：消息
+*****************************************************
+*@return []byte：编码结果
+*@return error：编码失败原因
+*****************************************************/
+func (JSONCodec) Marshal(mess Message) ([]byte, error) {
+	return json.Marshal(mess)
+}
+
+/****************************************************
+*@function func (JSONCodec) Unmarshal(data []byte, mess *Message) error
+*****************************************************
+*@brief 从json解码消息
+*****************************************************
+*@access Public
+*****************************************************
+*@param data：json数据
+*@param mess：解码结果
+*****************************************************
+*@return error：解码失败原因
+*****************************************************/
+func (JSONCodec) Unmarshal(data []byte, mess *Message) error {
+	return json.Unmarshal(data, mess)
+}
+
+/****************************************************
+*@brief 定义紧凑二进制编解码：按Cmd、Data、Sender、
+Receiver、Token、Key、Nonce、Codec、Payload、ID的顺序，每个字段为
+uvarint长度加内容，不重复字段名。解码时忽略末尾多出的
+字段，缺少的末尾字段为空，便于以后增加字段
+*****************************************************/
+type BinaryCodec struct{}
+
+/****************************************************
+*@function func (BinaryCodec) Name() string
+*****************************************************
+*@brief 输出编解码名称
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return string：binary
+*****************************************************/
+func (BinaryCodec) Name() string {
+	return "binary"
+}
+
+/****************************************************
+*@function func (BinaryCodec) ID() byte
+*****************************************************
+*@brief 输出负载类型
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return byte：1
+*****************************************************/
+func (BinaryCodec) ID() byte {
+	return 1
+}
+
+/****************************************************
+*@function func (BinaryCodec) Marshal(mess Message) ([]byte, error)
+*****************************************************
+*@brief 把消息编码为长度前缀的二进制
+*****************************************************
+*@access Public
+*****************************************************
+*@param mess：消息
+*****************************************************
+*@return []byte：编码结果
+*@return error：无
+*****************************************************/
+func (BinaryCodec) Marshal(mess Message) ([]byte, error) {
+	fields := []string{mess.Cmd, mess.Data, mess.Sender, mess.Receiver, mess.Token, mess.Key, mess.Nonce, mess.Codec, mess.Payload, mess.ID}
+	data := make([]byte, 0, 64)
+	for _, field := range fields {
+		data = binary.AppendUvarint(data, uint64(len(field)))
+		data = append(data, field...)
+	}
+	return data, nil
+}
+
+/****************************************************
+*@function func (BinaryCodec) Unmarshal(data []byte, mess *Message) error
+*****************************************************
+*@brief 从长度前缀的二进制解码消息
+*****************************************************
+*@access Public
+*****************************************************
+*@param data：二进制数据
+*@param mess：解码结果
+*****************************************************
+*@return error：数据被截断时返回错误
+*****************************************************/
+func (BinaryCodec) Unmarshal(data []byte, mess *Message) error {
+	fields := []*string{&mess.Cmd, &mess.Data, &mess.Sender, &mess.Receiver, &mess.Token, &mess.Key, &mess.Nonce, &mess.Codec, &mess.Payload, &mess.ID}
+	for _, field := range fields {
+		//旧版本编码的消息没有末尾的新字段
+		if len(data) == 0 {
+			return nil
+		}
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return errors.New("binary: truncated message")
+		}
+		*field = string(data[n : n+int(length)])
+		data = data[n+int(length):]
+	}
+	return nil
+}
+
+/****************************************************
+*@brief 定义cbor编解码(RFC 8949)：消息编码为以字段名
+为键的map，空字段省略，只使用定长的文本与map
+*****************************************************/
+type CBORCodec struct{}
+
+/****************************************************
+*@function func (CBORCodec) Name() string
+*****************************************************
+*@brief 输出编解码名称
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return string：cbor
+*****************************************************/
+func (CBORCodec) Name() string {
+	return "cbor"
+}
+
+/****************************************************
+*@function func (CBORCodec) ID() byte
+*****************************************************
+*@brief 输出负载类型
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return byte：2
+*****************************************************/
+func (CBORCodec) ID() byte {
+	return 2
+}
+
+/****************************************************
+*@function func (c CBORCodec) fields(mess *Message) ([]string, []*string)
+*****************************************************
+*@brief 输出消息的字段名与字段地址
+*****************************************************
+*@access Private
+*****************************************************
+*@param mess：消息
+*****************************************************
+*@return []string：字段名
+*@return []*string：字段地址
+*****************************************************/
+func (c CBORCodec) fields(mess *Message) ([]string, []*string) {
+	return []string{"Cmd", "Data", "Sender", "Receiver", "Token", "Key", "Nonce", "Codec", "Payload", "ID"},
+		[]*string{&mess.Cmd, &mess.Data, &mess.Sender, &mess.Receiver, &mess.Token, &mess.Key, &mess.Nonce, &mess.Codec, &mess.Payload, &mess.ID}
+}
+
+/****************************************************
+*@function func (c CBORCodec) head(data []byte, major byte, n uint64) []byte
+*****************************************************
+*@brief 写入cbor数据项的头部：主类型与长度
+*****************************************************
+*@access Private
+*****************************************************
+*@param data：已编码数据
+*@param major：主类型，3为文本，5为map
+*@param n：长度
+*****************************************************
+*@return []byte：追加头部后的数据
+*****************************************************/
+func (c CBORCodec) head(data []byte, major byte, n uint64) []byte {
+	major = major << 5
+	switch {
+	case n < 24:
+		return append(data, major|byte(n))
+	case n <= 0xff:
+		return append(data, major|24, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(data, major|25), uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(data, major|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(data, major|27), n)
+}
+
+/****************************************************
+*@function func (c CBORCodec) readHead(data []byte) (byte, uint64, []byte, error)
+*****************************************************
+*@brief 读取cbor数据项的头部，不支持不定长数据项
+*****************************************************
+*@access Private
+*****************************************************
+*@param data：待解码数据
+*****************************************************
+*@return byte：主类型
+*@return uint64：长度
+*@return []byte：头部之后的数据
+*@return error：数据不合法的原因
+*****************************************************/
+func (c CBORCodec) readHead(data []byte) (byte, uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, nil, errors.New("cbor: truncated message")
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	size := 0
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, nil, errors.New("cbor: indefinite length is not supported")
+	}
+	if len(data) < size {
+		return 0, 0, nil, errors.New("cbor: truncated message")
+	}
+	n := uint64(0)
+	for _, b := range data[:size] {
+		n = n<<8 | uint64(b)
+	}
+	return major, n, data[size:], nil
+}
+
+/****************************************************
+*@function func (c CBORCodec) readText(data []byte) (string, []byte, error)
+*****************************************************
+*@brief 读取一个cbor文本
+*****************************************************
+*@access Private
+*****************************************************
+*@param data：待解码数据
+*****************************************************
+*@return string：文本
+*@return []byte：文本之后的数据
+*@return error：数据不合法的原因
+*****************************************************/
+func (c CBORCodec) readText(data []byte) (string, []byte, error) {
+	major, n, data, err := c.readHead(data)
+	if err != nil {
+		return "", nil, err
+	}
+	if major != 3 {
+		return "", nil, fmt.Errorf("cbor: expected text, got major type %d", major)
+	}
+	if uint64(len(data)) < n {
+		return "", nil, errors.New("cbor: truncated message")
+	}
+	return string(data[:n]), data[n:], nil
+}
+
+/****************************************************
+*@function func (c CBORCodec) Marshal(mess Message) ([]byte, error)
+*****************************************************
+*@brief 把消息编码为cbor map
+*****************************************************
+*@access Public
+*****************************************************
+*@param mess：消息
+*****************************************************
+*@return []byte：编码结果
+*@return error：无
+*****************************************************/
+func (c CBORCodec) Marshal(mess Message) ([]byte, error) {
+	names, values := c.fields(&mess)
+	count := 0
+	for _, value := range values {
+		if *value != "" {
+			count++
+		}
+	}
+	data := c.head(make([]byte, 0, 64), 5, uint64(count))
+	for i, value := range values {
+		if *value != "" {
+			data = append(c.head(data, 3, uint64(len(names[i]))), names[i]...)
+			data = append(c.head(data, 3, uint64(len(*value))), *value...)
+		}
+	}
+	return data, nil
+}
+
+/****************************************************
+*@function func (c CBORCodec) Unmarshal(data []byte, mess *Message) error
+*****************************************************
+*@brief 从cbor map解码消息，忽略未知的键
+*****************************************************
+*@access Public
+*****************************************************
+*@param data：cbor数据
+*@param mess：解码结果
+*****************************************************
+*@return error：解码失败原因
+*****************************************************/
+func (c CBORCodec) Unmarshal(data []byte, mess *Message) error {
+	major, count, data, err := c.readHead(data)
+	if err != nil {
+		return err
+	}
+	if major != 5 {
+		return fmt.Errorf("cbor: expected map, got major type %d", major)
+	}
+	names, values := c.fields(mess)
+	for i := uint64(0); i < count; i++ {
+		var key, value string
+		key, data, err = c.readText(data)
+		if err != nil {
+			return err
+		}
+		value, data, err = c.readText(data)
+		if err != nil {
+			return err
+		}
+		for j, name := range names {
+			if name == key {
+				*values[j] = value
+			}
+		}
+	}
+	return nil
+}
+
+/****************************************************
+*@brief 定义udp数据报帧格式：2字节标识"IM"、1字节协议
+版本、1字节负载类型即编解码ID，之后为一条消息的负载。
+每个数据报不超过MaxFrameSize。超过FragmentSize的消息
+切分为多个分片帧发送，见EncodeFrames，重组后的整帧
+不超过MaxMessageSize
+*****************************************************/
+const (
+	FrameVersion   = 1
+	FrameHeader    = 4
+	MaxFrameSize   = 8192
+	FragmentType   = 0xFF
+	FragmentHeader = 12
+	FragmentSize   = 1200
+	MaxMessageSize = 1 << 20
+)
+
+/****************************************************
+*@brief 定义一条输入的最大字节数。加密后的内容经base64
+编码约增大三分之一，限制为整帧上限的一半，保证加密与
+编码后仍不超过MaxMessageSize
+*****************************************************/
+const MaxTextSize = MaxMessageSize / 2
+
+/****************************************************
+*@brief 定义输入超过MaxTextSize的错误
+*****************************************************/
+var ErrTooLarge = errors.New("message too large")
+
+/****************************************************
+*@brief 定义帧解析错误，Reason作为丢包计数的分类
+*****************************************************
+*@param Reason：丢弃原因，包括size、header、version、payload、fragment、memory
+*@param Err：具体错误
+*****************************************************/
+type FrameError struct {
+	Reason string
+	Err    error
+}
+
+/****************************************************
+*@function func (e *FrameError) Error() string
+*****************************************************
+*@brief 输出帧解析错误
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return string：错误描述
+*****************************************************/
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("frame %s: %v", e.Reason, e.Err)
+}
+
+/****************************************************
+*@function EncodeFrame(codec Codec, mess Message) ([]byte, error)
+*****************************************************
+*@brief 把一条消息编码为一个整帧
+*****************************************************
+*@access Public
+*****************************************************
+*@param codec：编解码，为nil时使用json
+*@param mess：待发送消息
+*****************************************************
+*@return []byte：整帧，可能需要分片发送
+*@return error：编码失败或超出大小限制
+*****************************************************/
+func EncodeFrame(codec Codec, mess Message) ([]byte, error) {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	payload, err := codec.Marshal(mess)
+	if err != nil {
+		return nil, err
+	}
+	if FrameHeader+len(payload) > MaxMessageSize {
+		return nil, &FrameError{Reason: "size", Err: fmt.Errorf("%d bytes exceeds %d", FrameHeader+len(payload), MaxMessageSize)}
+	}
+	frame := make([]byte, 0, FrameHeader+len(payload))
+	frame = append(frame, 'I', 'M', FrameVersion, codec.ID())
+	return append(frame, payload...), nil
+}
+
+/****************************************************
+*@function EncodeFrames(codec Codec, mess Message) ([][]byte, error)
+*****************************************************
+*@brief 把一条消息编码为一个或多个数据报。整帧超过
+一个分片的大小时切分为带编号的分片，每个分片帧的负载
+类型为FragmentType，之后依次为8字节分片组编号、2字节
+分片序号、2字节分片总数以及整帧的一段
+*****************************************************
+*@access Public
+*****************************************************
+*@param codec：编解码，为nil时使用json
+*@param mess：待发送消息
+*****************************************************
+*@return [][]byte：按顺序发送的数据报
+*@return error：编码失败或超出大小限制
+*****************************************************/
+func EncodeFrames(codec Codec, mess Message) ([][]byte, error) {
+	frame, err := EncodeFrame(codec, mess)
+	if err != nil {
+		return nil, err
+	}
+	if len(frame) <= FrameHeader+FragmentHeader+FragmentSize {
+		return [][]byte{frame}, nil
+	}
+	key := make([]byte, 8)
+	crand.Read(key)
+	count := (len(frame) + FragmentSize - 1) / FragmentSize
+	frames := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		chunk := frame[i*FragmentSize : min((i+1)*FragmentSize, len(frame))]
+		fragment := make([]byte, 0, FrameHeader+FragmentHeader+len(chunk))
+		fragment = append(fragment, 'I', 'M', FrameVersion, FragmentType)
+		fragment = append(fragment, key...)
+		fragment = binary.BigEndian.AppendUint16(fragment, uint16(i))
+		fragment = binary.BigEndian.AppendUint16(fragment, uint16(count))
+		frames = append(frames, append(fragment, chunk...))
+	}
+	return frames, nil
+}
+
+/****************************************************
+*@function DecodeFrame(data []byte) (Message, error)
+*****************************************************
+*@brief 把一个整帧解码为一条消息，按帧头的负载类型
+选择编解码，大小、帧头、版本或负载不合法时返回*FrameError
+*****************************************************
+*@access Public
+*****************************************************
+*@param data：整帧，即Reassembler返回的数据报或重组结果
+*****************************************************
+*@return Message：消息
+*@return error：解析失败原因
+*****************************************************/
+func DecodeFrame(data []byte) (Message, error) {
+	var mess Message
+	if len(data) > MaxMessageSize {
+		return mess, &FrameError{Reason: "size", Err: fmt.Errorf("%d bytes exceeds %d", len(data), MaxMessageSize)}
+	}
+	if len(data) < FrameHeader || data[0] != 'I' || data[1] != 'M' {
+		return mess, &FrameError{Reason: "header", Err: errors.New("missing frame header")}
+	}
+	if data[2] != FrameVersion {
+		return mess, &FrameError{Reason: "version", Err: fmt.Errorf("unsupported version %d", data[2])}
+	}
+	codec := CodecByID(data[3])
+	if codec == nil {
+		return mess, &FrameError{Reason: "payload", Err: fmt.Errorf("unsupported payload type %d", data[3])}
+	}
+	err := codec.Unmarshal(data[FrameHeader:], &mess)
+	if err != nil {
+		return mess, &FrameError{Reason: "payload", Err: err}
+	}
+	return mess, nil
+}
+
+/****************************************************
+*@brief 定义一条正在重组的消息
+*****************************************************
+*@param chunks：按序号保存的分片内容，未收到的为nil
+*@param received：已收到的分片数
+*@param source：来源地址
+*@param size：已收到的字节数
+*@param started：收到第一个分片的时间
+*****************************************************/
+type partial struct {
+	chunks   [][]byte
+	received int
+	source   string
+	size     int
+	started  time.Time
+}
+
+/****************************************************
+*@brief 定义分片重组。按来源地址与分片组编号收集分片，
+收齐后拼接为整帧。超过timeout仍未收齐的消息被丢弃，
+所有未收齐消息占用的内存不超过limit，其中每个来源地址
+不超过quota。分片不带令牌，收齐之前无法校验发送者，
+单个来源因此不能占满全部内存
+*****************************************************
+*@param lock：锁
+*@param timeout：一条消息收齐分片的最长时间
+*@param limit：未收齐消息最多占用的字节数
+*@param quota：每个来源地址的未收齐消息最多占用的字节数
+*@param size：未收齐消息当前占用的字节数
+*@param sources：来源地址->未收齐消息占用的字节数
+*@param parts：来源地址/分片组编号->正在重组的消息
+*@param pruned：上次清理超时消息的时间
+*@param drops：丢包计数，超时丢弃的消息记为expired
+*****************************************************/
+type Reassembler struct {
+	lock    sync.Mutex
+	timeout time.Duration
+	limit   int
+	quota   int
+	size    int
+	sources map[string]int
+	parts   map[string]*partial
+	pruned  time.Time
+	drops   *DropCounter
+}
+
+/****************************************************
+*@function NewReassembler(timeout time.Duration, limit int, quota int, drops *DropCounter) *Reassembler
+*****************************************************
+*@brief 新建分片重组
+*****************************************************
+*@access Public
+*****************************************************
+*@param timeout：一条消息收齐分片的最长时间
+*@param limit：未收齐消息最多占用的字节数
+*@param quota：每个来源地址最多占用的字节数
+*@param drops：丢包计数
+*****************************************************
+*@return *Reassembler：分片重组
+*****************************************************/
+func NewReassembler(timeout time.Duration, limit int, quota int, drops *DropCounter) *Reassembler {
+	return &Reassembler{
+		timeout: timeout,
+		limit:   limit,
+		quota:   quota,
+		sources: make(map[string]int),
+		parts:   make(map[string]*partial),
+		pruned:  time.Now(),
+		drops:   drops,
+	}
+}
+
+/****************************************************
+*@function func (r *Reassembler) Add(source string, data []byte) ([]byte, error)
+*****************************************************
+*@brief 处理收到的一个数据报。不是分片时原样返回；是
+分片时保存，收齐后返回拼接的整帧，未收齐时返回nil
+*****************************************************
+*@access Public
+*****************************************************
+*@param source：来源地址
+*@param data：收到的数据报，返回后可以复用
+*****************************************************
+*@return []byte：可以交给DecodeFrame的整帧，未收齐时为nil
+*@return error：数据报过大、分片不合法或超出内存限制时返回*FrameError
+*****************************************************/
+func (r *Reassembler) Add(source string, data []byte) ([]byte, error) {
+	if len(data) > MaxFrameSize {
+		return nil, &FrameError{Reason: "size", Err: fmt.Errorf("%d bytes exceeds %d", len(data), MaxFrameSize)}
+	}
+	if len(data) < FrameHeader || data[0] != 'I' || data[1] != 'M' || data[2] != FrameVersion || data[3] != FragmentType {
+		return data, nil
+	}
+	if len(data) < FrameHeader+FragmentHeader {
+		return nil, &FrameError{Reason: "fragment", Err: errors.New("short fragment header")}
+	}
+	header := data[FrameHeader : FrameHeader+FragmentHeader]
+	index := int(binary.BigEndian.Uint16(header[8:10]))
+	count := int(binary.BigEndian.Uint16(header[10:12]))
+	if count == 0 || index >= count || count > (MaxMessageSize+FragmentSize-1)/FragmentSize {
+		return nil, &FrameError{Reason: "fragment", Err: fmt.Errorf("fragment %d of %d", index, count)}
+	}
+	key := source + "/" + hex.EncodeToString(header[:8])
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	if now.Sub(r.pruned) > time.Second {
+		for temp, part := range r.parts {
+			if now.Sub(part.started) > r.timeout {
+				r.remove(temp)
+				r.drops.Drop("expired")
+			}
+		}
+		r.pruned = now
+	}
+	part, flag := r.parts[key]
+	if !flag {
+		part = &partial{chunks: make([][]byte, count), source: source, started: now}
+		r.parts[key] = part
+	}
+	if len(part.chunks) != count {
+		r.remove(key)
+		return nil, &FrameError{Reason: "fragment", Err: fmt.Errorf("fragment count changed from %d to %d", len(part.chunks), count)}
+	}
+	if part.chunks[index] != nil {
+		//重复的分片
+		return nil, nil
+	}
+	//分片头同样计入占用，防止大量空分片
+	cost := len(data)
+	if r.sources[source]+cost > r.quota {
+		r.remove(key)
+		return nil, &FrameError{Reason: "memory", Err: fmt.Errorf("%d bytes of fragments waiting from %s, limit %d", r.sources[source], source, r.quota)}
+	}
+	if r.size+cost > r.limit {
+		r.remove(key)
+		return nil, &FrameError{Reason: "memory", Err: fmt.Errorf("%d bytes of fragments waiting, limit %d", r.size, r.limit)}
+	}
+	part.chunks[index] = append([]byte(nil), data[FrameHeader+FragmentHeader:]...)
+	part.received++
+	part.size += cost
+	r.size += cost
+	r.sources[source] += cost
+	if part.received < count {
+		return nil, nil
+	}
+	r.remove(key)
+	frame := make([]byte, 0, part.size)
+	for _, chunk := range part.chunks {
+		frame = append(frame, chunk...)
+	}
+	return frame, nil
+}
+
+/****************************************************
+*@function func (r *Reassembler) remove(key string)
+*****************************************************
+*@brief 删除一条正在重组的消息并释放占用，调用者持锁
+*****************************************************
+*@access Private
+*****************************************************
+*@param key：来源地址/分片组编号
+*****************************************************
+*@return 无
+*****************************************************/
+func (r *Reassembler) remove(key string) {
+	part, flag := r.parts[key]
+	if flag {
+		r.size -= part.size
+		r.sources[part.source] -= part.size
+		if r.sources[part.source] <= 0 {
+			delete(r.sources, part.source)
+		}
+		delete(r.parts, key)
+	}
+}
+
+/****************************************************
+*@brief 定义丢包计数，按丢弃原因分类
+*****************************************************
+*@param lock：计数锁
+*@param counts：丢弃原因->丢弃数
+*****************************************************/
+type DropCounter struct {
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+/****************************************************
+*@function NewDropCounter() *DropCounter
+*****************************************************
+*@brief 新建丢包计数
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return *DropCounter：丢包计数
+*****************************************************/
+func NewDropCounter() *DropCounter {
+	return &DropCounter{counts: make(map[string]int)}
+}
+
+/****************************************************
+*@function func (c *DropCounter) Drop(reason string) int
+*****************************************************
+*@brief 记录一次丢包
+*****************************************************
+*@access Public
+*****************************************************
+*@param reason：丢弃原因
+*****************************************************
+*@return int：该原因累计的丢弃数
+*****************************************************/
+func (c *DropCounter) Drop(reason string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counts[reason]++
+	return c.counts[reason]
+}
+
+/****************************************************
+*@function func (c *DropCounter) Counts() map[string]int
+*****************************************************
+*@brief 输出丢包计数的副本
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return map[string]int：丢弃原因->丢弃数
+*****************************************************/
+func (c *DropCounter) Counts() map[string]int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	counts := make(map[string]int, len(c.counts))
+	for reason, count := range c.counts {
+		counts[reason] = count
+	}
+	return counts
+}
+
+/****************************************************
+*@brief 定义udp数据报端口，*net.UDPConn实现该接口，
+测试中替换为模拟NAT后面的端口
+*****************************************************/
+type PacketConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
 }
 
 /****************************************************
 *@brief 定义客户端用户
 *****************************************************
-*@param reader:消息接收接口
-*@param remoteAddr:远程服务器地址
-*@param name:用户名   
-*@param chatPort：用户监听端口     
+*@param reader:消息接收接口
+*@param remoteAddr:远程服务器地址
+*@param name:用户名   
+*@param chatPort：用户监听端口     
+*@param chatMode：会话模式，auto(自动)、direct(直连)、relay(服务器中转)
+*@param pongCh：打洞应答channel
+*@param token：服务器下发的会话令牌
+*@param secrets：端到端加密密钥
+*@param history：本地会话记录，包括直连与中转的消息
+*@param beatInterval：心跳间隔
+*@param drops：丢包计数
+*@param codec：与服务器协商的编解码
+*@param reliable：会话消息的确认、重传与去重
+*@param fragments：分片重组
+*@param input：标准输入
+*@param talks：同时进行的两人会话
+*****************************************************/
+type User struct {
+	reader       PacketConn
+	remoteClient *User
+	name         string
+	chatPort     string
+	chatMode     string
+	pongCh       chan string
+	token        string
+	secrets      *Secrets
+	history      *History
+	beatInterval time.Duration
+	drops        *DropCounter
+	codec        Codec
+	reliable     *Reliable
+	fragments    *Reassembler
+	input        *bufio.Reader
+	talks        *Conversations
+}
+
+/****************************************************
+*@brief 定义一条会话记录
+*****************************************************
+*@param Time：消息时间
+*@param Sender：发送者
+*@param Receiver：接受者
+*@param Data：消息内容
+*@param Nonce：端到端加密随机数，非空时Data为密文
+*****************************************************/
+type Record struct {
+	Time     time.Time
+	Sender   string
+	Receiver string
+	Data     string
+	Nonce    string
+}
+
+/****************************************************
+*@brief 定义会话记录仓库，每个会话的记录按行以json格式
+保存在dir下的单独文件中
+*****************************************************
+*@param dir：记录目录
+*@param lock：读写进程并发访问锁
+*****************************************************/
+type History struct {
+	dir  string
+	lock sync.Mutex
+}
+
+/****************************************************
+*@function NewHistory(dir string) (*History, error)
+*****************************************************
+*@brief 新建会话记录仓库，目录不存在时创建
+*****************************************************
+*@access Public
+*****************************************************
+*@param dir：记录目录
+*****************************************************
+*@return *History：会话记录仓库
+*@return error：目录创建失败原因
+*****************************************************/
+func NewHistory(dir string) (*History, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &History{dir: dir}, nil
+}
+
+/****************************************************
+*@function func (h *History) path(a, b string) string
+*****************************************************
+*@brief 输出a与b之间会话的记录文件路径，与双方顺序无关
+*****************************************************
+*@access Private
+*****************************************************
+*@param a：会话一方用户名
+*@param b：会话另一方用户名
+*****************************************************
+*@return string：记录文件路径
+*****************************************************/
+func (h *History) path(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return filepath.Join(h.dir, fmt.Sprintf("%x_%x.txt", a, b))
+}
+
+/****************************************************
+*@function func (h *History) Append(record Record) error
+*****************************************************
+*@brief 追加一条会话记录
+*****************************************************
+*@access Public
+*****************************************************
+*@param record：会话记录
+*****************************************************
+*@return error：保存失败原因
+*****************************************************/
+func (h *History) Append(record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	file, err := os.OpenFile(h.path(record.Sender, record.Receiver), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+/****************************************************
+*@function func (h *History) Last(a, b string, n int) ([]Record, error)
+*****************************************************
+*@brief 输出a与b之间最近的n条会话记录
+*****************************************************
+*@access Public
+*****************************************************
+*@param a：会话一方用户名
+*@param b：会话另一方用户名
+*@param n：记录条数
+*****************************************************
+*@return []Record：按时间顺序排列的记录
+*@return error：读取失败原因
+*****************************************************/
+func (h *History) Last(a, b string, n int) ([]Record, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	records := make([]Record, 0)
+	file, err := os.Open(h.path(a, b))
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	for decoder.More() {
+		var record Record
+		err = decoder.Decode(&record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+		if len(records) > n {
+			records = records[1:]
+		}
+	}
+	return records, nil
+}
+
+/****************************************************
+*@brief 定义与某个对方之间的端到端加密状态，收发方向
+使用不同的密钥，随机数为递增计数
+*****************************************************
+*@param peerKey：建立加密状态时对方的身份公钥
+*@param send：发送方向AEAD
+*@param recv：接收方向AEAD
+*@param sendCount：已发送计数
+*@param recvMax：已接收的最大计数
+*@param recvWindow：最大计数之前64个计数的接收位图，用于防重放
+*****************************************************/
+type Secret struct {
+	peerKey    string
+	send       cipher.AEAD
+	recv       cipher.AEAD
+	sendCount  uint64
+	recvMax    uint64
+	recvWindow uint64
+}
+
+/****************************************************
+*@brief 定义本地端到端加密密钥仓库
+*****************************************************
+*@param lock：读写进程并发访问锁
+*@param identity：本地X25519身份私钥
+*@param peers：对方用户名->加密状态
+*****************************************************/
+type Secrets struct {
+	lock     sync.Mutex
+	identity *ecdh.PrivateKey
+	peers    map[string]*Secret
+}
+
+/****************************************************
+*@function NewSecrets() (*Secrets, error)
+*****************************************************
+*@brief 生成本地X25519身份密钥
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return *Secrets：密钥仓库
+*@return error：密钥生成失败原因
+*****************************************************/
+func NewSecrets() (*Secrets, error) {
+	identity, err := ecdh.X25519().GenerateKey(crand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Secrets{
+		identity: identity,
+		peers:    make(map[string]*Secret),
+	}, nil
+}
+
+/****************************************************
+*@function func (s *Secrets) PublicKey() string
+*****************************************************
+*@brief 输出身份公钥，base64url编码，不含"/"
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return string：身份公钥
+*****************************************************/
+func (s *Secrets) PublicKey() string {
+	return base64.RawURLEncoding.EncodeToString(s.identity.PublicKey().Bytes())
+}
+
+/****************************************************
+*@function DeriveAEAD(secret []byte, from, to string) (cipher.AEAD, error)
+*****************************************************
+*@brief 由共享密钥派生from发往to方向的AES-GCM密钥
+*****************************************************
+*@access Public
+*****************************************************
+*@param secret：X25519共享密钥
+*@param from：发送方用户名
+*@param to：接收方用户名
+*****************************************************
+*@return cipher.AEAD：加密接口
+*@return error：派生失败原因
+*****************************************************/
+func DeriveAEAD(secret []byte, from, to string) (cipher.AEAD, error) {
+	key, err := hkdf.Key(sha256.New, secret, nil, fmt.Sprintf("im e2e %s>%s", from, to), 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+/****************************************************
+*@function func (s *Secrets) Add(self, peer, peerKey string) error
+*****************************************************
+*@brief 根据对方身份公钥建立加密状态，公钥未变化时
+保留原有计数，对方重启或重新登录后公钥变化，收发计数
+与防重放窗口从头开始
+*****************************************************
+*@access Public
+*****************************************************
+*@param self：本地用户名
+*@param peer：对方用户名
+*@param peerKey：对方身份公钥，base64url编码
+*****************************************************
+*@return error：公钥无效或密钥派生失败原因
+*****************************************************/
+func (s *Secrets) Add(self, peer, peerKey string) error {
+	if peerKey == "" {
+		return errors.New("the peer did not publish a key")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(peerKey)
+	if err != nil {
+		return err
+	}
+	publicKey, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return err
+	}
+	shared, err := s.identity.ECDH(publicKey)
+	if err != nil {
+		return err
+	}
+	send, err := DeriveAEAD(shared, self, peer)
+	if err != nil {
+		return err
+	}
+	recv, err := DeriveAEAD(shared, peer, self)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	//同一个对方密钥不变时，继续使用原来的计数，避免随机数重复
+	if old, flag := s.peers[peer]; flag && old.peerKey == peerKey {
+		return nil
+	}
+	//对方换了密钥，新会话的计数从头开始
+	s.peers[peer] = &Secret{peerKey: peerKey, send: send, recv: recv}
+	return nil
+}
+
+/****************************************************
+*@function func (s *Secrets) Has(peer string) bool
+*****************************************************
+*@brief 判断是否与对方建立了加密状态
+*****************************************************
+*@access Public
+*****************************************************
+*@param peer：对方用户名
+*****************************************************
+*@return bool：是否已建立
+*****************************************************/
+func (s *Secrets) Has(peer string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, flag := s.peers[peer]
+	return flag
+}
+
+/****************************************************
+*@function func (s *Secrets) Seal(mess *Message) bool
+*****************************************************
+*@brief 加密发往mess.Receiver的消息内容，未建立加密
+状态时保持明文
+*****************************************************
+*@access Public
+*****************************************************
+*@param mess：待加密消息
+*****************************************************
+*@return bool：是否已加密
+*****************************************************/
+func (s *Secrets) Seal(mess *Message) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	secret, flag := s.peers[mess.Receiver]
+	if !flag {
+		return false
+	}
+	secret.sendCount++
+	nonce := make([]byte, secret.send.NonceSize())
+	binary.BigEndian.PutUint64(nonce, secret.sendCount)
+	aad := []byte(fmt.Sprintf("%s/%s/%s", mess.Cmd, mess.Sender, mess.Receiver))
+	sealed := secret.send.Seal(nil, nonce, []byte(mess.Data), aad)
+	mess.Nonce = base64.RawURLEncoding.EncodeToString(nonce)
+	mess.Data = base64.RawURLEncoding.EncodeToString(sealed)
+	return true
+}
+
+/****************************************************
+*@function func (s *Secrets) OpenStored(self string, mess *Message) error
+*****************************************************
+*@brief 解密服务器保存的会话记录，不做重放检查，
+自己发出的消息使用发送方向密钥解密
+*****************************************************
+*@access Public
+*****************************************************
+*@param self：本地用户名
+*@param mess：会话记录消息，成功后Data为明文
+*****************************************************
+*@return error：解密失败原因
+*****************************************************/
+func (s *Secrets) OpenStored(self string, mess *Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	peer := mess.Sender
+	if peer == self {
+		peer = mess.Receiver
+	}
+	secret, flag := s.peers[peer]
+	if !flag {
+		return errors.New("no key for this user")
+	}
+	aead := secret.recv
+	if mess.Sender == self {
+		aead = secret.send
+	}
+	nonce, err := base64.RawURLEncoding.DecodeString(mess.Nonce)
+	if err != nil || len(nonce) != aead.NonceSize() {
+		return errors.New("invalid nonce")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(mess.Data)
+	if err != nil {
+		return err
+	}
+	aad := []byte(fmt.Sprintf("chat/%s/%s", mess.Sender, mess.Receiver))
+	plain, err := aead.Open(nil, nonce, sealed, aad)
+	if err != nil {
+		return err
+	}
+	mess.Data = string(plain)
+	mess.Nonce = ""
+	return nil
+}
+
+/****************************************************
+*@function func (s *Secrets) Open(mess *Message) error
+*****************************************************
+*@brief 解密来自mess.Sender的消息内容，拒绝重放的消息
+*****************************************************
+*@access Public
+*****************************************************
+*@param mess：待解密消息，成功后Data为明文
+*****************************************************
+*@return error：解密失败或重放的原因
+*****************************************************/
+func (s *Secrets) Open(mess *Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	secret, flag := s.peers[mess.Sender]
+	if !flag {
+		return errors.New("no key for this user")
+	}
+	nonce, err := base64.RawURLEncoding.DecodeString(mess.Nonce)
+	if err != nil || len(nonce) != secret.recv.NonceSize() {
+		return errors.New("invalid nonce")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(mess.Data)
+	if err != nil {
+		return err
+	}
+	count := binary.BigEndian.Uint64(nonce)
+	//滑动窗口防重放：计数过旧或已经收到过的消息直接丢弃
+	if count == 0 || count+64 <= secret.recvMax {
+		return errors.New("replayed message")
+	}
+	if count <= secret.recvMax && secret.recvWindow&(1<<(secret.recvMax-count)) != 0 {
+		return errors.New("replayed message")
+	}
+	aad := []byte(fmt.Sprintf("%s/%s/%s", mess.Cmd, mess.Sender, mess.Receiver))
+	plain, err := secret.recv.Open(nil, nonce, sealed, aad)
+	if err != nil {
+		return err
+	}
+	if count > secret.recvMax {
+		shift := count - secret.recvMax
+		if shift >= 64 {
+			secret.recvWindow = 0
+		} else {
+			secret.recvWindow <<= shift
+		}
+		secret.recvWindow |= 1
+		secret.recvMax = count
+	} else {
+		secret.recvWindow |= 1 << (secret.recvMax - count)
+	}
+	mess.Data = string(plain)
+	mess.Nonce = ""
+	return nil
+}
+
+/****************************************************
+*@function CodecOffer(preferred string) string
+*****************************************************
+*@brief 输出connect时提供给服务器的编解码，优先的排
+在最前，其余按默认顺序
+*****************************************************
+*@access Public
+*****************************************************
+*@param preferred：优先使用的编解码
+*****************************************************
+*@return string：逗号分隔的编解码名称
+*****************************************************/
+func CodecOffer(preferred string) string {
+	names := []string{preferred}
+	for _, codec := range Codecs {
+		if codec.Name() != preferred {
+			names = append(names, codec.Name())
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+/****************************************************
+*@function IsKeyword(name string) bool
+*****************************************************
+*@brief 判断输入是否为客户端指令关键字，关键字不能作为用户名
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return bool：是否为关键字
+*****************************************************/
+func IsKeyword(name string) bool {
+	switch name {
+	case "list", "group", "quit", "join", "leave", "rooms", "mode", "register", "login", "mail", "history", "logout", "accept", "decline", "switch", "msg", "status", "watch", "unwatch":
+		return true
+	}
+	return false
+}
+
+/****************************************************
+*@function PeerCommand(cmd string) bool
+*****************************************************
+*@brief 判断消息指令是否可以由其他客户端直接发出，其余
+指令只能来自服务器，来自其他地址的是伪造的
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：消息指令
+*****************************************************
+*@return bool：是否可以由其他客户端发出
+*****************************************************/
+func PeerCommand(cmd string) bool {
+	switch cmd {
+	case "chat", "quit", "ack", "punch", "punchack":
+		return true
+	}
+	return false
+}
+
+/****************************************************
+*@function SplitArgs(str string, n int) []string
+*****************************************************
+*@brief 拆分指令参数，前n-1个参数以空白分隔，最后一个
+参数保留原样，用于带消息内容的指令
+*****************************************************
+*@access Public
+*****************************************************
+*@param str：用户输入
+*@param n：最多拆分的参数个数
+*****************************************************
+*@return []string：参数，个数不超过n
+*****************************************************/
+func SplitArgs(str string, n int) []string {
+	args := make([]string, 0, n)
+	rest := strings.TrimSpace(str)
+	for len(args) < n-1 && rest != "" {
+		index := strings.IndexAny(rest, " \t")
+		if index < 0 {
+			break
+		}
+		args = append(args, rest[:index])
+		rest = strings.TrimSpace(rest[index:])
+	}
+	if rest != "" {
+		args = append(args, rest)
+	}
+	return args
+}
+
+/****************************************************
+*@function Login(config *Config) User
+*****************************************************
+*@brief 本地创建user，同时向服务器注册
+*****************************************************
+*@access Public
+*****************************************************
+*@param config *Config 客户端配置，包括服务器登录地址、
+本地监听地址以及服务器CA证书路径
+*****************************************************
+*@return user
+*****************************************************/
+func Login(config *Config) User { //本地监听端口，未配置时由系统分配
+	loginPort, caFile := config.ServerAddr, config.CAFile
+	user := new(User)
+	udpAddr, err := net.ResolveUDPAddr("udp", LocalAddr(config.LocalAddr))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	listener, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	udpAddr = listener.LocalAddr().(*net.UDPAddr)
+	fmt.Printf("localAddr:%v\n", udpAddr.String())
+	user.reader = listener
+	user.input = bufio.NewReader(os.Stdin)
+	//生成端到端加密身份密钥，公钥随connect上报服务器
+	user.secrets, err = NewSecrets()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	//向服务器注册端口发起注册
+	loginConn, err := DialLogin(loginPort, caFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer loginConn.Close()
+	mes := Message{
+		Cmd:      "connect",
+		Sender:   loginConn.LocalAddr().String(),
+		Data:     udpAddr.String(),
+		Receiver: "server",
+		Key:      user.secrets.PublicKey(),
+		Codec:    CodecOffer(config.Codec),
+	}
+	//json加密发送消息
+	coder := json.NewEncoder(loginConn)
+	err = coder.Encode(mes)
+	if err != nil {
+		fmt.Println(err)
+	}
+	//获取服务器返回的chat、beat端口
+	decoder := json.NewDecoder(loginConn)
+	err = decoder.Decode(&mes)
+	if err != nil {
+		fmt.Println(err)
+	}
+	user.chatPort = mes.Data
+	//服务器选中的编解码，旧服务器不返回Codec时为nil，即json
+	user.codec = CodecByName(mes.Codec)
+	//fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mes.Cmd, mes.Data, mes.Sender, mes.Receiver)
+	user.remoteClient = &User{
+		reader:       nil,
+		remoteClient: nil,
+		name:         "server",
+		chatPort:     "",
+	}
+	//接收welcome介绍
+	err = decoder.Decode(&mes)
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println(mes.Data)
+	fmt.Println("1.list: used to list all users")
+	fmt.Println("2. group: group XXX used to create a conversation between XXX, group XXX YYY creates a room with them")
+	fmt.Println("3.quit:used to quit a conversation")
+	fmt.Println("4.join: join ROOM [XXX YYY] used to join a room, creating it and inviting XXX YYY if given")
+	fmt.Println("5.leave: used to leave the current room")
+	fmt.Println("6.rooms: used to list all rooms and their members")
+	fmt.Println("7.mode: mode auto|direct|relay used to choose how conversations are sent")
+	fmt.Println("8.mail: mail XXX MESSAGE used to leave a message for XXX, delivered when XXX logs in")
+	fmt.Println("9.history: history XXX [n] used to show the last n messages with XXX")
+	fmt.Println("10.logout: used to log out and release your name")
+	fmt.Println("11.accept: accept [XXX] used to accept the invitation from XXX, or the earliest one")
+	fmt.Println("12.decline: decline [XXX] used to decline the invitation from XXX, or the earliest one")
+	fmt.Println("13.switch: switch [XXX] used to list your conversations, or bring the one with XXX to the front; @XXX MESSAGE sends to XXX without switching")
+	fmt.Println("14.msg: msg XXX MESSAGE used to send XXX one message through the server without starting a conversation")
+	fmt.Println("15.status: status available|away|busy|dnd [TEXT] used to set your status shown in list, dnd refuses conversations and msg")
+	fmt.Println("16.watch: watch [XXX] used to be told when XXX logs in, logs out or changes status, or to show everyone you watch")
+	fmt.Println("17.unwatch: unwatch XXX used to stop watching XXX")
+	fmt.Println("end a line with \\ to continue the message on the next line")
+	fmt.Println()
+	//输入用户名,服务器端检查是否被使用
+	flag := true
+	for flag {
+		line, err := user.ReadInput()
+		if err != nil {
+			//标准输入已结束，无法再登录
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		//输入格式：register 用户名 密码、login 用户名 密码，或者只输入用户名以游客登录
+		input := strings.Fields(line)
+		cmd := "login"
+		data := ""
+		if len(input) == 3 && (input[0] == "register" || input[0] == "login") {
+			cmd = input[0]
+			user.name = input[1]
+			data = fmt.Sprintf("%s/%s", input[1], input[2])
+		} else {
+			user.name = line
+			data = user.name
+		}
+		if IsKeyword(user.name) {
+			fmt.Println("you can not use the keyword as your name")
+		} else if strings.ContainsAny(user.name, "/ \t\n") {
+			fmt.Println("the name can not contain \"/\" or spaces")
+		} else {
+			mes = Message{
+				Cmd:      cmd,
+				Sender:   loginConn.LocalAddr().String(),
+				Data:     data,
+				Receiver: "server",
+			}
+			//fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mes.Cmd, mes.Data, mes.Sender, mes.Receiver)
+			encoder := json.NewEncoder(loginConn)
+			err = encoder.Encode(mes)
+			if err != nil {
+				fmt.Println(err)
+			}
+			err = decoder.Decode(&mes)
+			//fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mes.Cmd, mes.Data, mes.Sender, mes.Receiver)
+			if err != nil {
+				fmt.Println(err)
+			}
+			if mes.Data == "success" {
+				fmt.Println("success to login")
+				user.token = mes.Token
+				//接收离线留言数，直到mailend，新服务器在登录后经udp投递
+				//留言，旧服务器在mailend之前逐条发送
+				for mes.Cmd != "mailend" {
+					err = decoder.Decode(&mes)
+					if err != nil {
+						fmt.Println(err)
+						break
+					}
+					if mes.Cmd == "mail" {
+						//mes.Data格式为：留言时间/留言内容
+						mailList := strings.SplitN(mes.Data, "/", 2)
+						if len(mailList) == 2 {
+							fmt.Printf("[mail %s]<%s>:%s\n", mailList[0], mes.Sender, mailList[1])
+						}
+					} else if mes.Cmd == "mailend" && mes.Data != "0" {
+						fmt.Printf("you have %s offline messages\n", mes.Data)
+					}
+				}
+				break
+			} else if mes.Data == "fail" {
+				fmt.Println("the name has already been token,please try another name")
+				mes.Sender, mes.Receiver = mes.Receiver, mes.Sender
+			} else {
+				//服务器返回失败原因
+				fmt.Println(mes.Data)
+			}
+		}
+	}
+	//fmt.Println(*user)
+	return *user
+}
+
+/****************************************************
+*@function func (u *User) ReadInput() (string, error)
+*****************************************************
+*@brief 读取一条用户输入，长度不限。行末为\时继续读取
+下一行，多行之间以换行符连接
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return string：去掉首尾空白的输入
+*@return error：标准输入已结束或读取失败
+*****************************************************/
+func (u *User) ReadInput() (string, error) {
+	lines := make([]string, 0, 1)
+	for {
+		line, err := u.input.ReadString('\n')
+		if err != nil && line == "" {
+			if len(lines) == 0 {
+				return "", err
+			}
+			break
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if !strings.HasSuffix(line, "\\") {
+			lines = append(lines, line)
+			break
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\\"))
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n")), nil
+}
+
+/****************************************************
+*@function DialLogin(loginPort string, caFile string) (net.Conn, error)
+*****************************************************
+*@brief 连接服务器登录端口，caFile非空时使用TLS，
+并固定只信任caFile中的CA
+*****************************************************
+*@access Public
+*****************************************************
+*@param loginPort string 服务器登录地址
+*@param caFile string 服务器CA证书路径
+*****************************************************
+*@return net.Conn：登录连接
+*@return error：连接失败原因
+*****************************************************/
+func DialLogin(loginPort string, caFile string) (net.Conn, error) {
+	if caFile == "" {
+		return net.Dial("tcp", loginPort)
+	}
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("%s: no certificate found", caFile)
+	}
+	host, _, err := net.SplitHostPort(loginPort)
+	if err != nil {
+		return nil, err
+	}
+	return tls.Dial("tcp", loginPort, &tls.Config{
+		RootCAs:    pool,
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	})
+}
+
+/****************************************************
+*@function func (u *User) Read(groupCh chan string)
+*****************************************************
+*@brief 监听本地端口
+*****************************************************
+*@access Public
+*****************************************************
+*@param groupCh chan string 读写进程间group状态交互channel
+*****************************************************
+*@return 无
+*****************************************************/
+func (u *User) Read(groupCh chan string, logger *log.Logger) {
+	//用于区分服务器中转与直连的消息
+	serverAddr, err := net.ResolveUDPAddr("udp", u.chatPort)
+	if err != nil {
+		logger.Printf("read:%v\n", err)
+	}
+	buffer := make([]byte, 65536)
+	for {
+		//逐个读取数据报，同时获取对方的udp地址，用于打洞应答
+		count, remoteAddr, err := u.reader.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			logger.Printf("read:%v\n", err)
+			continue
+		}
+		//分片收齐后解码为一条消息，不合法的数据报计数后丢弃
+		data, err := u.fragments.Add(remoteAddr.String(), buffer[:count])
+		if err == nil && data == nil {
+			continue
+		}
+		var mess Message
+		if err == nil {
+			mess, err = DecodeFrame(data)
+		}
+		if err != nil {
+			reason := "payload"
+			var frameErr *FrameError
+			if errors.As(err, &frameErr) {
+				reason = frameErr.Reason
+			}
+			logger.Printf("read: drop from %v (%d %s drops):%v\n", remoteAddr, u.drops.Drop(reason), reason, err)
+			continue
+		}
+		logger.Printf("read:%v\n", mess)
+		fromServer := serverAddr != nil && remoteAddr.String() == serverAddr.String()
+		if !PeerCommand(mess.Cmd) && !fromServer {
+			logger.Printf("read: drop %v from %v (%d source drops): not the server\n", mess.Cmd, remoteAddr, u.drops.Drop("source"))
+			continue
+		}
+		//打洞消息不显示
+		if mess.Cmd == "punch" || mess.Cmd == "punchack" {
+			u.PunchReply(mess, remoteAddr, logger)
+			continue
+		}
+		//对方确认收到，停止重传
+		if mess.Cmd == "ack" {
+			u.reliable.Ack(mess.Data)
+			continue
+		}
+		//需要确认的消息原路回复ack，重传造成的重复消息不再显示
+		if mess.ID != "" {
+			ack := Message{
+				Cmd:      "ack",
+				Sender:   u.name,
+				Data:     mess.ID,
+				Receiver: mess.Sender,
+			}
+			writer := PeerWriter{conn: u.reader, addr: remoteAddr}
+			if fromServer {
+				ack.Token = u.token
+				writer.codec = u.codec
+			}
+			err := writer.Send(ack)
+			if err != nil {
+				logger.Printf("read:%v\n", err)
+			}
+			if u.reliable.Duplicate(mess.Sender, mess.ID) {
+				continue
+			}
+		}
+		now := fmt.Sprintf("%d:%d:%d", time.Now().Hour(), time.Now().Minute(), time.Now().Second())
+		fmt.Printf("%s:", now)
+		//新服务器在Payload中携带结构化内容，旧服务器只有Data
+		payload, typed := ParsePayload(mess)
+		if typed && payload.Error != nil {
+			fmt.Println(payload.Error.Text)
+			logger.Printf("read: %s error %d\n", mess.Cmd, payload.Error.Code)
+			continue
+		}
+		switch mess.Cmd {
+		//list指令，显示所有在线用户名
+		case "list":
+			{
+				fmt.Println("these online users are:")
+				userlist := strings.Split(mess.Data, "/")
+				if typed && payload.List != nil {
+					userlist = payload.List.Users
+					//新服务器同时返回用户状态
+					if len(payload.List.Statuses) == len(userlist) {
+						for i, status := range payload.List.Statuses {
+							userlist[i] = FormatStatus(status)
+						}
+					}
+				}
+				for _, userName := range userlist {
+					fmt.Println(userName)
+				}
+			}
+		//group指令，收到后，保存会话用户
+		case "group":
+			{
+				//fmt.Println(mess.Data)
+				//mess.Data包含5部分数据：1.发起者(1)\接受者(0)标志；2.名字；3.服务器观察到的公网udp地址；4.内网udp地址；5.身份公钥
+				groupList := strings.Split(mess.Data, "/")
+				if typed && payload.Offer != nil {
+					offer := payload.Offer
+					flag := "0"
+					if offer.Sponsor {
+						flag = "1"
+					}
+					groupList = []string{flag, offer.Name, offer.PublicAddr, offer.PrivateAddr, offer.Key}
+				}
+				//fmt.Println(groupList)
+				if groupList[0] == "0" {
+					fmt.Printf("now you can talk to %s\n", groupList[1])
+					groupInfo := strings.Join(groupList[1:], "/")
+					groupCh <- groupInfo
+				} else if groupList[0] == "1" {
+					fmt.Printf("now you can talk to %s\n", groupList[1])
+					groupInfo := strings.Join(groupList[1:], "/")
+					groupCh <- groupInfo
+				} else {
+					fmt.Println(mess.Data)
+				}
+
+			}
+			//invite指令，收到会话邀请，或者自己发出的邀请正在等待对方接受
+		case "invite":
+			{
+				if !typed || payload.Invite == nil {
+					fmt.Println(mess.Data)
+				} else if payload.Invite.To == u.name {
+					fmt.Printf("%s want talk to you, input \"accept %s\" or \"decline %s\" in %d seconds\n", payload.Invite.From, payload.Invite.From, payload.Invite.From, payload.Invite.Timeout)
+				} else {
+					fmt.Printf("waiting for %s to accept in %d seconds\n", payload.Invite.To, payload.Invite.Timeout)
+				}
+			}
+			//decline指令，服务器确认已拒绝邀请
+		case "decline":
+			{
+				fmt.Println(mess.Data)
+			}
+			//quit指令，收到后清除会话用户
+		case "quit":
+			{
+				//服务器发出的quit，Data为离开的用户
+				peer := mess.Sender
+				if mess.Sender == "server" {
+					peer = mess.Data
+				}
+				groupCh <- "quit/" + peer
+			}
+			//chat指令，收到后，显示会话内容
+		case "chat":
+			{
+				if mess.Nonce != "" {
+					err := u.secrets.Open(&mess)
+					if err != nil {
+						logger.Printf("read:%v\n", err)
+						fmt.Printf("dropped a message from %s: %v\n", mess.Sender, err)
+						break
+					}
+				} else if mess.Sender != "server" && u.secrets.Has(mess.Sender) {
+					//已建立加密会话却收到明文，提示可能被伪造
+					fmt.Printf("<%s>(unencrypted):%s\n", mess.Sender, mess.Data)
+					break
+				}
+				//不在前台的会话暂存消息，切换后显示
+				line := fmt.Sprintf("<%s>:%s", mess.Sender, mess.Data)
+				if count := u.talks.Deliver(mess.Sender, now+":"+line); count > 0 {
+					fmt.Printf("[%d unread from %s, input \"switch %s\"]\n", count, mess.Sender, mess.Sender)
+				} else {
+					fmt.Println(line)
+				}
+				//直连与中转的消息都以明文保存在本地，服务器保存的密文重启后无法解密
+				if mess.Sender != "server" {
+					err := u.history.Append(Record{
+						Time:     time.Now(),
+						Sender:   mess.Sender,
+						Receiver: u.name,
+						Data:     mess.Data,
+					})
+					if err != nil {
+						logger.Printf("read:%v\n", err)
+					}
+				}
+			}
+			//history指令，服务器返回的会话记录，最后一条由server发出，Data为记录条数
+		case "history":
+			{
+				if mess.Sender == "server" {
+					fmt.Printf("%s messages with %s\n", mess.Data, mess.Receiver)
+					break
+				}
+				//mess.Data格式为：消息时间/消息内容
+				historyList := strings.SplitN(mess.Data, "/", 2)
+				if len(historyList) != 2 {
+					break
+				}
+				mess.Data = historyList[1]
+				if mess.Nonce != "" && u.secrets.OpenStored(u.name, &mess) != nil {
+					mess.Data = "[encrypted]"
+				}
+				fmt.Printf("[%s]<%s>:%s\n", historyList[0], mess.Sender, mess.Data)
+			}
+			//mail指令，在线收到的留言，或者服务器对留言的反馈
+		case "mail":
+			{
+				if mess.Sender == "server" {
+					fmt.Println(mess.Data)
+				} else {
+					fmt.Printf("[mail]<%s>:%s\n", mess.Sender, mess.Data)
+				}
+			}
+			//mailbox指令，登录后收到的离线留言，作者在Payload中，
+			//Data格式为：留言时间/留言内容
+		case "mailbox":
+			{
+				if typed && payload.Note != nil {
+					fmt.Printf("[mail %s]<%s>:%s\n", payload.Note.Time, payload.Note.From, payload.Note.Text)
+					break
+				}
+				mailList := strings.SplitN(mess.Data, "/", 2)
+				if len(mailList) == 2 {
+					fmt.Printf("[mail %s]<%s>:%s\n", mailList[0], mess.Sender, mailList[1])
+				}
+			}
+			//status指令，服务器确认设置的状态
+		case "status":
+			{
+				fmt.Println(mess.Data)
+			}
+			//presence指令，关注的联系人上线、下线或者改变状态
+		case "presence":
+			{
+				if typed && payload.Status != nil {
+					fmt.Printf("[presence]%s\n", FormatStatus(*payload.Status))
+				} else {
+					fmt.Printf("[presence]%s\n", mess.Data)
+				}
+			}
+			//watch指令，服务器返回全部联系人的当前状态
+		case "watch":
+			{
+				contacts := make([]string, 0)
+				if typed && payload.List != nil {
+					for _, status := range payload.List.Statuses {
+						contacts = append(contacts, FormatStatus(status))
+					}
+				} else if mess.Data != "" {
+					contacts = strings.Split(mess.Data, "/")
+				}
+				if len(contacts) == 0 {
+					fmt.Println("you are not watching anyone")
+					break
+				}
+				fmt.Println("you are watching:")
+				for _, contact := range contacts {
+					fmt.Println(contact)
+				}
+			}
+			//unwatch指令，服务器确认取消关注
+		case "unwatch":
+			{
+				fmt.Println(mess.Data)
+			}
+			//kick指令，被管理员踢出，显示原因后通知写进程退出，
+			//读进程不再处理后续消息
+		case "kick":
+			{
+				fmt.Printf("[kicked]%s\n", mess.Data)
+				logger.Printf("read: kicked:%v\n", mess.Data)
+				groupCh <- "kick/" + mess.Data
+				return
+			}
+			//broadcast指令，管理员发给所有在线用户的通知
+		case "broadcast":
+			{
+				fmt.Printf("[notice]%s\n", mess.Data)
+			}
+			//msg指令，服务器转发的单条消息
+		case "msg":
+			{
+				if typed && payload.Note != nil {
+					fmt.Printf("[msg]<%s>:%s\n", payload.Note.From, payload.Note.Text)
+				} else {
+					fmt.Printf("[msg]<%s>:%s\n", mess.Sender, mess.Data)
+				}
+			}
+			//join指令，mess.Data包含房间名以及全部成员，Sender为新加入的成员
+		case "join":
+			{
+				if mess.Sender == "server" {
+					fmt.Println(mess.Data)
+					break
+				}
+				joinList := strings.Split(mess.Data, "/")
+				if typed && payload.Room != nil {
+					joinList = append([]string{payload.Room.Name}, payload.Room.Members...)
+				}
+				if mess.Sender == u.name {
+					fmt.Printf("now you are in room <%s> with %s\n", joinList[0], strings.Join(joinList[1:], ","))
+					groupCh <- fmt.Sprintf("join/%s", joinList[0])
+				} else {
+					fmt.Printf("%s joined room <%s>\n", mess.Sender, joinList[0])
+				}
+			}
+			//leave指令，有成员离开房间
+		case "leave":
+			{
+				if mess.Sender == "server" {
+					fmt.Println(mess.Data)
+				} else if mess.Sender == u.name {
+					fmt.Printf("you left room <%s>\n", mess.Data)
+				} else {
+					fmt.Printf("%s left room <%s>\n", mess.Sender, mess.Data)
+				}
+			}
+			//rooms指令，显示所有房间及成员
+		case "rooms":
+			{
+				roomList := make([]string, 0)
+				if typed && payload.Rooms != nil {
+					for _, room := range payload.Rooms.Rooms {
+						roomList = append(roomList, fmt.Sprintf("%s:%s", room.Name, strings.Join(room.Members, ",")))
+					}
+				} else if mess.Data != "" {
+					roomList = strings.Split(mess.Data, "/")
+				}
+				if len(roomList) == 0 {
+					fmt.Println("there is no room now")
+					break
+				}
+				fmt.Println("these rooms are:")
+				for _, room := range roomList {
+					fmt.Println(room)
+				}
+			}
+			//roomchat指令，显示房间内的会话内容
+		case "roomchat":
+			{
+				fmt.Printf("[%s]<%s>:%s\n", mess.Receiver, mess.Sender, mess.Data)
+			}
+		}
+	}
+}
+
+/****************************************************
+*@function HeartBeat(conn PacketConn, beatAddr string, userName string, token string, interval time.Duration, codec Codec)
+*****************************************************
+*@brief 本地发送心跳接口，心跳从本地监听端口发出，
+服务器据此记录客户端的公网udp地址
+*****************************************************
+*@access Public
+*****************************************************
+*@param conn PacketConn 本地监听端口
+*@param beatAddr string 服务器监听地址
+*@param userName string 用户名
+*@param token string 会话令牌
+*@param interval time.Duration 心跳间隔
+*@param codec Codec 与服务器协商的编解码
+*****************************************************
+*@return 无
+*****************************************************/
+func HeartBeat(conn PacketConn, beatAddr string, userName string, token string, interval time.Duration, codec Codec) {
+	udpAddr, err := net.ResolveUDPAddr("udp", beatAddr)
+	if err != nil {
+		fmt.Println(err)
+	}
+	timer := time.NewTimer(interval)
+	writer := PeerWriter{conn: conn, addr: udpAddr, codec: codec}
+	for {
+		select {
+		case <-timer.C:
+			{
+				mess := Message{
+					Cmd:      "beat",
+					Sender:   userName,
+					Data:     "",
+					Receiver: "server",
+					Token:    token,
+				}
+				//fmt.Println(mess)
+				err := writer.Send(mess)
+				if err != nil {
+					fmt.Println(err)
+				}
+			}
+		}
+		timer.Reset(interval)
+	}
+}
+
+/****************************************************
+*@function Write(serverAddr string)
+*****************************************************
+*@brief 本地输入接口，绑定本地唯一发送端口
+加开一个进程，用于发送心跳，维护在线状态
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return 无
+*****************************************************/
+func (u *User) Write(groupCh chan string, logger *log.Logger) {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	//开启进程，定时发送心跳，维护在线
+	go func(beatPort string, userName string) {
+		HeartBeat(u.reader, beatPort, userName, u.token, u.beatInterval, u.codec)
+	}(u.chatPort, u.name)
+	//接收用户输入并发送
+	inputCh := make(chan string)
+	go func(ch chan string) {
+		for {
+			fmt.Printf("<%s>:", u.name)
+			str, err := u.ReadInput()
+			if err != nil {
+				//标准输入结束后不再读取，仍然接收消息
+				if err != io.EOF {
+					fmt.Println(err)
+				}
+				return
+			}
+			ch <- str
+		}
+	}(inputCh)
+	//发往服务器的消息同样从本地监听端口发出，服务器据此校验来源地址
+	chatUdpAddr, err := net.ResolveUDPAddr("udp", u.chatPort)
+	if err != nil {
+		fmt.Println(err)
+		logger.Printf("write:%v\n", err)
+		return
+	}
+	chatConn := PeerWriter{conn: u.reader, addr: chatUdpAddr, codec: u.codec}
+	for {
+		//并发逻辑，收到group命令后，输入内容发送给client
+		/*******************************************************
+			存在一个问题是，与服务器之间的通信时在default中，
+			发送完group之后进入default中，等待下一个输入
+
+			解决办法：
+		******************************************************/
+		select {
+		case groupInfo := <-groupCh:
+			{
+				if strings.HasPrefix(groupInfo, "kick/") {
+					//被管理员踢出，客户端退出
+					return
+				} else if strings.HasPrefix(groupInfo, "join/") {
+					//加入房间，进入群聊
+					if !u.RoomChat(strings.TrimPrefix(groupInfo, "join/"), inputCh, groupCh, chatConn, logger) {
+						return
+					}
+				} else {
+					//对方退出或者收到会话通知
+					u.Converse(groupInfo, chatConn, logger)
+				}
+			}
+		case str := <-inputCh:
+			{
+				fmt.Println(str)
+				if !u.Command(str, chatConn, logger) {
+					return
+				}
+			}
+		}
+	}
+}
+
+/****************************************************
+*@function func (u *User) Command(str string, chatConn PeerWriter, logger *log.Logger) bool
+*****************************************************
+*@brief 处理一行用户输入：有前台会话时指令以外的输入发给
+对方，否则按指令发往服务器或在本地处理
+*****************************************************
+*@access Public
+*****************************************************
+*@param str string 用户输入
+*@param chatConn PeerWriter 服务器消息端口写接口
+*@param logger *log.Logger 日志文件
+*****************************************************
+*@return bool 注销后返回false，客户端退出
+*****************************************************/
+func (u *User) Command(str string, chatConn PeerWriter, logger *log.Logger) bool {
+	var mess Message
+	//有前台会话时，指令以外的输入发给对方
+	active := u.talks.Active()
+	lists := strings.Fields(str)
+	if active != "" && (len(lists) == 0 || !IsKeyword(lists[0]) && !strings.HasPrefix(lists[0], "@")) {
+		u.Chat(active, str, logger)
+		return true
+	}
+	sendFlag := false
+	if str == "list" {
+		mess = Message{
+			Cmd:      str,
+			Sender:   u.name,
+			Data:     "",
+			Receiver: "server",
+		}
+		sendFlag = true
+	} else if str == "quit" && active != "" {
+		//结束前台会话
+		u.Quit(active, logger)
+	} else if str == "quit" {
+		mess = Message{
+			Cmd:      str,
+			Sender:   u.name,
+			Data:     "",
+			Receiver: "server",
+		}
+		sendFlag = true
+	} else if str == "logout" {
+		//注销后服务器立即释放用户名，客户端退出
+		mess = Message{
+			Cmd:      str,
+			Sender:   u.name,
+			Data:     "",
+			Receiver: "server",
+			Token:    u.token,
+		}
+		err := chatConn.Send(mess)
+		if err != nil {
+			fmt.Println(err)
+			logger.Printf("write:%v\n", err)
+		}
+		fmt.Println("logged out")
+		return false
+	} else if strings.HasPrefix(str, "mode") {
+		mode := strings.TrimSpace(strings.TrimPrefix(str, "mode"))
+		if active != "" && (mode == "direct" || mode == "relay") {
+			//会话中切换前台会话的模式
+			u.SwitchMode(active, mode, chatConn)
+		} else if mode == "auto" || mode == "direct" || mode == "relay" {
+			u.chatMode = mode
+			fmt.Printf("conversations will use %s mode\n", mode)
+		} else {
+			fmt.Println("usage: mode auto|direct|relay")
+		}
+	} else if str == "rooms" {
+		mess = Message{
+			Cmd:      str,
+			Sender:   u.name,
+			Data:     "",
+			Receiver: "server",
+		}
+		sendFlag = true
+	} else if len(lists) > 0 && strings.HasPrefix(lists[0], "@") {
+		u.ChatTo(str, logger)
+	} else if len(lists) > 0 && lists[0] == "switch" {
+		u.Switch(lists[1:])
+	} else {
+		if len(lists) > 0 && lists[0] == "group" {
+			if len(lists) == 2 {
+				if lists[1] == u.name { //如果选着跟自己交谈，就没必要了吧
+					fmt.Println("you can talk to yourself without me")
+				} else {
+					mess = Message{
+						Cmd:      lists[0],
+						Sender:   u.name,
+						Data:     strings.Join(lists[1:len(lists)], "/"),
+						Receiver: "server",
+					}
+					sendFlag = true
+				}
+			} else if len(lists) > 2 { //多人会话，以发起者命名建立房间
+				mess = Message{
+					Cmd:      "join",
+					Sender:   u.name,
+					Data:     fmt.Sprintf("%s-room/%s", u.name, strings.Join(lists[1:], "/")),
+					Receiver: "server",
+					Payload:  NewPayload(Payload{Room: &RoomInfo{Name: u.name + "-room", Members: lists[1:]}}),
+				}
+				sendFlag = true
+			} else {
+				fmt.Println("usage: group XXX [YYY ...]")
+			}
+		} else if len(lists) > 0 && lists[0] == "join" {
+			if len(lists) >= 2 {
+				mess = Message{
+					Cmd:      "join",
+					Sender:   u.name,
+					Data:     strings.Join(lists[1:], "/"),
+					Receiver: "server",
+					Payload:  NewPayload(Payload{Room: &RoomInfo{Name: lists[1], Members: lists[2:]}}),
+				}
+				sendFlag = true
+			} else {
+				fmt.Println("usage: join ROOM [XXX YYY ...]")
+			}
+		} else if len(lists) > 0 && lists[0] == "history" {
+			u.History(str, chatConn, logger)
+		} else if len(lists) > 0 && lists[0] == "mail" {
+			mailList := SplitArgs(str, 3)
+			if len(mailList) == 3 {
+				mess = Message{
+					Cmd:      "mail",
+					Sender:   u.name,
+					Data:     mailList[2],
+					Receiver: mailList[1],
+				}
+				sendFlag = true
+			} else {
+				fmt.Println("usage: mail XXX MESSAGE")
+			}
+		} else if len(lists) > 0 && lists[0] == "msg" {
+			//单条消息由服务器按Receiver转发，不建立会话
+			msgList := SplitArgs(str, 3)
+			if len(msgList) == 3 {
+				mess = Message{
+					Cmd:      "msg",
+					Sender:   u.name,
+					Data:     msgList[2],
+					Receiver: msgList[1],
+				}
+				sendFlag = true
+			} else {
+				fmt.Println("usage: msg XXX MESSAGE")
+			}
+		} else if len(lists) > 0 && lists[0] == "status" {
+			//状态说明可以包含空格
+			statusList := SplitArgs(str, 3)
+			if len(statusList) >= 2 && ValidStatus(statusList[1]) {
+				status := UserStatus{Name: u.name, Status: statusList[1]}
+				if len(statusList) == 3 {
+					status.Text = statusList[2]
+				}
+				mess = Message{
+					Cmd:      "status",
+					Sender:   u.name,
+					Data:     fmt.Sprintf("%s/%s", status.Status, status.Text),
+					Receiver: "server",
+					Payload:  NewPayload(Payload{Status: &status}),
+				}
+				sendFlag = true
+			} else {
+				fmt.Println("usage: status available|away|busy|dnd [TEXT]")
+			}
+		} else if len(lists) > 0 && (lists[0] == "watch" || lists[0] == "unwatch") {
+			//watch不带参数时列出全部联系人
+			if len(lists) == 2 || (len(lists) == 1 && lists[0] == "watch") {
+				mess = Message{
+					Cmd:      lists[0],
+					Sender:   u.name,
+					Data:     strings.Join(lists[1:], ""),
+					Receiver: "server",
+				}
+				sendFlag = true
+			} else if lists[0] == "watch" {
+				fmt.Println("usage: watch [XXX]")
+			} else {
+				fmt.Println("usage: unwatch XXX")
+			}
+		} else if len(lists) > 0 && (lists[0] == "accept" || lists[0] == "decline") {
+			//不指定发起者时处理最早的邀请
+			if len(lists) <= 2 {
+				mess = Message{
+					Cmd:      lists[0],
+					Sender:   u.name,
+					Data:     strings.Join(lists[1:], ""),
+					Receiver: "server",
+				}
+				sendFlag = true
+			} else {
+				fmt.Printf("usage: %s [XXX]\n", lists[0])
+			}
+		} else if str == "leave" {
+			fmt.Println("you are not in any room")
+		}
+	}
+	if sendFlag {
+		mess.Token = u.token
+		var err error
+		if mess.Cmd == "group" || mess.Cmd == "quit" || mess.Cmd == "accept" || mess.Cmd == "decline" {
+			//会话请求需要服务器确认
+			err = u.reliable.Send(mess, chatConn.Send, u.NotDelivered(fmt.Sprintf(" %s to server", mess.Cmd)))
+		} else {
+			err = chatConn.Send(mess)
+		}
+		if err != nil {
+			u.NotSent(err, logger)
+		}
+	}
+	return true
+}
+
+/****************************************************
+*@brief 通过本地监听端口向指定地址发送数据的写接口，
+保证直连消息与心跳、打洞使用同一个NAT映射
+*****************************************************
+*@param conn:本地监听端口
+*@param addr:对方udp地址
+*@param codec:编解码，发往服务器时使用协商结果，发往对方
+客户端时为nil，即json
+*****************************************************/
+type PeerWriter struct {
+	conn  PacketConn
+	addr  *net.UDPAddr
+	codec Codec
+}
+
+/****************************************************
+*@function func (w PeerWriter) Send(mess Message) error
+*****************************************************
+*@brief 将一条消息编码后发送给对方，长消息分片发送
+*****************************************************
+*@access Public
+*****************************************************
+*@param mess Message 待发送消息
+*****************************************************
+*@return error：编码或发送失败原因
+*****************************************************/
+func (w PeerWriter) Send(mess Message) error {
+	frames, err := EncodeFrames(w.codec, mess)
+	if err != nil {
+		return err
+	}
+	for _, data := range frames {
+		_, err = w.conn.WriteToUDP(data, w.addr)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/****************************************************
+*@brief 可靠投递的重传上限，保证逐次加倍的等待时间与
+重复消息的保留时间不会溢出
+*****************************************************/
+const (
+	MaxRetries = 16
+	MaxAckWait = time.Minute
+)
+
+/****************************************************
+*@brief 定义可靠投递：需要确认的消息带上消息ID，对方
+收到后回复ack，超时未确认时按指数退避重传，重传用尽后
+回调fail。接收方按发送者+消息ID记录已收到的消息，
+重传造成的重复消息只回复ack不再处理
+*****************************************************
+*@param lock：锁
+*@param prefix：消息ID前缀，每次启动随机生成，避免重启后ID重复
+*@param next：消息ID计数
+*@param retries：最多重传次数
+*@param wait：第一次重传前的等待时间，之后每次加倍
+*@param pending：未确认的消息ID->确认通知
+*@param seen：已收到的发送者/消息ID->收到时间
+*@param window：已收到的消息ID保留时间
+*@param pruned：上次清理seen的时间
+*****************************************************/
+type Reliable struct {
+	lock    sync.Mutex
+	prefix  string
+	next    uint64
+	retries int
+	wait    time.Duration
+	pending map[string]chan struct{}
+	seen    map[string]time.Time
+	window  time.Duration
+	pruned  time.Time
+}
+
+/****************************************************
+*@function NewReliable(retries int, wait time.Duration) *Reliable
+*****************************************************
+*@brief 新建可靠投递
+*****************************************************
+*@access Public
+*****************************************************
+*@param retries：最多重传次数
+*@param wait：第一次重传前的等待时间
+*****************************************************
+*@return *Reliable：可靠投递
+*****************************************************/
+func NewReliable(retries int, wait time.Duration) *Reliable {
+	prefix := make([]byte, 4)
+	crand.Read(prefix)
+	return &Reliable{
+		prefix:  hex.EncodeToString(prefix),
+		retries: retries,
+		wait:    wait,
+		pending: make(map[string]chan struct{}),
+		seen:    make(map[string]time.Time),
+		//重传全部结束之前收到的重复消息都需要识别
+		window: wait<<uint(retries+1) + time.Minute,
+		pruned: time.Now(),
+	}
+}
+
+/****************************************************
+*@function func (r *Reliable) Send(mess Message, send func(Message) error, fail func(Message)) error
+*****************************************************
+*@brief 给消息分配ID后发送，在后台等待确认，超时按
+指数退避重传，重传用尽仍未确认时调用fail
+*****************************************************
+*@access Public
+*****************************************************
+*@param mess：待发送消息
+*@param send：发送一次消息的函数
+*@param fail：投递失败时的回调，可以为nil
+*****************************************************
+*@return error：第一次发送失败的原因，此时不再重传
+*****************************************************/
+func (r *Reliable) Send(mess Message, send func(Message) error, fail func(Message)) error {
+	acked := make(chan struct{})
+	r.lock.Lock()
+	r.next++
+	mess.ID = fmt.Sprintf("%s-%d", r.prefix, r.next)
+	r.pending[mess.ID] = acked
+	r.lock.Unlock()
+	err := send(mess)
+	if err != nil {
+		r.Ack(mess.ID)
+		return err
+	}
+	go func() {
+		wait := r.wait
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		for i := 0; ; i++ {
+			select {
+			case <-acked:
+				return
+			case <-timer.C:
+			}
+			if i == r.retries {
+				break
+			}
+			//重传失败与丢包同样处理，等待下一次重传
+			send(mess)
+			wait *= 2
+			timer.Reset(wait)
+		}
+		r.Ack(mess.ID)
+		if fail != nil {
+			fail(mess)
+		}
+	}()
+	return nil
+}
+
+/****************************************************
+*@function func (r *Reliable) Ack(id string)
+*****************************************************
+*@brief 收到对方的确认，停止重传
+*****************************************************
+*@access Public
+*****************************************************
+*@param id：消息ID
+*****************************************************
+*@return 无
+*****************************************************/
+func (r *Reliable) Ack(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	acked, flag := r.pending[id]
+	if flag {
+		close(acked)
+		delete(r.pending, id)
+	}
+}
+
+/****************************************************
+*@function func (r *Reliable) Duplicate(sender string, id string) bool
+*****************************************************
+*@brief 记录收到的消息，判断是否为重传造成的重复消息
+*****************************************************
+*@access Public
+*****************************************************
+*@param sender：发送者
+*@param id：消息ID
+*****************************************************
+*@return bool：是否已经收到过
+*****************************************************/
+func (r *Reliable) Duplicate(sender string, id string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	if now.Sub(r.pruned) > r.window {
+		for key, seen := range r.seen {
+			if now.Sub(seen) > r.window {
+				delete(r.seen, key)
+			}
+		}
+		r.pruned = now
+	}
+	key := sender + "/" + id
+	if _, flag := r.seen[key]; flag {
+		return true
+	}
+	r.seen[key] = now
+	return false
+}
+
+/****************************************************
+*@function func (u *User) NotDelivered(text string) func(Message)
+*****************************************************
+*@brief 生成投递失败的回调，重传用尽时显示未送达标记
+*****************************************************
+*@access Public
+*****************************************************
+*@param text string 未送达的内容
+*****************************************************
+*@return func(Message)：投递失败回调
+*****************************************************/
+func (u *User) NotDelivered(text string) func(Message) {
+	return func(mess Message) {
+		fmt.Printf("[not delivered]%s\n", text)
+	}
+}
+
+/****************************************************
+*@function func (u *User) NotSent(err error, logger *log.Logger)
+*****************************************************
+*@brief 消息没有发出时显示未发送标记与原因，客户端
+继续运行
+*****************************************************
+*@access Public
+*****************************************************
+*@param err error 发送失败原因
+*@param logger *log.Logger 日志文件
+*****************************************************
+*@return 无
+*****************************************************/
+func (u *User) NotSent(err error, logger *log.Logger) {
+	var frameErr *FrameError
+	if errors.Is(err, ErrTooLarge) || errors.As(err, &frameErr) && frameErr.Reason == "size" {
+		fmt.Println("[not sent] message too large")
+	} else {
+		fmt.Printf("[not sent] %v\n", err)
+	}
+	logger.Printf("write:%v\n", err)
+}
+
+/****************************************************
+*@brief 定义一个两人会话
+*****************************************************
+*@param Name：对方用户名
+*@param Writer：发往对方的写接口，中转时为服务器端口
+*@param PeerAddr：打洞得到的对方地址，为nil时不能直连
+*@param Relay：是否经服务器中转
+*@param Unread：不在前台时收到的消息
+*****************************************************/
+type Conversation struct {
+	Name     string
+	Writer   PeerWriter
+	PeerAddr *net.UDPAddr
+	Relay    bool
+	Unread   []string
+}
+
+/****************************************************
+*@brief 定义同时进行的全部两人会话，输入默认发往前台
+会话，其他会话收到的消息暂存为未读
+*****************************************************
+*@param lock：读写进程并发访问锁
+*@param active：前台会话的对方用户名，为空时输入均为指令
+*@param list：对方用户名->会话
+*****************************************************/
+type Conversations struct {
+	lock   sync.Mutex
+	active string
+	list   map[string]*Conversation
+}
+
+/****************************************************
+*@function NewConversations() *Conversations
+*****************************************************
+*@brief 新建空的会话列表
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return *Conversations：会话列表
+*****************************************************/
+func NewConversations() *Conversations {
+	return &Conversations{
+		list: make(map[string]*Conversation),
+	}
+}
+
+/****************************************************
+*@function func (c *Conversations) Open(conv Conversation)
+*****************************************************
+*@brief 新建会话，与同一用户的旧会话被替换，新会话切换
+到前台
+*****************************************************
+*@access Public
+*****************************************************
+*@param conv：会话
+*****************************************************
+*@return 无
+*****************************************************/
+func (c *Conversations) Open(conv Conversation) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	conv.Unread = nil
+	c.list[conv.Name] = &conv
+	c.active = conv.Name
+}
+
+/****************************************************
+*@function func (c *Conversations) Close(name string) bool
+*****************************************************
+*@brief 结束与name的会话，前台会话结束时按用户名顺序
+切换到下一个会话
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：对方用户名
+*****************************************************
+*@return bool：会话是否存在
+*****************************************************/
+func (c *Conversations) Close(name string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.list[name]; !ok {
+		return false
+	}
+	delete(c.list, name)
+	if c.active == name {
+		c.active = ""
+		names := make([]string, 0, len(c.list))
+		for temp := range c.list {
+			names = append(names, temp)
+		}
+		sort.Strings(names)
+		for _, temp := range names {
+			if temp > name {
+				c.active = temp
+				break
+			}
+		}
+		if c.active == "" && len(names) > 0 {
+			c.active = names[0]
+		}
+	}
+	return true
+}
+
+/****************************************************
+*@function func (c *Conversations) Get(name string) (Conversation, bool)
+*****************************************************
+*@brief 获取与name的会话副本
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：对方用户名
+*****************************************************
+*@return Conversation：会话副本
+*@return bool：会话是否存在
+*****************************************************/
+func (c *Conversations) Get(name string) (Conversation, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	conv, ok := c.list[name]
+	if !ok {
+		return Conversation{}, false
+	}
+	temp := *conv
+	temp.Unread = append([]string(nil), conv.Unread...)
+	return temp, true
+}
+
+/****************************************************
+*@function func (c *Conversations) Update(name string, fn func(conv *Conversation)) bool
+*****************************************************
+*@brief 在锁内修改已存在的会话，fn中不能再访问会话列表
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：对方用户名
+*@param fn：修改函数
+*****************************************************
+*@return bool：会话是否存在
+*****************************************************/
+func (c *Conversations) Update(name string, fn func(conv *Conversation)) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	conv, ok := c.list[name]
+	if !ok {
+		return false
+	}
+	fn(conv)
+	return true
+}
+
+/****************************************************
+*@function func (c *Conversations) Active() string
+*****************************************************
+*@brief 获取前台会话的对方用户名
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return string：对方用户名，没有会话时为空
+*****************************************************/
+func (c *Conversations) Active() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.active
+}
+
+/****************************************************
+*@function func (c *Conversations) Switch(name string) ([]string, bool)
+*****************************************************
+*@brief 将与name的会话切换到前台，取出其未读消息
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：对方用户名
+*****************************************************
+*@return []string：未读消息
+*@return bool：会话是否存在
+*****************************************************/
+func (c *Conversations) Switch(name string) ([]string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	conv, ok := c.list[name]
+	if !ok {
+		return nil, false
+	}
+	c.active = name
+	unread := conv.Unread
+	conv.Unread = nil
+	return unread, true
+}
+
+/****************************************************
+*@function func (c *Conversations) Deliver(name string, line string) int
+*****************************************************
+*@brief 收到name的消息，不在前台的会话暂存为未读
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：发送者
+*@param line：待显示的消息
+*****************************************************
+*@return int：未读消息数，为0时应立即显示
+*****************************************************/
+func (c *Conversations) Deliver(name string, line string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	conv, ok := c.list[name]
+	if !ok || c.active == name {
+		return 0
+	}
+	conv.Unread = append(conv.Unread, line)
+	return len(conv.Unread)
+}
+
+/****************************************************
+*@function func (c *Conversations) Summary() []string
+*****************************************************
+*@brief 按用户名顺序列出全部会话及其状态
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return []string：每个会话一行
+*****************************************************/
+func (c *Conversations) Summary() []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	names := make([]string, 0, len(c.list))
+	for name := range c.list {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		line := name
+		if c.list[name].Relay {
+			line += " (relay)"
+		}
+		if name == c.active {
+			line += " (talking)"
+		} else if len(c.list[name].Unread) > 0 {
+			line += fmt.Sprintf(" (%d unread)", len(c.list[name].Unread))
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+/****************************************************
+*@function func (u *User) Punch(peer string, addrs []string, logger *log.Logger) *net.UDPAddr
+*****************************************************
+*@brief udp打洞，从本地监听端口向对方的公网、内网地址
+持续发送punch，直到收到对方的punch或punchack
+*****************************************************
+*@access Public
+*****************************************************
+*@param peer string 对方用户名
+*@param addrs []string 对方的候选udp地址
+*@param logger *log.Logger 日志文件
+*****************************************************
+*@return *net.UDPAddr：打通的对方地址，失败时为nil
+*****************************************************/
+func (u *User) Punch(peer string, addrs []string, logger *log.Logger) *net.UDPAddr {
+	targets := make([]*net.UDPAddr, 0)
+	for _, addr := range addrs {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			logger.Printf("punch:%v\n", err)
+			continue
+		}
+		targets = append(targets, udpAddr)
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	//清除上次会话残留的应答，对方先于本地开始打洞时
+	//已经到达的应答保留下来，否则对方收到punchack后不再
+	//发送，本地再也等不到应答
+	early := ""
+	for drained := false; !drained; {
+		select {
+		case reply := <-u.pongCh:
+			if strings.HasPrefix(reply, peer+"/") {
+				early = reply
+			}
+		default:
+			drained = true
+		}
+	}
+	if early != "" {
+		select {
+		case u.pongCh <- early:
+		default:
+		}
+	}
+	data, err := EncodeFrame(nil, Message{
+		Cmd:      "punch",
+		Sender:   u.name,
+		Data:     "",
+		Receiver: peer,
+	})
+	if err != nil {
+		return nil
+	}
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	deadline := time.NewTimer(3 * time.Second)
+	defer deadline.Stop()
+	for {
+		for _, target := range targets {
+			_, err := u.reader.WriteToUDP(data, target)
+			if err != nil {
+				logger.Printf("punch:%v\n", err)
+			}
+		}
+		select {
+		case reply := <-u.pongCh:
+			{
+				//reply格式为：用户名/对方实际udp地址
+				replyList := strings.SplitN(reply, "/", 2)
+				if len(replyList) == 2 && replyList[0] == peer {
+					udpAddr, err := net.ResolveUDPAddr("udp", replyList[1])
+					if err == nil {
+						return udpAddr
+					}
+				}
+			}
+		case <-ticker.C:
+		case <-deadline.C:
+			return nil
+		}
+	}
+}
+
+/****************************************************
+*@function func (u *User) PunchReply(mess Message, remoteAddr *net.UDPAddr, logger *log.Logger)
+*****************************************************
+*@brief 处理对方的打洞消息，收到punch时回复punchack，
+并把打通的地址交给正在打洞的Punch
+*****************************************************
+*@access Public
+*****************************************************
+*@param mess Message 打洞消息
+*@param remoteAddr *net.UDPAddr 消息的来源地址
+*@param logger *log.Logger 日志文件
+*****************************************************
+*@return 无
+*****************************************************/
+func (u *User) PunchReply(mess Message, remoteAddr *net.UDPAddr, logger *log.Logger) {
+	//双方内网地址相同时，发往对方内网地址的punch会回到
+	//自己，不能占用应答channel
+	if mess.Sender == u.name {
+		return
+	}
+	if mess.Cmd == "punch" {
+		data, err := EncodeFrame(nil, Message{
+			Cmd:      "punchack",
+			Sender:   u.name,
+			Data:     "",
+			Receiver: mess.Sender,
+		})
+		if err == nil {
+			_, err = u.reader.WriteToUDP(data, remoteAddr)
+		}
+		if err != nil {
+			logger.Printf("punch:%v\n", err)
+		}
+	}
+	select {
+	case u.pongCh <- fmt.Sprintf("%s/%s", mess.Sender, remoteAddr.String()):
+	default:
+	}
+}
+
+/****************************************************
+*@function func (u *User) History(str string, chatConn PeerWriter, logger *log.Logger)
+*****************************************************
+*@brief 处理history XXX [n]指令，读取本地记录。直连与
+中转的会话都在本地保存明文，服务器只有中转消息的密文，
+本地没有记录时才向服务器查询
+*****************************************************
+*@access Public
+*****************************************************
+*@param str string 用户输入
+*@param chatConn PeerWriter 服务器消息端口写接口
+*@param logger *log.Logger 日志文件
+*****************************************************
+*@return 无
+*****************************************************/
+func (u *User) History(str string, chatConn PeerWriter, logger *log.Logger) {
+	lists := strings.Fields(str)
+	n := 20
+	if len(lists) == 3 {
+		count, err := strconv.Atoi(lists[2])
+		if err != nil || count <= 0 {
+			lists = nil
+		} else {
+			n = count
+		}
+	}
+	if len(lists) != 2 && len(lists) != 3 {
+		fmt.Println("usage: history XXX [n]")
+		return
+	}
+	peer := lists[1]
+	records, err := u.history.Last(u.name, peer, n)
+	if err != nil {
+		fmt.Println(err)
+		logger.Printf("history:%v\n", err)
+		return
+	}
+	if len(records) == 0 {
+		err := chatConn.Send(Message{
+			Cmd:      "history",
+			Sender:   u.name,
+			Data:     fmt.Sprintf("%s/%d", peer, n),
+			Receiver: "server",
+			Token:    u.token,
+		})
+		if err != nil {
+			fmt.Println(err)
+			logger.Printf("history:%v\n", err)
+		}
+		return
+	}
+	for _, record := range records {
+		fmt.Printf("[%s]<%s>:%s\n", record.Time.Format("2006-01-02 15:04:05"), record.Sender, record.Data)
+	}
+	fmt.Printf("%d messages with %s\n", len(records), peer)
+}
+
+/****************************************************
+*@function func (u *User) RoomChat(room string, inputCh chan string, groupCh chan string, chatConn PeerWriter, logger *log.Logger) bool
+*****************************************************
+*@brief 群聊会话，输入内容经服务器转发给房间内所有成员，
+输入leave离开房间，“@XXX MESSAGE”发往两人会话，其他指令
+与会话外一样处理
+*****************************************************
+*@access Public
+*****************************************************
+*@param room string 房间名
+*@param inputCh chan string 用户输入channel
+*@param groupCh chan string 读写进程间group状态交互channel
+*@param chatConn PeerWriter 服务器消息端口写接口
+*@param logger *log.Logger 日志文件
+*****************************************************
+*@return bool 群聊中注销或被踢出时返回false，客户端退出
+*****************************************************/
+func (u *User) RoomChat(room string, inputCh chan string, groupCh chan string, chatConn PeerWriter, logger *log.Logger) bool {
+	for {
+		select {
+		case str := <-inputCh:
+			{
+				var mess Message
+				switch str {
+				case "leave":
+					mess = Message{
+						Cmd:      "leave",
+						Sender:   u.name,
+						Data:     room,
+						Receiver: "server",
+					}
+				case "list", "rooms":
+					mess = Message{
+						Cmd:      str,
+						Sender:   u.name,
+						Data:     "",
+						Receiver: "server",
+					}
+				default:
+					//群聊期间指令与@XXX照常处理，其余输入发往房间
+					lists := strings.Fields(str)
+					if len(lists) > 0 && lists[0] == "join" {
+						fmt.Printf("you are still chatting in room <%s>, leave it first\n", room)
+						continue
+					}
+					if len(lists) > 0 && (IsKeyword(lists[0]) || strings.HasPrefix(lists[0], "@")) {
+						if !u.Command(str, chatConn, logger) {
+							return false
+						}
+						continue
+					}
+					mess = Message{
+						Cmd:      "roomchat",
+						Sender:   u.name,
+						Data:     str,
+						Receiver: room,
+					}
+				}
+				mess.Token = u.token
+				err := chatConn.Send(mess)
+				if err != nil {
+					u.NotSent(err, logger)
+					continue
+				}
+				if mess.Cmd == "leave" {
+					return true
+				}
+			}
+		case groupInfo := <-groupCh:
+			{
+				//群聊期间不能进入其他房间，两人会话照常建立与结束
+				if strings.HasPrefix(groupInfo, "kick/") {
+					return false
+				} else if strings.HasPrefix(groupInfo, "join/") {
+					fmt.Printf("you are still chatting in room <%s>, leave it to chat in <%s>\n", room, strings.TrimPrefix(groupInfo, "join/"))
+				} else {
+					u.Converse(groupInfo, chatConn, logger)
+				}
+			}
+		}
+	}
+}
+
+/****************************************************
+*@function func (u *User) Converse(groupInfo string, chatConn PeerWriter, logger *log.Logger)
+*****************************************************
+*@brief 处理读进程转来的会话变化：对方退出时结束会话并
+告知服务器；收到会话通知时打洞并新建会话
+*****************************************************
+*@access Public
+*****************************************************
+*@param groupInfo string quit/对方用户名，或者会话通知
+*@param chatConn PeerWriter 服务器消息端口写接口
+*@param logger *log.Logger 日志文件
+*****************************************************
+*@return 无
+*****************************************************/
+func (u *User) Converse(groupInfo string, chatConn PeerWriter, logger *log.Logger) {
+	if strings.HasPrefix(groupInfo, "quit/") {
+		name := strings.TrimPrefix(groupInfo, "quit/")
+		if name == "" {
+			//旧服务器发出的quit不带对方用户名，结束前台会话
+			name = u.talks.Active()
+		}
+		if !u.talks.Close(name) {
+			return
+		}
+		//退出会话，同时向服务器反馈
+		fmt.Printf("%s left the chatting\n", name)
+		mess := Message{
+			Cmd:      "quit",
+			Sender:   u.name,
+			Data:     name,
+			Receiver: "server",
+			Token:    u.token,
+		}
+		err := u.reliable.Send(mess, chatConn.Send, u.NotDelivered(" quit to server"))
+		if err != nil {
+			u.NotSent(err, logger)
+		}
+		//下一个会话切换到前台，显示其未读消息
+		if active := u.talks.Active(); active != "" {
+			u.Switch([]string{active})
+		}
+		return
+	}
+	//收到回话要求
+	//groupInfo包含：1.对方用户名；2.公网地址；3.内网地址；4.对方身份公钥
+	groupList := strings.Split(groupInfo, "/")
+	addrs := groupList[1:]
+	if len(groupList) >= 4 {
+		addrs = groupList[1:3]
+		err := u.secrets.Add(u.name, groupList[0], groupList[3])
+		if err != nil {
+			logger.Printf("write:%v\n", err)
+		}
+	}
+	if !u.secrets.Has(groupList[0]) {
+		fmt.Printf("the conversation with %s is not encrypted\n", groupList[0])
+	}
+	//根据会话模式选择直连或服务器中转，直连前双方同时打洞，
+	//auto模式下打洞失败时自动改为中转
+	relay := u.chatMode == "relay"
+	var peerAddr *net.UDPAddr
+	var err error
+	if !relay {
+		peerAddr = u.Punch(groupList[0], addrs, logger)
+		if peerAddr == nil && u.chatMode == "direct" {
+			peerAddr, err = net.ResolveUDPAddr("udp", groupList[1])
+			if err != nil {
+				fmt.Println(err)
+				logger.Printf("write:%v\n", err)
+			}
+		}
+		relay = peerAddr == nil
+	}
+	if relay {
+		fmt.Printf("talking to %s through the server\n", groupList[0])
+	}
+	writer := chatConn
+	if !relay {
+		writer = PeerWriter{conn: u.reader, addr: peerAddr}
+	}
+	u.talks.Open(Conversation{
+		Name:     groupList[0],
+		Writer:   writer,
+		PeerAddr: peerAddr,
+		Relay:    relay,
+	})
+}
+
+/****************************************************
+*@function func (u *User) Chat(name string, str string, logger *log.Logger)
+*****************************************************
+*@brief 在与name的会话中发送一条消息，对方未确认时重传，
+消息过大或发送失败时显示未发送
+*****************************************************
+*@access Public
+*****************************************************
+*@param name string 对方用户名
+*@param str string 消息内容
+*@param logger *log.Logger 日志文件
+*****************************************************
+*@return error：消息过大或第一次发送失败的原因
+*****************************************************/
+func (u *User) Chat(name string, str string, logger *log.Logger) error {
+	conv, ok := u.talks.Get(name)
+	if !ok {
+		fmt.Printf("you are not talking to %s\n", name)
+		return fmt.Errorf("not talking to %s", name)
+	}
+	//加密之前检查长度，超长的输入不加密也不记录
+	if len(str) > MaxTextSize {
+		u.NotSent(ErrTooLarge, logger)
+		return ErrTooLarge
+	}
+	mess := Message{
+		Cmd:      "chat",
+		Sender:   u.name,
+		Data:     str,
+		Receiver: name,
+	}
+	u.secrets.Seal(&mess)
+	//令牌只发给服务器，直连时不携带
+	if conv.Relay {
+		mess.Token = u.token
+	}
+	//对方未确认时重传，用尽后显示未送达
+	err := u.reliable.Send(mess, conv.Writer.Send, u.NotDelivered(fmt.Sprintf("<%s>:%s", name, str)))
+	if err != nil {
+		u.NotSent(err, logger)
+		return err
+	}
+	//直连与中转的消息都以明文保存在本地
+	err = u.history.Append(Record{
+		Time:     time.Now(),
+		Sender:   u.name,
+		Receiver: name,
+		Data:     str,
+	})
+	if err != nil {
+		logger.Printf("write:%v\n", err)
+	}
+	return nil
+}
+
+/****************************************************
+*@function func (u *User) ChatTo(str string, logger *log.Logger)
+*****************************************************
+*@brief 处理“@XXX MESSAGE”输入，发往指定的会话，不切换
+前台会话
+*****************************************************
+*@access Public
+*****************************************************
+*@param str string 用户输入
+*@param logger *log.Logger 日志文件
+*****************************************************
+*@return 无
+*****************************************************/
+func (u *User) ChatTo(str string, logger *log.Logger) {
+	atList := SplitArgs(str, 2)
+	if len(atList) != 2 || atList[0] == "@" {
+		fmt.Println("usage: @XXX MESSAGE")
+		return
+	}
+	u.Chat(strings.TrimPrefix(atList[0], "@"), atList[1], logger)
+}
+
+/****************************************************
+*@function func (u *User) Quit(name string, logger *log.Logger)
+*****************************************************
+*@brief 结束与name的会话并通知对方，中转时由服务器转发
+*****************************************************
+*@access Public
+*****************************************************
+*@param name string 对方用户名
+*@param logger *log.Logger 日志文件
+*****************************************************
+*@return 无
+*****************************************************/
+func (u *User) Quit(name string, logger *log.Logger) {
+	conv, ok := u.talks.Get(name)
+	if !ok || !u.talks.Close(name) {
+		return
+	}
+	mess := Message{
+		Cmd:      "quit",
+		Sender:   u.name,
+		Data:     "",
+		Receiver: name,
+	}
+	if conv.Relay {
+		mess.Token = u.token
+	}
+	err := u.reliable.Send(mess, conv.Writer.Send, u.NotDelivered(fmt.Sprintf(" quit to <%s>", name)))
+	if err != nil {
+		u.NotSent(err, logger)
+	}
+	fmt.Printf("you left the chatting with %s\n", name)
+	//下一个会话切换到前台，显示其未读消息
+	if active := u.talks.Active(); active != "" {
+		u.Switch([]string{active})
+	}
+}
+
+/****************************************************
+*@function func (u *User) Switch(args []string)
+*****************************************************
+*@brief 处理switch指令，不带参数时列出全部会话，否则将
+与指定用户的会话切换到前台并显示未读消息
+*****************************************************
+*@access Public
+*****************************************************
+*@param args []string switch之后的参数
+*****************************************************
+*@return 无
+*****************************************************/
+func (u *User) Switch(args []string) {
+	if len(args) == 0 {
+		summary := u.talks.Summary()
+		if len(summary) == 0 {
+			fmt.Println("you are not talking to anyone")
+			return
+		}
+		fmt.Println("your conversations are:")
+		for _, line := range summary {
+			fmt.Println(line)
+		}
+		return
+	}
+	if len(args) != 1 {
+		fmt.Println("usage: switch [XXX]")
+		return
+	}
+	unread, ok := u.talks.Switch(args[0])
+	if !ok {
+		fmt.Printf("you are not talking to %s\n", args[0])
+		return
+	}
+	fmt.Printf("now you are talking to %s\n", args[0])
+	for _, line := range unread {
+		fmt.Println(line)
+	}
+}
+
+/****************************************************
+*@function func (u *User) SwitchMode(name string, mode string, chatConn PeerWriter)
+*****************************************************
+*@brief 会话中切换直连或服务器中转，直连要求打洞成功过
+*****************************************************
+*@access Public
+*****************************************************
+*@param name string 对方用户名
+*@param mode string direct或relay
+*@param chatConn PeerWriter 服务器消息端口写接口
+*****************************************************
+*@return 无
+*****************************************************/
+func (u *User) SwitchMode(name string, mode string, chatConn PeerWriter) {
+	switched := false
+	u.talks.Update(name, func(conv *Conversation) {
+		if mode == "relay" {
+			conv.Writer = chatConn
+			conv.Relay = true
+		} else if conv.PeerAddr != nil {
+			conv.Writer = PeerWriter{conn: u.reader, addr: conv.PeerAddr}
+			conv.Relay = false
+		} else {
+			return
+		}
+		switched = true
+	})
+	if !switched {
+		fmt.Println("can not reach the peer directly")
+		return
+	}
+	fmt.Printf("now mode %s with %s\n", mode, name)
+}
+
+/****************************************************
+*@brief 定义客户端配置，来自命令行参数以及可选的json
+配置文件，命令行参数优先
+*****************************************************
+*@param ServerAddr：服务器tcp登录地址
+*@param LocalAddr：本地udp监听地址，为空时自动选择
+*@param LogFile：日志文件
+*@param BeatInterval：心跳间隔
+*@param CAFile：服务器CA证书，非空时使用TLS登录
+*@param Mode：默认会话模式
+*@param HistoryDir：本地会话记录目录
+*@param Codec：优先使用的udp消息编解码
+*@param Retries：会话消息最多重传次数
+*@param AckWait：第一次重传前等待确认的时间，之后每次加倍
 *****************************************************/
-type User struct {
-	reader       *net.UDPConn
-	remoteClient *User
-	name         string
-	chatPort     string
+type Config struct {
+	ServerAddr   string
+	LocalAddr    string
+	LogFile      string
+	BeatInterval time.Duration
+	CAFile       string
+	Mode         string
+	HistoryDir   string
+	Codec        string
+	Retries      int
+	AckWait      time.Duration
 }
 
 /****************************************************
-*@function Login(loginPort string) User
+*@function NewConfig(args []string) (*Config, error)
 *****************************************************
-*@brief 本地创建user，同时向服务器注册
+*@brief 解析命令行参数，-config指定的配置文件补充
+命令行未给出的参数，最后校验配置
 *****************************************************
 *@access Public
 *****************************************************
-*@param 无
+*@param args：命令行参数，不含程序名
 *****************************************************
-*@return user
+*@return *Config：客户端配置
+*@return error：参数或配置文件错误原因
 *****************************************************/
-func Login(loginPort string) User { //随机本地监听开启端口
-	//获取本地ip地址
-	addrs, _ := net.InterfaceAddrs()
-	fmt.Println(addrs)
-	localHost := addrs[0]
-	rand := rand.New(rand.NewSource(time.Now().UnixNano()))
-	port := rand.Int() % 65536
-	user := new(User)
-	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%v", localHost.String(), port))
-	if err != nil {
-		fmt.Println(err)
-	}
-	fmt.Printf("localAddr:%v\n", udpAddr.String())
-	listener, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		fmt.Println(err)
-	}
-	user.reader = listener
-	//向服务器注册端口发起注册
-	loginConn, err := net.Dial("tcp", loginPort)
+func NewConfig(args []string) (*Config, error) {
+	config := new(Config)
+	fs := flag.NewFlagSet("client", flag.ContinueOnError)
+	configFile := fs.String("config", "", "optional json config file, keys are the flag names")
+	fs.StringVar(&config.ServerAddr, "server", "172.16.18.163:8080", "server tcp login address")
+	fs.StringVar(&config.LocalAddr, "local", "", "local udp listen address, host or host:port, picked automatically when empty")
+	fs.StringVar(&config.LogFile, "log", "log.txt", "log file")
+	fs.DurationVar(&config.BeatInterval, "beat", time.Second, "heartbeat interval")
+	fs.StringVar(&config.CAFile, "ca", "", "server CA certificate, enables tls login and trusts only this CA")
+	fs.StringVar(&config.Mode, "mode", "auto", "default conversation mode: auto, direct or relay")
+	fs.StringVar(&config.HistoryDir, "history", "localhistory", "local chat history directory")
+	fs.StringVar(&config.Codec, "codec", "binary", "preferred wire codec for server messages: binary, cbor or json")
+	fs.IntVar(&config.Retries, "retries", 4, "how many times an unacknowledged chat, group or quit message is resent")
+	fs.DurationVar(&config.AckWait, "ackwait", 300*time.Millisecond, "how long to wait for an ack before the first resend, doubled on each resend")
+	err := fs.Parse(args)
 	if err != nil {
-		fmt.Println(err)
-	}
-	defer loginConn.Close()
-	mes := Message{
-		Cmd:      "connect",
-		Sender:   loginConn.LocalAddr().String(),
-		Data:     udpAddr.String(),
-		Receiver: "server",
+		return nil, err
 	}
-	//json加密发送消息
-	coder := json.NewEncoder(loginConn)
-	err = coder.Encode(mes)
-	if err != nil {
-		fmt.Println(err)
+	if *configFile != "" {
+		err = LoadConfigFile(fs, *configFile)
+		if err != nil {
+			return nil, err
+		}
 	}
-	//获取服务器返回的chat、beat端口
-	decoder := json.NewDecoder(loginConn)
-	err = decoder.Decode(&mes)
+	return config, config.Validate()
+}
+
+/****************************************************
+*@function LoadConfigFile(fs *flag.FlagSet, path string) error
+*****************************************************
+*@brief 读取json配置文件，键为参数名，只设置命令行
+中未给出的参数
+*****************************************************
+*@access Public
+*****************************************************
+*@param fs：已解析的命令行参数
+*@param path：配置文件路径
+*****************************************************
+*@return error：读取失败、未知参数或参数值错误的原因
+*****************************************************/
+func LoadConfigFile(fs *flag.FlagSet, path string) error {
+	file, err := os.Open(path)
 	if err != nil {
-		fmt.Println(err)
+		return err
 	}
-	user.chatPort = mes.Data
-	//fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mes.Cmd, mes.Data, mes.Sender, mes.Receiver)
-	user.remoteClient = &User{
-		reader:       nil,
-		remoteClient: nil,
-		name:         "server",
-		chatPort:     "",
+	defer file.Close()
+	values := make(map[string]interface{})
+	//数字保留原文交给flag解析，避免大数被格式化为科学计数法
+	decoder := json.NewDecoder(file)
+	decoder.UseNumber()
+	err = decoder.Decode(&values)
+	if err == nil && decoder.More() {
+		err = errors.New("unexpected data after the settings")
 	}
-	//接收welcome介绍
-	err = decoder.Decode(&mes)
 	if err != nil {
-		fmt.Println(err)
+		return fmt.Errorf("%s: %v", path, err)
 	}
-	fmt.Println(mes.Data)
-	fmt.Println("1.list: used to list all users")
-	fmt.Println("2. group: group XXX used to create a conversation between XXX")
-	fmt.Println("3.quit:used to quit a conversation\n")
-	//输入用户名,服务器端检查是否被使用
-	flag := true
-	buffer := make([]byte, 1024)
-	for flag {
-		count, err := os.Stdin.Read(buffer)
-		if err != nil {
-			fmt.Println(err)
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for name, value := range values {
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
 		}
-		user.name = strings.TrimSpace(strings.TrimSpace(string(buffer[:count])))
-		if user.name == "list" || user.name == "group" || user.name == "quit" {
-			fmt.Println("you can not use the keyword as your name")
-		} else {
-			mes = Message{
-				Cmd:      "login",
-				Sender:   loginConn.LocalAddr().String(),
-				Data:     user.name,
-				Receiver: "server",
-			}
-			//fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mes.Cmd, mes.Data, mes.Sender, mes.Receiver)
-			encoder := json.NewEncoder(loginConn)
-			err = encoder.Encode(mes)
-			if err != nil {
-				fmt.Println(err)
-			}
-			err = decoder.Decode(&mes)
-			//fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mes.Cmd, mes.Data, mes.Sender, mes.Receiver)
-			if err != nil {
-				fmt.Println(err)
-			}
-			if mes.Data == "success" {
-				fmt.Println("success to login")
-				break
-			} else {
-				fmt.Println("the name has already been token,please try another name")
-				mes.Sender, mes.Receiver = mes.Receiver, mes.Sender
-			}
+		if given[name] {
+			continue
+		}
+		err = fs.Set(name, fmt.Sprint(value))
+		if err != nil {
+			return fmt.Errorf("%s: %s: %v", path, name, err)
 		}
 	}
-	//fmt.Println(*user)
-	return *user
+	return nil
 }
 
 /****************************************************
-*@function func (u *User) Read(groupCh chan string)
+*@function func (c *Config) Validate() error
 *****************************************************
-*@brief 监听本地端口
+*@brief 校验客户端配置
 *****************************************************
 *@access Public
 *****************************************************
-*@param groupCh chan string 读写进程间group状态交互channel
+*@param 无
 *****************************************************
-*@return 无
+*@return error：第一个错误配置的原因
 *****************************************************/
-func (u *User) Read(groupCh chan string, logger *log.Logger) {
-	decoder := json.NewDecoder(u.reader)
-	var mess Message
-	for {
-		err := decoder.Decode(&mess)
+func (c *Config) Validate() error {
+	_, err := net.ResolveTCPAddr("tcp", c.ServerAddr)
+	if err != nil {
+		return fmt.Errorf("server: invalid address %q: %v", c.ServerAddr, err)
+	}
+	if c.LocalAddr != "" {
+		_, err = net.ResolveUDPAddr("udp", LocalAddr(c.LocalAddr))
 		if err != nil {
-			fmt.Println(err)
-		}
-		logger.Printf("read:%v\n", mess)
-		now := fmt.Sprintf("%d:%d:%d", time.Now().Hour(), time.Now().Minute(), time.Now().Second())
-		fmt.Printf("%s:", now)
-		switch mess.Cmd {
-		//list指令，显示所有在线用户名
-		case "list":
-			{
-				fmt.Println("these online users are:")
-				userlist := strings.Split(mess.Data, "/")
-				for _, userName := range userlist {
-					fmt.Println(userName)
-				}
-			}
-		//group指令，收到后，保存会话用户
-		case "group":
-			{
-				//fmt.Println(mess.Data)
-				//mess.Data包含3部分数据：1.发起者(1)\接受者(0)标志；2.名字；3.udp地址
-				groupList := strings.Split(mess.Data, "/")
-				//fmt.Println(groupList)
-				if groupList[0] == "0" {
-					fmt.Printf("%s want talk to you\n", groupList[1])
-					groupInfo := strings.Join(groupList[1:], "/")
-					groupCh <- groupInfo
-				} else if groupList[0] == "1" {
-					fmt.Printf("now you can talk to %s\n", groupList[1])
-					groupInfo := strings.Join(groupList[1:], "/")
-					groupCh <- groupInfo
-				} else {
-					fmt.Println(mess.Data)
-				}
-
-			}
-			//quit指令，收到后清除会话用户
-		case "quit":
-			{
-				groupCh <- "quit"
-			}
-			//chat指令，收到后，显示会话内容
-		case "chat":
-			{
-				fmt.Printf("<%s>:%s\n", mess.Sender, mess.Data)
-			}
+			return fmt.Errorf("local: invalid address %q: %v", c.LocalAddr, err)
 		}
 	}
+	if c.LogFile == "" {
+		return errors.New("log: log file can not be empty")
+	}
+	if c.BeatInterval <= 0 {
+		return fmt.Errorf("beat: interval must be positive, got %v", c.BeatInterval)
+	}
+	if c.Mode != "auto" && c.Mode != "direct" && c.Mode != "relay" {
+		return fmt.Errorf("mode: must be auto, direct or relay, got %q", c.Mode)
+	}
+	if c.HistoryDir == "" {
+		return errors.New("history: directory can not be empty")
+	}
+	if CodecByName(c.Codec) == nil {
+		return fmt.Errorf("codec: must be binary, cbor or json, got %q", c.Codec)
+	}
+	if c.Retries < 0 || c.Retries > MaxRetries {
+		return fmt.Errorf("retries: must be between 0 and %d, got %d", MaxRetries, c.Retries)
+	}
+	if c.AckWait <= 0 || c.AckWait > MaxAckWait {
+		return fmt.Errorf("ackwait: must be positive and at most %v, got %v", MaxAckWait, c.AckWait)
+	}
+	return nil
 }
 
 /****************************************************
-*@function HeartBeat(beatAddr string, userName string)
+*@function LocalAddr(addr string) string
 *****************************************************
-*@brief 本地发送心跳接口
+*@brief 补全本地udp监听地址，未给出端口时由系统分配，
+未给出地址时选择第一个非回环的IPv4地址
 *****************************************************
 *@access Public
 *****************************************************
-*@param beatAddr string 服务器监听地址
-*@param userName string 用户名
+*@param addr：配置的本地地址，host或host:port
 *****************************************************
-*@return 无
+*@return string：host:port形式的监听地址
 *****************************************************/
-func HeartBeat(beatAddr string, userName string) {
-	udpAddr, _ := net.ResolveUDPAddr("udp", beatAddr)
-	timer := time.NewTimer(1 * time.Second)
-	conn, err := net.DialUDP("udp", nil, udpAddr)
-	if err != nil {
-		fmt.Println(err)
+func LocalAddr(addr string) string {
+	if addr != "" {
+		if _, _, err := net.SplitHostPort(addr); err == nil {
+			return addr
+		}
+		return net.JoinHostPort(addr, "0")
 	}
-	encoder := json.NewEncoder(conn)
-	for {
-		select {
-		case <-timer.C:
-			{
-				mess := Message{
-					Cmd:      "beat",
-					Sender:   userName,
-					Data:     "",
-					Receiver: "server",
-				}
-				//fmt.Println(mess)
-				err := encoder.Encode(mess)
-				if err != nil {
-					fmt.Println(err)
-				}
-			}
+	addrs, _ := net.InterfaceAddrs()
+	for _, temp := range addrs {
+		ipNet, ok := temp.(*net.IPNet)
+		if ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return net.JoinHostPort(ipNet.IP.String(), "0")
 		}
-		timer.Reset(1 * time.Second)
 	}
+	return "127.0.0.1:0"
 }
 
 /****************************************************
-*@function Write(serverAddr string)
+*@function OpenLog(path string) *log.Logger
 *****************************************************
-*@brief 本地输入接口，绑定本地唯一发送端口
-加开一个进程，用于发送心跳，维护在线状态
+*@brief 以追加方式打开日志文件，文件不存在时创建，
+打开失败时输出到标准错误
 *****************************************************
 *@access Public
 *****************************************************
-*@param 无
+*@param path：日志文件路径
 *****************************************************
-*@return 无
+*@return *log.Logger：日志接口
 *****************************************************/
-func (u *User) Write(groupCh chan string, logger *log.Logger) {
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	//开启进程，定时发送心跳，维护在线
-	go func(beatPort string, userName string) {
-		HeartBeat(beatPort, userName)
-	}(u.chatPort, u.name)
-	//接收用户输入并发送
-	inputCh := make(chan string)
-	go func(ch chan string) {
-		buffer := make([]byte, 1024)
-		for {
-			fmt.Printf("<%s>:", u.name)
-			count, err := os.Stdin.Read(buffer)
-			if err != nil {
-				fmt.Println(err)
-			}
-			str := strings.TrimSpace(strings.TrimSpace(string(buffer[:count])))
-			ch <- str
-		}
-	}(inputCh)
-	var mess Message
-	chatUdpAddr, _ := net.ResolveUDPAddr("udp", u.chatPort)
-	chatConn, err := net.DialUDP("udp", nil, chatUdpAddr)
-	for {
-		//并发逻辑，收到group命令后，输入内容发送给client
-		/*******************************************************
-			存在一个问题是，与服务器之间的通信时在default中，
-			发送完group之后进入default中，等待下一个输入
-
-			解决办法：
-		******************************************************/
-		select {
-		case groupInfo := <-groupCh:
-			{
-				if groupInfo != "quit" {
-					//收到回话要求
-					groupList := strings.Split(groupInfo, "/")
-					remoteUdpAddr, _ := net.ResolveUDPAddr("udp", groupList[1])
-					remoteChatConn, err := net.DialUDP("udp", nil, remoteUdpAddr)
-					if err != nil {
-						logger.Panic(err)
-						fmt.Println(err)
-					}
-					//fmt.Printf("chat with client:%s\n",groupList[2])
-					encoder := json.NewEncoder(remoteChatConn)
-					quitFlag := false
-					var mess Message
-					for {
-						if quitFlag {
-							break
-						} else {
-							select {
-							case str := <-inputCh:
-								{
-									if str == "quit" {
-										quitFlag = true
-										mess = Message{
-											Cmd:      "quit",
-											Sender:   u.name,
-											Data:     "",
-											Receiver: groupList[0],
-										}
-									} else {
-										mess = Message{
-											Cmd:      "chat",
-											Sender:   u.name,
-											Data:     str,
-											Receiver: groupList[0],
-										}
-									}
-									err := encoder.Encode(mess)
-									if err != nil {
-										fmt.Println(err)
-										logger.Panic(err)
-									}
-								}
-							case groupInfo := <-groupCh:
-								{
-									if groupInfo == "quit" {
-										//退出会话，同时向服务器反馈
-										fmt.Printf("%s left the chatting\n", groupList[0])
-										quitFlag = true
-										remoteChatConn.Close()
-										mess = Message{
-											Cmd:      "quit",
-											Sender:   u.name,
-											Data:     groupList[0],
-											Receiver: "server",
-										}
-										encoder := json.NewEncoder(chatConn)
-										err := encoder.Encode(mess)
-										if err != nil {
-											fmt.Println(err)
-											logger.Panic(err)
-										}
-									}
-								}
-							}
-						}
-					}
-				}
-
-			}
-		case str := <-inputCh:
-			{
-				fmt.Println(str)
-				if err != nil {
-					fmt.Println(err)
-					logger.Panic(err)
-				}
-				sendFlag := false
-				if str == "list" {
-					mess = Message{
-						Cmd:      str,
-						Sender:   u.name,
-						Data:     "",
-						Receiver: "server",
-					}
-					sendFlag = true
-				} else if str == "quit" {
-					mess = Message{
-						Cmd:      str,
-						Sender:   u.name,
-						Data:     "",
-						Receiver: "server",
-					}
-					sendFlag = true
-				} else {
-					lists := strings.Split(str, " ")
-					if lists[0] == "group" {
-						if len(lists) == 2 {
-							if lists[1] == u.name { //如果选着跟自己交谈，就没必要了吧
-								fmt.Println("you can talk to yourself without me")
-							} else {
-								mess = Message{
-									Cmd:      lists[0],
-									Sender:   u.name,
-									Data:     strings.Join(lists[1:len(lists)], "/"),
-									Receiver: "server",
-								}
-								sendFlag = true
-							}
-						} else { //暂时只有两人间的会话
-							fmt.Println("just support conversation between 2 clients")
-						}
-					}
-				}
-				if sendFlag {
-					encoder := json.NewEncoder(chatConn)
-					err := encoder.Encode(mess)
-					if err != nil {
-						fmt.Println(err)
-						logger.Panic(err)
-					}
-				}
-			}
-		}
+func OpenLog(path string) *log.Logger {
+	year, month, day := time.Now().Date()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		fmt.Println(err)
+		return log.New(os.Stderr, fmt.Sprintf("R:%v-%v-%v:", year, month, day), log.Ltime)
 	}
+	return log.New(file, fmt.Sprintf("R:%v-%v-%v:", year, month, day), log.Ltime)
 }
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	listenPort := "172.16.18.163:8080"
-	file, err := os.OpenFile("log.txt", os.O_APPEND, 0666)
+	config, err := NewConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
 	if err != nil {
-		file, err = os.Create("log.txt")
-		if err != nil {
-			fmt.Println(err)
-		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger := OpenLog(config.LogFile)
+	temp := Login(config)
+	temp.chatMode = config.Mode
+	temp.beatInterval = config.BeatInterval
+	temp.pongCh = make(chan string, 1)
+	temp.drops = NewDropCounter()
+	temp.reliable = NewReliable(config.Retries, config.AckWait)
+	temp.talks = NewConversations()
+	temp.fragments = NewReassembler(5*time.Second, 4*MaxMessageSize, 2*MaxMessageSize, temp.drops)
+	//本地保存直连会话记录
+	temp.history, err = NewHistory(filepath.Join(config.HistoryDir, fmt.Sprintf("%x", temp.name)))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
-	year, month, day := time.Now().Date()
-	logger := log.New(file, fmt.Sprintf("R:%v-%v-%v:", year, month, day), log.Ltime)
-	temp := Login(listenPort)
-	fmt.Println(temp)
 	fmt.Println(temp.reader.LocalAddr().String())
-	groupCh := make(chan string)
+	//会话通知可能连续到达，写进程打洞期间读进程不阻塞
+	groupCh := make(chan string, 16)
 	go temp.Read(groupCh, logger)
 	temp.Write(groupCh, logger)
 }
@@ -0,0 +1,831 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+/****************************************************
+*@function newTestUser(t *testing.T, name string, conn PacketConn, server string) *User
+*****************************************************
+*@brief 新建使用给定端口的用户并开启读进程，测试结束时
+关闭端口
+*****************************************************/
+func newTestUser(t *testing.T, name string, conn PacketConn, server string) *User {
+	t.Helper()
+	u, _ := newTestClient(t, name, "", conn, server)
+	return u
+}
+
+/****************************************************
+*@function newTestClient(t *testing.T, name, token string, conn PacketConn, server string) (*User, chan string)
+*****************************************************
+*@brief 新建带会话令牌的用户并开启读进程，返回读进程
+通知写进程的channel
+*****************************************************/
+func newTestClient(t *testing.T, name, token string, conn PacketConn, server string) (*User, chan string) {
+	t.Helper()
+	u := &User{
+		reader:   conn,
+		name:     name,
+		token:    token,
+		chatPort: server,
+		chatMode: "auto",
+		pongCh:   make(chan string, 1),
+		drops:    NewDropCounter(),
+		reliable: NewReliable(2, 100*time.Millisecond),
+		talks:    NewConversations(),
+	}
+	u.fragments = NewReassembler(time.Second, 4*MaxMessageSize, 2*MaxMessageSize, u.drops)
+	secrets, err := NewSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.secrets = secrets
+	u.history, err = NewHistory(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	groupCh := make(chan string, 16)
+	go u.Read(groupCh, log.New(io.Discard, "", 0))
+	t.Cleanup(func() {
+		conn.Close()
+	})
+	return u, groupCh
+}
+
+/****************************************************
+*@function observe(t *testing.T, server *SimConn, users ...*User) map[string]string
+*****************************************************
+*@brief 用户向服务器发送心跳，返回服务器看到的来源地址，
+即group握手中转交的公网地址
+*****************************************************/
+func observe(t *testing.T, server *SimConn, users ...*User) map[string]string {
+	t.Helper()
+	for _, u := range users {
+		data, err := EncodeFrame(nil, Message{Cmd: "beat", Sender: u.name, Receiver: "server"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.reader.WriteToUDP(data, server.addr)
+	}
+	observed := make(map[string]string)
+	buffer := make([]byte, 2048)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	for len(observed) < len(users) {
+		count, from, err := server.ReadFromUDP(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mess, err := DecodeFrame(buffer[:count])
+		if err != nil {
+			t.Fatal(err)
+		}
+		observed[mess.Sender] = from.String()
+	}
+	return observed
+}
+
+/****************************************************
+*@function punchBoth(a, b *User, addrsA, addrsB []string) (*net.UDPAddr, *net.UDPAddr)
+*****************************************************
+*@brief 双方同时打洞，返回各自打通的对方地址
+*****************************************************/
+func punchBoth(a, b *User, addrsA, addrsB []string) (*net.UDPAddr, *net.UDPAddr) {
+	logger := log.New(io.Discard, "", 0)
+	done := make(chan *net.UDPAddr)
+	go func() {
+		done <- b.Punch(a.name, addrsA, logger)
+	}()
+	fromA := a.Punch(b.name, addrsB, logger)
+	return fromA, <-done
+}
+
+/****************************************************
+*@brief 不同类型的NAT之间打洞：至少一方的映射与目标
+无关且另一方不是对称型时可以直连，否则双方都返回nil，
+由会话回退到服务器中转
+*****************************************************/
+func TestPunchThroughNAT(t *testing.T) {
+	cases := []struct {
+		name string
+		a, b NATType
+		ok   bool
+	}{
+		{"full cone", NATFullCone, NATFullCone, true},
+		{"restricted and port restricted", NATRestricted, NATPortRestricted, true},
+		{"port restricted", NATPortRestricted, NATPortRestricted, true},
+		{"symmetric and full cone", NATSymmetric, NATFullCone, true},
+		{"symmetric and restricted", NATSymmetric, NATRestricted, true},
+		{"symmetric and port restricted", NATSymmetric, NATPortRestricted, false},
+		{"symmetric", NATSymmetric, NATSymmetric, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			simNet := NewSimNet()
+			server := simNet.Listen("198.51.100.1:8081")
+			natA := simNet.NAT(c.a, "203.0.113.1")
+			natB := simNet.NAT(c.b, "203.0.113.2")
+			alice := newTestUser(t, "alice", natA.Listen("192.168.1.10:5000"), server.addr.String())
+			bob := newTestUser(t, "bob", natB.Listen("192.168.1.10:5000"), server.addr.String())
+			observed := observe(t, server, alice, bob)
+			toB, toA := punchBoth(alice, bob,
+				[]string{observed["alice"], "192.168.1.10:5000"},
+				[]string{observed["bob"], "192.168.1.10:5000"})
+			if (toB != nil && toA != nil) != c.ok {
+				t.Fatalf("punch alice->bob %v, bob->alice %v, want success %v", toB, toA, c.ok)
+			}
+			if !c.ok {
+				return
+			}
+			//打洞之后双方经打通的地址收发不再被NAT过滤
+			dropped := simNet.Dropped()
+			data, _ := EncodeFrame(nil, Message{Cmd: "punchack", Sender: "alice", Receiver: "bob"})
+			alice.reader.WriteToUDP(data, toB)
+			data, _ = EncodeFrame(nil, Message{Cmd: "punchack", Sender: "bob", Receiver: "alice"})
+			bob.reader.WriteToUDP(data, toA)
+			if simNet.Dropped() != dropped {
+				t.Errorf("datagrams over the punched path were dropped")
+			}
+		})
+	}
+}
+
+/****************************************************
+*@brief 同一NAT后面的两个用户经内网地址直连
+*****************************************************/
+func TestPunchSameLAN(t *testing.T) {
+	simNet := NewSimNet()
+	server := simNet.Listen("198.51.100.1:8081")
+	nat := simNet.NAT(NATPortRestricted, "203.0.113.1")
+	alice := newTestUser(t, "alice", nat.Listen("192.168.1.10:5000"), server.addr.String())
+	bob := newTestUser(t, "bob", nat.Listen("192.168.1.11:5000"), server.addr.String())
+	observed := observe(t, server, alice, bob)
+	toB, toA := punchBoth(alice, bob,
+		[]string{observed["alice"], "192.168.1.10:5000"},
+		[]string{observed["bob"], "192.168.1.11:5000"})
+	if toB == nil || toB.String() != "192.168.1.11:5000" {
+		t.Errorf("alice reached bob at %v, want 192.168.1.11:5000", toB)
+	}
+	if toA == nil || toA.String() != "192.168.1.10:5000" {
+		t.Errorf("bob reached alice at %v, want 192.168.1.10:5000", toA)
+	}
+}
+
+/****************************************************
+*@brief 对方重启后换了身份公钥，新会话从计数1开始的
+消息可以解密；同一公钥重复建立时保留防重放状态
+*****************************************************/
+func TestSecretsRekey(t *testing.T) {
+	bob, err := NewSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seal := func(alice *Secrets, text string) Message {
+		mess := Message{Cmd: "chat", Sender: "alice", Data: text, Receiver: "bob"}
+		if !alice.Seal(&mess) {
+			t.Fatal("no key for bob")
+		}
+		return mess
+	}
+	for restart := 0; restart < 2; restart++ {
+		alice, err := NewSecrets()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := alice.Add("alice", "bob", bob.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+		if err := bob.Add("bob", "alice", alice.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+		var last Message
+		for i := 0; i < 3; i++ {
+			last = seal(alice, "hello")
+			mess := last
+			if err := bob.Open(&mess); err != nil || mess.Data != "hello" {
+				t.Fatalf("session %d message %d: %v", restart, i, err)
+			}
+		}
+		//同一公钥再次握手，已收到的消息仍被当作重放
+		if err := bob.Add("bob", "alice", alice.PublicKey()); err != nil {
+			t.Fatal(err)
+		}
+		if err := bob.Open(&last); err == nil {
+			t.Errorf("session %d: replayed message accepted", restart)
+		}
+	}
+}
+
+/****************************************************
+*@brief 超长的输入在加密前被拒绝，返回ErrTooLarge而不
+退出，也不发出任何数据报；不超过MaxTextSize的输入加密
+后仍可以编码
+*****************************************************/
+func TestChatTooLarge(t *testing.T) {
+	simNet := NewSimNet()
+	server := simNet.Listen("198.51.100.1:8081")
+	alice := newTestUser(t, "alice", simNet.Listen("198.51.100.2:5000"), server.addr.String())
+	alice.talks.Open(Conversation{
+		Name:   "bob",
+		Writer: PeerWriter{conn: alice.reader, addr: server.addr},
+		Relay:  true,
+	})
+	err := alice.Chat("bob", strings.Repeat("x", MaxTextSize+1), log.New(io.Discard, "", 0))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("got %v, want ErrTooLarge", err)
+	}
+	server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := server.ReadFromUDP(make([]byte, 2048)); err == nil {
+		t.Error("an oversized message was sent")
+	}
+
+	secrets, err := NewSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := secrets.Add("alice", "bob", secrets.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	mess := Message{Cmd: "chat", Sender: "alice", Data: strings.Repeat("x", MaxTextSize), Receiver: "bob", Token: "token"}
+	if !secrets.Seal(&mess) {
+		t.Fatal("no key for bob")
+	}
+	if _, err := EncodeFrames(nil, mess); err != nil {
+		t.Errorf("a sealed message of MaxTextSize bytes can not be sent: %v", err)
+	}
+}
+
+/****************************************************
+*@brief 重传次数与等待时间超过上限时配置无效，上限内
+重复消息的保留时间不溢出
+*****************************************************/
+func TestRetriesLimit(t *testing.T) {
+	for _, args := range [][]string{
+		{"-retries", "17"},
+		{"-retries", "1000"},
+		{"-ackwait", "2m"},
+	} {
+		if _, err := NewConfig(args); err == nil {
+			t.Errorf("%v was accepted", args)
+		}
+	}
+	config, err := NewConfig([]string{"-retries", "16", "-ackwait", "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReliable(config.Retries, config.AckWait)
+	if r.window < config.AckWait<<uint(config.Retries+1) {
+		t.Errorf("window %v is shorter than the last resend", r.window)
+	}
+}
+
+/****************************************************
+*@brief 客户端之间的指令以外的消息来自其他地址时被
+丢弃，不回复ack；来自服务器地址时正常处理
+*****************************************************/
+func TestServerOnlyFromServer(t *testing.T) {
+	simNet := NewSimNet()
+	server := simNet.Listen("198.51.100.1:8081")
+	spoofer := simNet.Listen("198.51.100.66:8081")
+	alice := newTestUser(t, "alice", simNet.Listen("198.51.100.2:5000"), server.addr.String())
+	aliceAddr := alice.reader.LocalAddr().(*net.UDPAddr)
+	send := func(conn *SimConn, mess Message) {
+		data, err := EncodeFrame(nil, mess)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.WriteToUDP(data, aliceAddr)
+	}
+	cmds := []string{"msg", "broadcast", "invite", "group", "presence", "mailbox", "join", "leave", "roomchat",
+		"list", "rooms", "mail", "history", "status", "watch", "unwatch", "decline", "unknown"}
+	for _, cmd := range cmds {
+		send(spoofer, Message{Cmd: cmd, Sender: "server", Data: "spoofed", Receiver: "alice", ID: "spoofed-" + cmd})
+		send(server, Message{Cmd: cmd, Sender: "server", Data: "real", Receiver: "alice", ID: "real-" + cmd})
+		data, _ := simRecv(t, server)
+		ack, err := DecodeFrame([]byte(data))
+		if err != nil || ack.Cmd != "ack" || ack.Data != "real-"+cmd {
+			t.Errorf("%s: server got %v (%v), want an ack", cmd, ack, err)
+		}
+	}
+	spoofer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, from, err := spoofer.ReadFromUDP(make([]byte, 2048)); err == nil {
+		t.Errorf("a spoofed message was acknowledged to %v", from)
+	}
+	if drops := alice.drops.Counts()["source"]; drops != len(cmds) {
+		t.Errorf("%d source drops, want %d", drops, len(cmds))
+	}
+	//客户端之间的聊天不经过服务器
+	send(spoofer, Message{Cmd: "chat", Sender: "bob", Data: "hi", Receiver: "alice", ID: "peer-chat"})
+	data, _ := simRecv(t, spoofer)
+	if ack, err := DecodeFrame([]byte(data)); err != nil || ack.Cmd != "ack" || ack.Data != "peer-chat" {
+		t.Errorf("peer chat: got %v (%v), want an ack", ack, err)
+	}
+}
+
+/****************************************************
+*@brief 伪造的kick被忽略；服务器的kick通知写进程退出，
+读进程随之结束，群聊中同样退出
+*****************************************************/
+func TestKickFromServer(t *testing.T) {
+	simNet := NewSimNet()
+	server := simNet.Listen("198.51.100.1:8081")
+	spoofer := simNet.Listen("198.51.100.66:8081")
+	conn := simNet.Listen("198.51.100.2:5000")
+	defer conn.Close()
+	u := &User{
+		reader:   conn,
+		name:     "alice",
+		chatPort: server.addr.String(),
+		pongCh:   make(chan string, 1),
+		drops:    NewDropCounter(),
+		reliable: NewReliable(2, 100*time.Millisecond),
+		talks:    NewConversations(),
+	}
+	u.fragments = NewReassembler(time.Second, 4*MaxMessageSize, 2*MaxMessageSize, u.drops)
+	logger := log.New(io.Discard, "", 0)
+	groupCh := make(chan string, 16)
+	done := make(chan struct{})
+	go func() {
+		u.Read(groupCh, logger)
+		close(done)
+	}()
+	data, err := EncodeFrame(nil, Message{Cmd: "kick", Sender: "server", Data: "bye", Receiver: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	spoofer.WriteToUDP(data, conn.addr)
+	select {
+	case info := <-groupCh:
+		t.Fatalf("a spoofed kick reached the writer: %s", info)
+	case <-time.After(100 * time.Millisecond):
+	}
+	server.WriteToUDP(data, conn.addr)
+	select {
+	case info := <-groupCh:
+		if info != "kick/bye" {
+			t.Errorf("writer got %q, want kick/bye", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the kick did not reach the writer")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the reader kept running after the kick")
+	}
+	groupCh <- "kick/bye"
+	if u.RoomChat("lobby", make(chan string), groupCh, PeerWriter{}, logger) {
+		t.Error("room chat kept running after the kick")
+	}
+}
+
+/****************************************************
+*@brief 服务器代为投递的msg与离线留言以server为发送者，
+客户端的ack发给服务器并携带令牌，服务器据此停止重传
+*****************************************************/
+func TestAckServerNotes(t *testing.T) {
+	simNet := NewSimNet()
+	server := simNet.Listen("198.51.100.1:8081")
+	alice, _ := newTestClient(t, "alice", "ta", simNet.Listen("198.51.100.2:5000"), server.addr.String())
+	aliceAddr := alice.reader.LocalAddr().(*net.UDPAddr)
+	buffer := make([]byte, 2048)
+	for _, cmd := range []string{"msg", "mailbox"} {
+		data, err := EncodeFrame(nil, Message{
+			Cmd:      cmd,
+			Sender:   "server",
+			Data:     "2026-10-18 09:00:00/hi",
+			Receiver: "alice",
+			Payload:  NewPayload(Payload{Note: &NoteInfo{From: "bob", Text: "hi", Time: "2026-10-18 09:00:00"}}),
+			ID:       "s-" + cmd,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.WriteToUDP(data, aliceAddr)
+		server.SetReadDeadline(time.Now().Add(time.Second))
+		count, _, err := server.ReadFromUDP(buffer)
+		if err != nil {
+			t.Fatalf("%s: no ack: %v", cmd, err)
+		}
+		ack, err := DecodeFrame(buffer[:count])
+		if err != nil || ack.Cmd != "ack" || ack.Data != "s-"+cmd || ack.Receiver != "server" || ack.Token != "ta" {
+			t.Errorf("%s: got %+v (%v), want an ack to the server with the token", cmd, ack, err)
+		}
+	}
+}
+
+/****************************************************
+*@function pending(r *Reliable) int
+*****************************************************
+*@brief 输出尚未确认也未放弃的消息数
+*****************************************************/
+func pending(r *Reliable) int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.pending)
+}
+
+/****************************************************
+*@brief 直连会话中对方的读进程回复ack，发送方的读进程
+收到后停止重传；同一消息ID重复到达时每次都回复ack，
+但只记录一次
+*****************************************************/
+func TestChatAckedThroughRead(t *testing.T) {
+	simNet := NewSimNet()
+	server := simNet.Listen("198.51.100.1:8081")
+	alice, _ := newTestClient(t, "alice", "ta", simNet.Listen("192.168.1.10:5000"), server.addr.String())
+	bob, _ := newTestClient(t, "bob", "tb", simNet.Listen("192.168.1.11:5000"), server.addr.String())
+	bobAddr := bob.reader.LocalAddr().(*net.UDPAddr)
+	alice.talks.Open(Conversation{Name: "bob", Writer: PeerWriter{conn: alice.reader, addr: bobAddr}, PeerAddr: bobAddr})
+	if err := alice.Chat("bob", "hi", log.New(io.Discard, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for pending(alice.reliable) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := pending(alice.reliable); n != 0 {
+		t.Fatalf("%d messages still unacknowledged", n)
+	}
+	//重传全部用尽所需的时间之后，bob仍只记录一条
+	time.Sleep(800 * time.Millisecond)
+	if records, err := bob.history.Last("bob", "alice", 10); err != nil || len(records) != 1 || records[0].Data != "hi" {
+		t.Errorf("bob recorded %v (%v), want one message", records, err)
+	}
+
+	carol := simNet.Listen("192.168.1.12:5000")
+	data, err := EncodeFrame(nil, Message{Cmd: "chat", Sender: "carol", Data: "again", Receiver: "bob", ID: "c-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		carol.WriteToUDP(data, bobAddr)
+		reply, _ := simRecv(t, carol)
+		if ack, err := DecodeFrame([]byte(reply)); err != nil || ack.Cmd != "ack" || ack.Data != "c-1" {
+			t.Errorf("copy %d: got %v (%v), want an ack", i+1, ack, err)
+		}
+	}
+	if records, err := bob.history.Last("bob", "carol", 10); err != nil || len(records) != 1 {
+		t.Errorf("bob recorded %v (%v), want the duplicate dropped", records, err)
+	}
+}
+
+/****************************************************
+*@brief 对方一直不确认时按ackwait、2*ackwait的间隔重传，
+retries次后放弃
+*****************************************************/
+func TestChatResendBackoff(t *testing.T) {
+	simNet := NewSimNet()
+	server := simNet.Listen("198.51.100.1:8081")
+	alice, _ := newTestClient(t, "alice", "ta", simNet.Listen("192.168.1.10:5000"), server.addr.String())
+	dave := simNet.Listen("192.168.1.13:5000")
+	alice.talks.Open(Conversation{Name: "dave", Writer: PeerWriter{conn: alice.reader, addr: dave.addr}, PeerAddr: dave.addr})
+	if err := alice.Chat("dave", "lost", log.New(io.Discard, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	//newTestClient重传2次，第一次等待100ms
+	arrivals := make([]time.Time, 0)
+	ids := make(map[string]bool)
+	buffer := make([]byte, 2048)
+	dave.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		count, _, err := dave.ReadFromUDP(buffer)
+		if err != nil {
+			break
+		}
+		arrivals = append(arrivals, time.Now())
+		if mess, err := DecodeFrame(buffer[:count]); err == nil {
+			ids[mess.ID] = true
+		}
+	}
+	if len(arrivals) != 3 || len(ids) != 1 {
+		t.Fatalf("%d copies with %d ids, want the message and 2 resends", len(arrivals), len(ids))
+	}
+	for i, least := range []time.Duration{90 * time.Millisecond, 190 * time.Millisecond} {
+		if gap := arrivals[i+1].Sub(arrivals[i]); gap < least {
+			t.Errorf("resend %d after %v, want at least %v", i+1, gap, least)
+		}
+	}
+	if n := pending(alice.reliable); n != 0 {
+		t.Errorf("%d messages still pending after giving up", n)
+	}
+}
+
+/****************************************************
+*@brief 同时打开多个会话时，读进程把后台会话的消息暂存
+为未读，切换后取出；关闭前台会话后切换到下一个会话，
+已关闭的会话不能再发送
+*****************************************************/
+func TestConversationsUnread(t *testing.T) {
+	simNet := NewSimNet()
+	server := simNet.Listen("198.51.100.1:8081")
+	alice, _ := newTestClient(t, "alice", "ta", simNet.Listen("192.168.1.10:5000"), server.addr.String())
+	aliceAddr := alice.reader.LocalAddr().(*net.UDPAddr)
+	peers := make(map[string]*SimConn)
+	for i, name := range []string{"bob", "carol"} {
+		peers[name] = simNet.Listen(fmt.Sprintf("192.168.1.%d:5000", 11+i))
+		alice.talks.Open(Conversation{Name: name, Writer: PeerWriter{conn: alice.reader, addr: peers[name].addr}, PeerAddr: peers[name].addr})
+	}
+	if active := alice.talks.Active(); active != "carol" {
+		t.Fatalf("active %q, want the last opened conversation", active)
+	}
+	chat := func(from, id, text string) {
+		t.Helper()
+		data, err := EncodeFrame(nil, Message{Cmd: "chat", Sender: from, Data: text, Receiver: "alice", ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		records, _ := alice.history.Last("alice", from, 10)
+		peers[from].WriteToUDP(data, aliceAddr)
+		simRecv(t, peers[from])
+		//ack先于显示发出，读进程记录历史后消息才处理完毕
+		for deadline := time.Now().Add(time.Second); ; {
+			if now, _ := alice.history.Last("alice", from, 10); len(now) > len(records) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("the message from %s was not recorded", from)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	chat("bob", "b-1", "one")
+	chat("bob", "b-2", "two")
+	chat("carol", "c-1", "front")
+	if conv, _ := alice.talks.Get("bob"); len(conv.Unread) != 2 || !strings.HasSuffix(conv.Unread[1], "<bob>:two") {
+		t.Errorf("bob unread %q, want both messages", conv.Unread)
+	}
+	if conv, _ := alice.talks.Get("carol"); len(conv.Unread) != 0 {
+		t.Errorf("carol unread %q, the active conversation shows messages at once", conv.Unread)
+	}
+	unread, ok := alice.talks.Switch("bob")
+	if !ok || len(unread) != 2 || alice.talks.Active() != "bob" {
+		t.Errorf("switch returned %q %v, active %q", unread, ok, alice.talks.Active())
+	}
+	chat("carol", "c-2", "back")
+	if conv, _ := alice.talks.Get("carol"); len(conv.Unread) != 1 {
+		t.Errorf("carol unread %q after switching away", conv.Unread)
+	}
+	if !alice.talks.Close("bob") || alice.talks.Active() != "carol" {
+		t.Errorf("active %q after closing bob, want carol", alice.talks.Active())
+	}
+	if err := alice.Chat("bob", "bye", log.New(io.Discard, "", 0)); err == nil {
+		t.Error("sent to a closed conversation")
+	}
+}
+
+/****************************************************
+*@brief auto模式下双方都在对称型NAT后面，打洞失败后
+会话改为经服务器中转：消息发往服务器并携带令牌，对方
+收到服务器转来的消息后正常显示与记录
+*****************************************************/
+func TestRelayFallback(t *testing.T) {
+	simNet := NewSimNet()
+	server := simNet.Listen("198.51.100.1:8081")
+	alice, _ := newTestClient(t, "alice", "ta", simNet.NAT(NATSymmetric, "203.0.113.1").Listen("192.168.1.10:5000"), server.addr.String())
+	bob, _ := newTestClient(t, "bob", "tb", simNet.NAT(NATSymmetric, "203.0.113.2").Listen("192.168.2.10:5000"), server.addr.String())
+	observed := observe(t, server, alice, bob)
+	chatConn := func(u *User) PeerWriter {
+		return PeerWriter{conn: u.reader, addr: server.addr}
+	}
+	logger := log.New(io.Discard, "", 0)
+	done := make(chan struct{})
+	go func() {
+		bob.Converse(fmt.Sprintf("alice/%s/192.168.1.10:5000", observed["alice"]), chatConn(bob), logger)
+		close(done)
+	}()
+	alice.Converse(fmt.Sprintf("bob/%s/192.168.2.10:5000", observed["bob"]), chatConn(alice), logger)
+	<-done
+	for _, u := range []*User{alice, bob} {
+		for _, conv := range []string{"alice", "bob"} {
+			if conv == u.name {
+				continue
+			}
+			if got, ok := u.talks.Get(conv); !ok || !got.Relay || got.Writer.addr.String() != server.addr.String() {
+				t.Fatalf("%s talks to %s with %+v, want a relay through the server", u.name, conv, got)
+			}
+		}
+	}
+
+	if err := alice.Chat("bob", "via server", logger); err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, 2048)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	count, _, err := server.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mess, err := DecodeFrame(buffer[:count])
+	if err != nil || mess.Cmd != "chat" || mess.Receiver != "bob" || mess.Token != "ta" || mess.ID == "" {
+		t.Fatalf("server got %+v (%v), want a reliable chat for bob with alice's token", mess, err)
+	}
+	//服务器按HandleChat转发，bob经服务器回复ack
+	bobAddr, _ := net.ResolveUDPAddr("udp", observed["bob"])
+	server.WriteToUDP(buffer[:count], bobAddr)
+	//alice未收到ack前可能重传，跳过重传的chat
+	ack := mess
+	for ack.Cmd == "chat" {
+		reply, _ := simRecv(t, server)
+		if ack, err = DecodeFrame([]byte(reply)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ack.Cmd != "ack" || ack.Data != mess.ID || ack.Receiver != "alice" {
+		t.Errorf("server got %v, want bob's ack for alice", ack)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		records, _ := bob.history.Last("bob", "alice", 10)
+		if len(records) == 1 && records[0].Data == "via server" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bob recorded %v, want the relayed message", records)
+		}
+	}
+}
+
+/****************************************************
+*@function testCert(t *testing.T, path string) tls.Certificate
+*****************************************************
+*@brief 生成与服务器开发模式相同的自签名证书，证书写入
+path供DialLogin固定信任
+*****************************************************/
+func testCert(t *testing.T, path string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "im test server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+/****************************************************
+*@brief DialLogin只信任ca文件中的证书：服务器证书匹配时
+连接成功，固定了其他证书或ca文件不可用时失败
+*****************************************************/
+func TestDialLoginPinsCA(t *testing.T) {
+	dir := t.TempDir()
+	caFile, otherFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "other.crt")
+	cert := testCert(t, caFile)
+	testCert(t, otherFile)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("welcome\n"))
+			}()
+		}
+	}()
+	addr := listener.Addr().String()
+	conn, err := DialLogin(addr, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "welcome\n" {
+		t.Errorf("got %q (%v) over TLS", line, err)
+	}
+	for _, path := range []string{otherFile, filepath.Join(dir, "missing.crt")} {
+		if conn, err := DialLogin(addr, path); err == nil {
+			conn.Close()
+			t.Errorf("connected while pinning %s", path)
+		}
+	}
+}
+
+/****************************************************
+*@brief history先读取本地记录，双方的消息在同一个文件
+中按时间排列；本地没有记录时向服务器请求中转会话记录，
+参数错误时不发送
+*****************************************************/
+func TestHistoryLocalFirst(t *testing.T) {
+	simNet := NewSimNet()
+	server := simNet.Listen("198.51.100.1:8081")
+	alice, _ := newTestClient(t, "alice", "ta", simNet.Listen("192.168.1.10:5000"), server.addr.String())
+	chatConn := PeerWriter{conn: alice.reader, addr: server.addr}
+	logger := log.New(io.Discard, "", 0)
+	for _, record := range []Record{
+		{Time: time.Now(), Sender: "alice", Receiver: "bob", Data: "one"},
+		{Time: time.Now(), Sender: "bob", Receiver: "alice", Data: "two"},
+		{Time: time.Now(), Sender: "alice", Receiver: "carol", Data: "other"},
+	} {
+		if err := alice.history.Append(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := alice.history.Last("bob", "alice", 1)
+	if err != nil || len(records) != 1 || records[0].Data != "two" {
+		t.Errorf("last record with bob is %v (%v), want two", records, err)
+	}
+
+	alice.History("history bob 5", chatConn, logger)
+	alice.History("history dave 0", chatConn, logger)
+	server.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := server.ReadFromUDP(make([]byte, 2048)); err == nil {
+		t.Error("asked the server although the history is local or the count is invalid")
+	}
+	alice.History("history dave 5", chatConn, logger)
+	reply, _ := simRecv(t, server)
+	mess, err := DecodeFrame([]byte(reply))
+	if err != nil || mess.Cmd != "history" || mess.Data != "dave/5" || mess.Token != "ta" || mess.Receiver != "server" {
+		t.Errorf("server got %v (%v), want a history request for dave", mess, err)
+	}
+}
+
+/****************************************************
+*@brief 读进程优先使用Payload中的房间信息，旧服务器只带
+Data时同样进入房间；携带错误的负载只显示，不进入房间
+*****************************************************/
+func TestReadTypedPayload(t *testing.T) {
+	simNet := NewSimNet()
+	server := simNet.Listen("198.51.100.1:8081")
+	conn := simNet.Listen("192.168.1.10:5000")
+	_, groupCh := newTestClient(t, "alice", "ta", conn, server.addr.String())
+	send := func(mess Message) {
+		t.Helper()
+		data, err := EncodeFrame(nil, mess)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.WriteToUDP(data, conn.addr)
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case info := <-groupCh:
+			if info != want {
+				t.Errorf("writer got %q, want %q", info, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s did not reach the writer", want)
+		}
+	}
+	quiet := func() {
+		t.Helper()
+		select {
+		case info := <-groupCh:
+			t.Errorf("writer got %q, want nothing", info)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	send(Message{Cmd: "join", Sender: "alice", Data: "ignored/alice", Receiver: "alice",
+		Payload: NewPayload(Payload{Room: &RoomInfo{Name: "lobby", Members: []string{"alice"}}})})
+	expect("join/lobby")
+	send(Message{Cmd: "join", Sender: "alice", Data: "den/alice/bob", Receiver: "alice"})
+	expect("join/den")
+	send(Message{Cmd: "join", Sender: "alice", Data: "the user <carol> is not online", Receiver: "alice",
+		Payload: NewPayload(Payload{Error: &ErrorInfo{Code: CodeNotOnline, Text: "the user <carol> is not online"}})})
+	quiet()
+	send(Message{Cmd: "join", Sender: "bob", Data: "lobby/alice/bob", Receiver: "alice", Payload: "{"})
+	quiet()
+}
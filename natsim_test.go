@@ -0,0 +1,458 @@
+package main
+
+//server.go与client.go各自是一个package main，测试按文件运行：
+//go test -race server.go natsim_test.go server_test.go
+//go test -race client.go natsim_test.go client_test.go
+
+import (
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+/****************************************************
+*@brief 定义模拟NAT的类型
+*****************************************************/
+type NATType int
+
+const (
+	NATFullCone       NATType = iota //映射与目标无关，任何地址都可以经映射发进来
+	NATRestricted                    //映射与目标无关，只接收发往过的IP
+	NATPortRestricted                //映射与目标无关，只接收发往过的IP与端口
+	NATSymmetric                     //每个目标地址单独映射，只接收该目标
+)
+
+/****************************************************
+*@brief 定义模拟网络中的一个数据报
+*****************************************************/
+type simPacket struct {
+	data []byte
+	from *net.UDPAddr
+}
+
+/****************************************************
+*@brief 定义进程内模拟网络，包括公网主机与若干NAT，
+所有路由在同一把锁内完成
+*****************************************************
+*@param lock：锁
+*@param hosts：公网地址->公网主机端口
+*@param nats：NAT公网IP->NAT
+*@param dropped：被NAT过滤或无法路由的数据报数
+*****************************************************/
+type SimNet struct {
+	lock    sync.Mutex
+	hosts   map[string]*SimConn
+	nats    map[string]*SimNAT
+	dropped int
+}
+
+/****************************************************
+*@brief 定义NAT的一个映射
+*****************************************************
+*@param inside：内网端口
+*@param public：映射的公网地址
+*@param allowed：发往过的IP以及IP:端口
+*****************************************************/
+type simMapping struct {
+	inside  *SimConn
+	public  *net.UDPAddr
+	allowed map[string]bool
+}
+
+/****************************************************
+*@brief 定义模拟NAT，同一NAT后面的主机互相可以用内网
+地址直达，不支持经公网地址回环
+*****************************************************
+*@param net：所在模拟网络
+*@param kind：NAT类型
+*@param ip：公网IP
+*@param hosts：内网地址->内网端口
+*@param maps：内网地址(对称型再加目标地址)->映射
+*@param ports：公网端口->映射
+*@param next：下一个分配的公网端口
+*****************************************************/
+type SimNAT struct {
+	net   *SimNet
+	kind  NATType
+	ip    net.IP
+	hosts map[string]*SimConn
+	maps  map[string]*simMapping
+	ports map[int]*simMapping
+	next  int
+}
+
+/****************************************************
+*@brief 定义模拟网络中的udp端口，实现PacketConn
+*****************************************************
+*@param net：所在模拟网络
+*@param nat：所在NAT，公网主机为nil
+*@param addr：本地地址，NAT后面的主机为内网地址
+*@param inbox：收到的数据报
+*@param done：关闭通知
+*@param once：保证只关闭一次
+*@param lock：读超时锁
+*@param deadline：读超时
+*****************************************************/
+type SimConn struct {
+	net      *SimNet
+	nat      *SimNAT
+	addr     *net.UDPAddr
+	inbox    chan simPacket
+	done     chan struct{}
+	once     sync.Once
+	lock     sync.Mutex
+	deadline time.Time
+}
+
+/****************************************************
+*@function NewSimNet() *SimNet
+*****************************************************
+*@brief 新建模拟网络
+*****************************************************/
+func NewSimNet() *SimNet {
+	return &SimNet{
+		hosts: make(map[string]*SimConn),
+		nats:  make(map[string]*SimNAT),
+	}
+}
+
+/****************************************************
+*@function func (n *SimNet) NAT(kind NATType, ip string) *SimNAT
+*****************************************************
+*@brief 在模拟网络中加入一个NAT
+*****************************************************
+*@param kind：NAT类型
+*@param ip：公网IP
+*****************************************************/
+func (n *SimNet) NAT(kind NATType, ip string) *SimNAT {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	nat := &SimNAT{
+		net:   n,
+		kind:  kind,
+		ip:    net.ParseIP(ip),
+		hosts: make(map[string]*SimConn),
+		maps:  make(map[string]*simMapping),
+		ports: make(map[int]*simMapping),
+		next:  30000,
+	}
+	n.nats[nat.ip.String()] = nat
+	return nat
+}
+
+/****************************************************
+*@function func (n *SimNet) Listen(addr string) *SimConn
+*****************************************************
+*@brief 在公网地址上打开端口
+*****************************************************/
+func (n *SimNet) Listen(addr string) *SimConn {
+	conn := n.newConn(nil, addr)
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.hosts[conn.addr.String()] = conn
+	return conn
+}
+
+/****************************************************
+*@function func (t *SimNAT) Listen(addr string) *SimConn
+*****************************************************
+*@brief 在NAT后面的内网地址上打开端口
+*****************************************************/
+func (t *SimNAT) Listen(addr string) *SimConn {
+	conn := t.net.newConn(t, addr)
+	t.net.lock.Lock()
+	defer t.net.lock.Unlock()
+	t.hosts[conn.addr.String()] = conn
+	return conn
+}
+
+/****************************************************
+*@function func (t *SimNAT) Public(inside *SimConn, to string) string
+*****************************************************
+*@brief 输出内网端口发往to时使用的公网地址，尚未映射
+时为空
+*****************************************************/
+func (t *SimNAT) Public(inside *SimConn, to string) string {
+	t.net.lock.Lock()
+	defer t.net.lock.Unlock()
+	key := inside.addr.String()
+	if t.kind == NATSymmetric {
+		key += ">" + to
+	}
+	mapping, flag := t.maps[key]
+	if !flag {
+		return ""
+	}
+	return mapping.public.String()
+}
+
+/****************************************************
+*@function func (n *SimNet) Dropped() int
+*****************************************************
+*@brief 输出被NAT过滤或无法路由的数据报数
+*****************************************************/
+func (n *SimNet) Dropped() int {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.dropped
+}
+
+/****************************************************
+*@function func (n *SimNet) newConn(nat *SimNAT, addr string) *SimConn
+*****************************************************
+*@brief 新建端口，地址不合法时panic
+*****************************************************/
+func (n *SimNet) newConn(nat *SimNAT, addr string) *SimConn {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		panic(err)
+	}
+	return &SimConn{
+		net:   n,
+		nat:   nat,
+		addr:  udpAddr,
+		inbox: make(chan simPacket, 4096),
+		done:  make(chan struct{}),
+	}
+}
+
+/****************************************************
+*@function func (n *SimNet) route(from *SimConn, data []byte, to *net.UDPAddr)
+*****************************************************
+*@brief 路由一个数据报：同一内网直达，否则经发送方NAT
+映射后发往公网地址
+*****************************************************/
+func (n *SimNet) route(from *SimConn, data []byte, to *net.UDPAddr) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	src := from.addr
+	if from.nat != nil {
+		if peer, flag := from.nat.hosts[to.String()]; flag {
+			peer.push(data, from.addr)
+			return
+		}
+		src = from.nat.outbound(from, to)
+	}
+	if nat, flag := n.nats[to.IP.String()]; flag {
+		mapping, flag := nat.ports[to.Port]
+		if !flag || nat == from.nat || !nat.accepts(mapping, src) {
+			n.dropped++
+			return
+		}
+		mapping.inside.push(data, src)
+		return
+	}
+	if host, flag := n.hosts[to.String()]; flag {
+		host.push(data, src)
+		return
+	}
+	n.dropped++
+}
+
+/****************************************************
+*@function func (t *SimNAT) outbound(from *SimConn, to *net.UDPAddr) *net.UDPAddr
+*****************************************************
+*@brief 查找或新建发往to的映射，记录发往过的地址，
+调用方持有模拟网络的锁
+*****************************************************/
+func (t *SimNAT) outbound(from *SimConn, to *net.UDPAddr) *net.UDPAddr {
+	key := from.addr.String()
+	if t.kind == NATSymmetric {
+		key += ">" + to.String()
+	}
+	mapping, flag := t.maps[key]
+	if !flag {
+		t.next++
+		mapping = &simMapping{
+			inside:  from,
+			public:  &net.UDPAddr{IP: t.ip, Port: t.next},
+			allowed: make(map[string]bool),
+		}
+		t.maps[key] = mapping
+		t.ports[t.next] = mapping
+	}
+	mapping.allowed[to.IP.String()] = true
+	mapping.allowed[to.String()] = true
+	return mapping.public
+}
+
+/****************************************************
+*@function func (t *SimNAT) accepts(mapping *simMapping, src *net.UDPAddr) bool
+*****************************************************
+*@brief 按NAT类型判断是否放行从src发到映射的数据报
+*****************************************************/
+func (t *SimNAT) accepts(mapping *simMapping, src *net.UDPAddr) bool {
+	switch t.kind {
+	case NATFullCone:
+		return true
+	case NATRestricted:
+		return mapping.allowed[src.IP.String()]
+	default:
+		return mapping.allowed[src.String()]
+	}
+}
+
+/****************************************************
+*@function func (c *SimConn) push(data []byte, from *net.UDPAddr)
+*****************************************************
+*@brief 放入收到的数据报，端口关闭或缓冲已满时丢弃
+*****************************************************/
+func (c *SimConn) push(data []byte, from *net.UDPAddr) {
+	select {
+	case <-c.done:
+		c.net.dropped++
+		return
+	default:
+	}
+	select {
+	case c.inbox <- simPacket{data: data, from: from}:
+	default:
+		c.net.dropped++
+	}
+}
+
+/****************************************************
+*@function func (c *SimConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+*****************************************************
+*@brief 读取一个数据报，与*net.UDPConn一样在关闭后返回
+net.ErrClosed，超时返回os.ErrDeadlineExceeded
+*****************************************************/
+func (c *SimConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	c.lock.Lock()
+	deadline := c.deadline
+	c.lock.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case packet := <-c.inbox:
+		return copy(b, packet.data), packet.from, nil
+	case <-c.done:
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Addr: c.addr, Err: net.ErrClosed}
+	case <-timeout:
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Addr: c.addr, Err: os.ErrDeadlineExceeded}
+	}
+}
+
+/****************************************************
+*@function func (c *SimConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+*****************************************************
+*@brief 经模拟网络发送一个数据报，与udp一样不保证送达
+*****************************************************/
+func (c *SimConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: c.addr, Err: net.ErrClosed}
+	default:
+	}
+	c.net.route(c, append([]byte(nil), b...), addr)
+	return len(b), nil
+}
+
+/****************************************************
+*@function func (c *SimConn) SetReadDeadline(t time.Time) error
+*****************************************************
+*@brief 设置读超时，零值表示不超时
+*****************************************************/
+func (c *SimConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deadline = t
+	return nil
+}
+
+/****************************************************
+*@function func (c *SimConn) LocalAddr() net.Addr
+*****************************************************
+*@brief 输出本地地址
+*****************************************************/
+func (c *SimConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+/****************************************************
+*@function func (c *SimConn) Close() error
+*****************************************************
+*@brief 关闭端口，阻塞的ReadFromUDP返回net.ErrClosed
+*****************************************************/
+func (c *SimConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+	return nil
+}
+
+/****************************************************
+*@function simRecv(t *testing.T, conn *SimConn) (string, string)
+*****************************************************
+*@brief 等待一个数据报，返回内容与来源地址，模拟网络
+同步投递，200ms内没有收到时返回空串
+*****************************************************/
+func simRecv(t *testing.T, conn *SimConn) (string, string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+	buffer := make([]byte, 2048)
+	count, from, err := conn.ReadFromUDP(buffer)
+	if err != nil {
+		return "", ""
+	}
+	return string(buffer[:count]), from.String()
+}
+
+/****************************************************
+*@brief 各类NAT对外映射与入站过滤符合定义
+*****************************************************/
+func TestSimNATFiltering(t *testing.T) {
+	cases := []struct {
+		name    string
+		kind    NATType
+		sameMap bool //发往第二个目标时映射不变
+		anyIP   bool //没发往过的IP可以进来
+		anyPort bool //同一IP的其他端口可以进来
+	}{
+		{"full cone", NATFullCone, true, true, true},
+		{"restricted", NATRestricted, true, false, true},
+		{"port restricted", NATPortRestricted, true, false, false},
+		{"symmetric", NATSymmetric, false, false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			simNet := NewSimNet()
+			server := simNet.Listen("198.51.100.1:8081")
+			sameIP := simNet.Listen("198.51.100.1:9000")
+			otherIP := simNet.Listen("198.51.100.2:8081")
+			nat := simNet.NAT(c.kind, "203.0.113.1")
+			inside := nat.Listen("192.168.1.10:5000")
+			inside.WriteToUDP([]byte("beat"), server.addr)
+			data, observed := simRecv(t, server)
+			if data != "beat" || observed != nat.Public(inside, server.addr.String()) {
+				t.Fatalf("server got %q from %q", data, observed)
+			}
+			inside.WriteToUDP([]byte("beat"), otherIP.addr)
+			_, second := simRecv(t, otherIP)
+			if (second == observed) != c.sameMap {
+				t.Errorf("mapping to a second server is %s, first was %s", second, observed)
+			}
+			mapped, _ := net.ResolveUDPAddr("udp", observed)
+			sameIP.WriteToUDP([]byte("same ip"), mapped)
+			if data, _ := simRecv(t, inside); (data == "same ip") != c.anyPort {
+				t.Errorf("same ip, other port got %q", data)
+			}
+			stranger := simNet.Listen("198.51.100.3:8081")
+			stranger.WriteToUDP([]byte("stranger"), mapped)
+			if data, _ := simRecv(t, inside); (data == "stranger") != c.anyIP {
+				t.Errorf("unknown ip got %q", data)
+			}
+			server.WriteToUDP([]byte("reply"), mapped)
+			if data, _ := simRecv(t, inside); data != "reply" {
+				t.Errorf("reply from the server got %q", data)
+			}
+		})
+	}
+}
@@ -1,13 +1,33 @@
 package main
 
 import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"math/big"
 	"net"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,652 +39,5856 @@ json加密，
 *@param Data:消息内容
 *@param Sender：发送者，在用户名域
 *@param Receiver：接受者，在用户名域
+*@param Token：登录时下发的会话令牌，客户端发往服务器的消息必须携带
+*@param Key：客户端身份公钥，connect时上报
+*@param Nonce：端到端加密随机数，非空时Data为密文，服务器只转发
+*@param Codec：connect时协商的编解码，客户端按优先顺序列出，服务器返回选中的一个
+*@param Payload：json编码的结构化负载，见Payload
+*@param ID：需要确认的消息的ID，见Reliable
 *****************************************************/
 type Message struct {
 	Cmd      string
 	Data     string
 	Sender   string
 	Receiver string
+	Token    string
+	Key      string
+	Nonce    string
+	Codec    string
+	Payload  string
+	ID       string
 }
 
 /****************************************************
-*@brief 定义客户端用户
+*@brief 定义结构化消息负载，编码为json后放在
+Message.Payload中，每条消息只使用其中一个字段。Data中
+仍保留旧的斜杠分隔格式，兼容旧客户端
+*****************************************************
+*@param List：在线用户列表
+*@param Offer：两人会话建立时对方的地址与公钥
+*@param Invite：等待接受的会话邀请
+*@param Room：群聊房间及成员
+*@param Rooms：所有群聊房间
+*@param Error：带错误码的错误
+*@param Status：用户状态
+*@param Note：服务器代为投递的单条消息或离线留言
+*****************************************************/
+type Payload struct {
+	List   *UserList     `json:",omitempty"`
+	Offer  *SessionOffer `json:",omitempty"`
+	Invite *InviteInfo   `json:",omitempty"`
+	Room   *RoomInfo     `json:",omitempty"`
+	Rooms  *RoomList     `json:",omitempty"`
+	Error  *ErrorInfo    `json:",omitempty"`
+	Status *UserStatus   `json:",omitempty"`
+	Note   *NoteInfo     `json:",omitempty"`
+}
+
+/****************************************************
+*@brief 定义在线用户列表
+*****************************************************
+*@param Users：在线用户名
+*@param Statuses：在线用户的状态，顺序与Users相同
+*****************************************************/
+type UserList struct {
+	Users    []string
+	Statuses []UserStatus `json:",omitempty"`
+}
+
+/****************************************************
+*@brief 定义用户状态，Text为可选的状态说明
 *****************************************************
-*@param reader:消息接收接口
-*@param remoteAddr:远程服务器地址
 *@param Name：用户名
-*@param BeatCount：心跳累计
+*@param Status：状态，见StatusAvailable等
+*@param Text：状态说明
 *****************************************************/
-type User struct {
-	Name       string
-	Addr       string
-	RemoteName string
-	BeatCount  int
+type UserStatus struct {
+	Name   string
+	Status string
+	Text   string
+}
+
+/****************************************************
+*@brief 定义两人会话的建立信息，被叫方接受邀请后服务器
+同时发给发起方与被叫方
+*****************************************************
+*@param Sponsor：收到邀请的一方是否为发起方
+*@param Name：对方用户名
+*@param PublicAddr：服务器观察到的对方公网udp地址
+*@param PrivateAddr：对方上报的内网udp地址
+*@param Key：对方身份公钥
+*****************************************************/
+type SessionOffer struct {
+	Sponsor     bool
+	Name        string
+	PublicAddr  string
+	PrivateAddr string
+	Key         string
+}
+
+/****************************************************
+*@brief 定义会话邀请通知，服务器同时发给发起方与被叫方
+*****************************************************
+*@param From：发起者
+*@param To：被邀请者
+*@param Timeout：邀请有效的秒数
+*****************************************************/
+type InviteInfo struct {
+	From    string
+	To      string
+	Timeout int
+}
+
+/****************************************************
+*@brief 定义群聊房间及成员
+*****************************************************
+*@param Name：房间名
+*@param Members：成员用户名
+*****************************************************/
+type RoomInfo struct {
+	Name    string
+	Members []string
+}
+
+/****************************************************
+*@brief 定义服务器代为投递的单条消息或离线留言。这类
+消息以server为Sender可靠投递，接收方的ack发给服务器，
+作者放在From中
+*****************************************************
+*@param From：作者
+*@param Text：内容
+*@param Time：留言时间，单条消息为空
+*****************************************************/
+type NoteInfo struct {
+	From string
+	Text string
+	Time string `json:",omitempty"`
+}
+
+/****************************************************
+*@brief 定义所有群聊房间
+*****************************************************
+*@param Rooms：群聊房间
+*****************************************************/
+type RoomList struct {
+	Rooms []RoomInfo
+}
+
+/****************************************************
+*@brief 定义带错误码的错误
+*****************************************************
+*@param Code：错误码
+*@param Text：错误描述
+*****************************************************/
+type ErrorInfo struct {
+	Code int
+	Text string
+}
+
+/****************************************************
+*@brief 定义错误码
+*****************************************************/
+const (
+	CodeNotOnline     = 1
+	CodeBusy          = 2
+	CodeNotTalking    = 3
+	CodeNotRegistered = 4
+	CodeNotInRoom     = 5
+	CodeMailbox       = 6
+	CodeNotDelivered  = 7
+	CodeNoInvite      = 8
+	CodeDeclined      = 9
+	CodeExpired       = 10
+	CodeBadStatus     = 11
+	CodeNotWatching   = 12
+)
+
+/****************************************************
+*@brief 定义用户状态，dnd为请勿打扰，offline表示不在线，
+只出现在联系人状态中，不能设置
+*****************************************************/
+const (
+	StatusAvailable = "available"
+	StatusAway      = "away"
+	StatusBusy      = "busy"
+	StatusDND       = "dnd"
+	StatusOffline   = "offline"
+)
+
+/****************************************************
+*@function ValidStatus(status string) bool
+*****************************************************
+*@brief 判断是否为可设置的用户状态
+*****************************************************
+*@access Public
+*****************************************************
+*@param status：状态
+*****************************************************
+*@return bool：是否合法
+*****************************************************/
+func ValidStatus(status string) bool {
+	switch status {
+	case StatusAvailable, StatusAway, StatusBusy, StatusDND:
+		return true
+	}
+	return false
+}
+
+/****************************************************
+*@function NewPayload(payload Payload) string
+*****************************************************
+*@brief 把结构化负载编码为Message.Payload
+*****************************************************
+*@access Public
+*****************************************************
+*@param payload：结构化负载
+*****************************************************
+*@return string：json编码的负载
+*****************************************************/
+func NewPayload(payload Payload) string {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+/****************************************************
+*@function ParsePayload(mess Message) (Payload, bool)
+*****************************************************
+*@brief 解析消息中的结构化负载，旧版本对端不携带负载
+*****************************************************
+*@access Public
+*****************************************************
+*@param mess：消息
+*****************************************************
+*@return Payload：结构化负载
+*@return bool：是否携带合法的负载，为false时需解析Data
+*****************************************************/
+func ParsePayload(mess Message) (Payload, bool) {
+	var payload Payload
+	if mess.Payload == "" {
+		return payload, false
+	}
+	err := json.Unmarshal([]byte(mess.Payload), &payload)
+	return payload, err == nil
+}
+
+/****************************************************
+*@brief 定义消息编解码接口，ID写入帧头的负载类型，
+接收方据此选择解码方式
+*****************************************************
+*@param Name：编解码名称，connect时协商使用
+*@param ID：负载类型
+*@param Marshal：编码一条消息
+*@param Unmarshal：解码一条消息
+*****************************************************/
+type Codec interface {
+	Name() string
+	ID() byte
+	Marshal(mess Message) ([]byte, error)
+	Unmarshal(data []byte, mess *Message) error
+}
+
+/****************************************************
+*@brief 定义已支持的编解码，顺序即默认的优先顺序
+*****************************************************/
+var Codecs = []Codec{BinaryCodec{}, CBORCodec{}, JSONCodec{}}
+
+/****************************************************
+*@function CodecByName(name string) Codec
+*****************************************************
+*@brief 按名称查找编解码
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：编解码名称
+*****************************************************
+*@return Codec：编解码，不支持时为nil
+*****************************************************/
+func CodecByName(name string) Codec {
+	for _, codec := range Codecs {
+		if codec.Name() == name {
+			return codec
+		}
+	}
+	return nil
+}
+
+/****************************************************
+*@function CodecByID(id byte) Codec
+*****************************************************
+*@brief 按帧头的负载类型查找编解码
+*****************************************************
+*@access Public
+*****************************************************
+*@param id：负载类型
+*****************************************************
+*@return Codec：编解码，不支持时为nil
+*****************************************************/
+func CodecByID(id byte) Codec {
+	for _, codec := range Codecs {
+		if codec.ID() == id {
+			return codec
+		}
+	}
+	return nil
+}
+
+/****************************************************
+*@brief 定义json编解码，兼容只支持json的客户端
+*****************************************************/
+type JSONCodec struct{}
+
+/****************************************************
+*@function func (JSONCodec) Name() string
+*****************************************************
+*@brief 输出编解码名称
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return string：json
+*****************************************************/
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+/****************************************************
+*@function func (JSONCodec) ID() byte
+*****************************************************
+*@brief 输出负载类型
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return byte：0
+*****************************************************/
+func (JSONCodec) ID() byte {
+	return 0
+}
+
+/****************************************************
+*@function func (JSONCodec) Marshal(mess Message) ([]byte, error)
+*****************************************************
+*@brief 把消息编码为json
+*****************************************************
+*@access Public
+*****************************************************
+*@param mess：消息
+*****************************************************
+*@return []byte：编码结果
+*@return error：编码失败原因
+*****************************************************/
+func (JSONCodec) Marshal(mess Message) ([]byte, error) {
+	return json.Marshal(mess)
+}
+
+/****************************************************
+*@function func (JSONCodec) Unmarshal(data []byte, mess *Message) error
+*****************************************************
+*@brief 从json解码消息
+*****************************************************
+*@access Public
+*****************************************************
+*@param data：json数据
+*@param mess：解码结果
+*****************************************************
+*@return error：解码失败原因
+*****************************************************/
+func (JSONCodec) Unmarshal(data []byte, mess *Message) error {
+	return json.Unmarshal(data, mess)
+}
+
+/****************************************************
+*@brief 定义紧凑二进制编解码：按Cmd、Data、Sender、
+Receiver、Token、Key、Nonce、Codec、Payload、ID的顺序，每个字段为
+uvarint长度加内容，不重复字段名。解码时忽略末尾多出的
+字段，缺少的末尾字段为空，便于以后增加字段
+*****************************************************/
+type BinaryCodec struct{}
+
+/****************************************************
+*@function func (BinaryCodec) Name() string
+*****************************************************
+*@brief 输出编解码名称
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return string：binary
+*****************************************************/
+func (BinaryCodec) Name() string {
+	return "binary"
+}
+
+/****************************************************
+*@function func (BinaryCodec) ID() byte
+*****************************************************
+*@brief 输出负载类型
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return byte：1
+*****************************************************/
+func (BinaryCodec) ID() byte {
+	return 1
+}
+
+/****************************************************
+*@function func (BinaryCodec) Marshal(mess Message) ([]byte, error)
+*****************************************************
+*@brief 把消息编码为长度前缀的二进制
+*****************************************************
+*@access Public
+*****************************************************
+*@param mess：消息
+*****************************************************
+*@return []byte：编码结果
+*@return error：无
+*****************************************************/
+func (BinaryCodec) Marshal(mess Message) ([]byte, error) {
+	fields := []string{mess.Cmd, mess.Data, mess.Sender, mess.Receiver, mess.Token, mess.Key, mess.Nonce, mess.Codec, mess.Payload, mess.ID}
+	data := make([]byte, 0, 64)
+	for _, field := range fields {
+		data = binary.AppendUvarint(data, uint64(len(field)))
+		data = append(data, field...)
+	}
+	return data, nil
+}
+
+/****************************************************
+*@function func (BinaryCodec) Unmarshal(data []byte, mess *Message) error
+*****************************************************
+*@brief 从长度前缀的二进制解码消息
+*****************************************************
+*@access Public
+*****************************************************
+*@param data：二进制数据
+*@param mess：解码结果
+*****************************************************
+*@return error：数据被截断时返回错误
+*****************************************************/
+func (BinaryCodec) Unmarshal(data []byte, mess *Message) error {
+	fields := []*string{&mess.Cmd, &mess.Data, &mess.Sender, &mess.Receiver, &mess.Token, &mess.Key, &mess.Nonce, &mess.Codec, &mess.Payload, &mess.ID}
+	for _, field := range fields {
+		//旧版本编码的消息没有末尾的新字段
+		if len(data) == 0 {
+			return nil
+		}
+		length, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < length {
+			return errors.New("binary: truncated message")
+		}
+		*field = string(data[n : n+int(length)])
+		data = data[n+int(length):]
+	}
+	return nil
+}
+
+/****************************************************
+*@brief 定义cbor编解码(RFC 8949)：消息编码为以字段名
+为键的map，空字段省略，只使用定长的文本与map
+*****************************************************/
+type CBORCodec struct{}
+
+/****************************************************
+*@function func (CBORCodec) Name() string
+*****************************************************
+*@brief 输出编解码名称
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return string：cbor
+*****************************************************/
+func (CBORCodec) Name() string {
+	return "cbor"
+}
+
+/****************************************************
+*@function func (CBORCodec) ID() byte
+*****************************************************
+*@brief 输出负载类型
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return byte：2
+*****************************************************/
+func (CBORCodec) ID() byte {
+	return 2
+}
+
+/****************************************************
+*@function func (c CBORCodec) fields(mess *Message) ([]string, []*string)
+*****************************************************
+*@brief 输出消息的字段名与字段地址
+*****************************************************
+*@access Private
+*****************************************************
+*@param mess：消息
+*****************************************************
+*@return []string：字段名
+*@return []*string：字段地址
+*****************************************************/
+func (c CBORCodec) fields(mess *Message) ([]string, []*string) {
+	return []string{"Cmd", "Data", "Sender", "Receiver", "Token", "Key", "Nonce", "Codec", "Payload", "ID"},
+		[]*string{&mess.Cmd, &mess.Data, &mess.Sender, &mess.Receiver, &mess.Token, &mess.Key, &mess.Nonce, &mess.Codec, &mess.Payload, &mess.ID}
+}
+
+/****************************************************
+*@function func (c CBORCodec) head(data []byte, major byte, n uint64) []byte
+*****************************************************
+*@brief 写入cbor数据项的头部：主类型与长度
+*****************************************************
+*@access Private
+*****************************************************
+*@param data：已编码数据
+*@param major：主类型，3为文本，5为map
+*@param n：长度
+*****************************************************
+*@return []byte：追加头部后的数据
+*****************************************************/
+func (c CBORCodec) head(data []byte, major byte, n uint64) []byte {
+	major = major << 5
+	switch {
+	case n < 24:
+		return append(data, major|byte(n))
+	case n <= 0xff:
+		return append(data, major|24, byte(n))
+	case n <= 0xffff:
+		return binary.BigEndian.AppendUint16(append(data, major|25), uint16(n))
+	case n <= 0xffffffff:
+		return binary.BigEndian.AppendUint32(append(data, major|26), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(data, major|27), n)
+}
+
+/****************************************************
+*@function func (c CBORCodec) readHead(data []byte) (byte, uint64, []byte, error)
+*****************************************************
+*@brief 读取cbor数据项的头部，不支持不定长数据项
+*****************************************************
+*@access Private
+*****************************************************
+*@param data：待解码数据
+*****************************************************
+*@return byte：主类型
+*@return uint64：长度
+*@return []byte：头部之后的数据
+*@return error：数据不合法的原因
+*****************************************************/
+func (c CBORCodec) readHead(data []byte) (byte, uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, 0, nil, errors.New("cbor: truncated message")
+	}
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+	size := 0
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, nil, errors.New("cbor: indefinite length is not supported")
+	}
+	if len(data) < size {
+		return 0, 0, nil, errors.New("cbor: truncated message")
+	}
+	n := uint64(0)
+	for _, b := range data[:size] {
+		n = n<<8 | uint64(b)
+	}
+	return major, n, data[size:], nil
+}
+
+/****************************************************
+*@function func (c CBORCodec) readText(data []byte) (string, []byte, error)
+*****************************************************
+*@brief 读取一个cbor文本
+*****************************************************
+*@access Private
+*****************************************************
+*@param data：待解码数据
+*****************************************************
+*@return string：文本
+*@return []byte：文本之后的数据
+*@return error：数据不合法的原因
+*****************************************************/
+func (c CBORCodec) readText(data []byte) (string, []byte, error) {
+	major, n, data, err := c.readHead(data)
+	if err != nil {
+		return "", nil, err
+	}
+	if major != 3 {
+		return "", nil, fmt.Errorf("cbor: expected text, got major type %d", major)
+	}
+	if uint64(len(data)) < n {
+		return "", nil, errors.New("cbor: truncated message")
+	}
+	return string(data[:n]), data[n:], nil
+}
+
+/****************************************************
+*@function func (c CBORCodec) Marshal(mess Message) ([]byte, error)
+*****************************************************
+*@brief 把消息编码为cbor map
+*****************************************************
+*@access Public
+*****************************************************
+*@param mess：消息
+*****************************************************
+*@return []byte：编码结果
+*@return error：无
+*****************************************************/
+func (c CBORCodec) Marshal(mess Message) ([]byte, error) {
+	names, values := c.fields(&mess)
+	count := 0
+	for _, value := range values {
+		if *value != "" {
+			count++
+		}
+	}
+	data := c.head(make([]byte, 0, 64), 5, uint64(count))
+	for i, value := range values {
+		if *value != "" {
+			data = append(c.head(data, 3, uint64(len(names[i]))), names[i]...)
+			data = append(c.head(data, 3, uint64(len(*value))), *value...)
+		}
+	}
+	return data, nil
+}
+
+/****************************************************
+*@function func (c CBORCodec) Unmarshal(data []byte, mess *Message) error
+*****************************************************
+*@brief 从cbor map解码消息，忽略未知的键
+*****************************************************
+*@access Public
+*****************************************************
+*@param data：cbor数据
+*@param mess：解码结果
+*****************************************************
+*@return error：解码失败原因
+*****************************************************/
+func (c CBORCodec) Unmarshal(data []byte, mess *Message) error {
+	major, count, data, err := c.readHead(data)
+	if err != nil {
+		return err
+	}
+	if major != 5 {
+		return fmt.Errorf("cbor: expected map, got major type %d", major)
+	}
+	names, values := c.fields(mess)
+	for i := uint64(0); i < count; i++ {
+		var key, value string
+		key, data, err = c.readText(data)
+		if err != nil {
+			return err
+		}
+		value, data, err = c.readText(data)
+		if err != nil {
+			return err
+		}
+		for j, name := range names {
+			if name == key {
+				*values[j] = value
+			}
+		}
+	}
+	return nil
+}
+
+/****************************************************
+*@brief 定义udp数据报帧格式：2字节标识"IM"、1字节协议
+版本、1字节负载类型即编解码ID，之后为一条消息的负载。
+每个数据报不超过MaxFrameSize。超过FragmentSize的消息
+切分为多个分片帧发送，见EncodeFrames，重组后的整帧
+不超过MaxMessageSize
+*****************************************************/
+const (
+	FrameVersion   = 1
+	FrameHeader    = 4
+	MaxFrameSize   = 8192
+	FragmentType   = 0xFF
+	FragmentHeader = 12
+	FragmentSize   = 1200
+	MaxMessageSize = 1 << 20
+)
+
+/****************************************************
+*@brief 定义帧解析错误，Reason作为丢包计数的分类
+*****************************************************
+*@param Reason：丢弃原因，包括size、header、version、payload、fragment、memory
+*@param Err：具体错误
+*****************************************************/
+type FrameError struct {
+	Reason string
+	Err    error
+}
+
+/****************************************************
+*@function func (e *FrameError) Error() string
+*****************************************************
+*@brief 输出帧解析错误
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return string：错误描述
+*****************************************************/
+func (e *FrameError) Error() string {
+	return fmt.Sprintf("frame %s: %v", e.Reason, e.Err)
+}
+
+/****************************************************
+*@function EncodeFrame(codec Codec, mess Message) ([]byte, error)
+*****************************************************
+*@brief 把一条消息编码为一个整帧
+*****************************************************
+*@access Public
+*****************************************************
+*@param codec：编解码，为nil时使用json
+*@param mess：待发送消息
+*****************************************************
+*@return []byte：整帧，可能需要分片发送
+*@return error：编码失败或超出大小限制
+*****************************************************/
+func EncodeFrame(codec Codec, mess Message) ([]byte, error) {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	payload, err := codec.Marshal(mess)
+	if err != nil {
+		return nil, err
+	}
+	if FrameHeader+len(payload) > MaxMessageSize {
+		return nil, &FrameError{Reason: "size", Err: fmt.Errorf("%d bytes exceeds %d", FrameHeader+len(payload), MaxMessageSize)}
+	}
+	frame := make([]byte, 0, FrameHeader+len(payload))
+	frame = append(frame, 'I', 'M', FrameVersion, codec.ID())
+	return append(frame, payload...), nil
+}
+
+/****************************************************
+*@function EncodeFrames(codec Codec, mess Message) ([][]byte, error)
+*****************************************************
+*@brief 把一条消息编码为一个或多个数据报。整帧超过
+一个分片的大小时切分为带编号的分片，每个分片帧的负载
+类型为FragmentType，之后依次为8字节分片组编号、2字节
+分片序号、2字节分片总数以及整帧的一段
+*****************************************************
+*@access Public
+*****************************************************
+*@param codec：编解码，为nil时使用json
+*@param mess：待发送消息
+*****************************************************
+*@return [][]byte：按顺序发送的数据报
+*@return error：编码失败或超出大小限制
+*****************************************************/
+func EncodeFrames(codec Codec, mess Message) ([][]byte, error) {
+	frame, err := EncodeFrame(codec, mess)
+	if err != nil {
+		return nil, err
+	}
+	if len(frame) <= FrameHeader+FragmentHeader+FragmentSize {
+		return [][]byte{frame}, nil
+	}
+	key := make([]byte, 8)
+	rand.Read(key)
+	count := (len(frame) + FragmentSize - 1) / FragmentSize
+	frames := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		chunk := frame[i*FragmentSize : min((i+1)*FragmentSize, len(frame))]
+		fragment := make([]byte, 0, FrameHeader+FragmentHeader+len(chunk))
+		fragment = append(fragment, 'I', 'M', FrameVersion, FragmentType)
+		fragment = append(fragment, key...)
+		fragment = binary.BigEndian.AppendUint16(fragment, uint16(i))
+		fragment = binary.BigEndian.AppendUint16(fragment, uint16(count))
+		frames = append(frames, append(fragment, chunk...))
+	}
+	return frames, nil
+}
+
+/****************************************************
+*@function DecodeFrame(data []byte) (Message, error)
+*****************************************************
+*@brief 把一个整帧解码为一条消息，按帧头的负载类型
+选择编解码，大小、帧头、版本或负载不合法时返回*FrameError
+*****************************************************
+*@access Public
+*****************************************************
+*@param data：整帧，即Reassembler返回的数据报或重组结果
+*****************************************************
+*@return Message：消息
+*@return error：解析失败原因
+*****************************************************/
+func DecodeFrame(data []byte) (Message, error) {
+	var mess Message
+	if len(data) > MaxMessageSize {
+		return mess, &FrameError{Reason: "size", Err: fmt.Errorf("%d bytes exceeds %d", len(data), MaxMessageSize)}
+	}
+	if len(data) < FrameHeader || data[0] != 'I' || data[1] != 'M' {
+		return mess, &FrameError{Reason: "header", Err: errors.New("missing frame header")}
+	}
+	if data[2] != FrameVersion {
+		return mess, &FrameError{Reason: "version", Err: fmt.Errorf("unsupported version %d", data[2])}
+	}
+	codec := CodecByID(data[3])
+	if codec == nil {
+		return mess, &FrameError{Reason: "payload", Err: fmt.Errorf("unsupported payload type %d", data[3])}
+	}
+	err := codec.Unmarshal(data[FrameHeader:], &mess)
+	if err != nil {
+		return mess, &FrameError{Reason: "payload", Err: err}
+	}
+	return mess, nil
+}
+
+/****************************************************
+*@brief 定义一条正在重组的消息
+*****************************************************
+*@param chunks：按序号保存的分片内容，未收到的为nil
+*@param received：已收到的分片数
+*@param source：来源地址
+*@param size：已收到的字节数
+*@param started：收到第一个分片的时间
+*****************************************************/
+type partial struct {
+	chunks   [][]byte
+	received int
+	source   string
+	size     int
+	started  time.Time
+}
+
+/****************************************************
+*@brief 定义分片重组。按来源地址与分片组编号收集分片，
+收齐后拼接为整帧。超过timeout仍未收齐的消息被丢弃，
+所有未收齐消息占用的内存不超过limit，其中每个来源地址
+不超过quota。分片不带令牌，收齐之前无法校验发送者，
+单个来源因此不能占满全部内存
+*****************************************************
+*@param lock：锁
+*@param timeout：一条消息收齐分片的最长时间
+*@param limit：未收齐消息最多占用的字节数
+*@param quota：每个来源地址的未收齐消息最多占用的字节数
+*@param size：未收齐消息当前占用的字节数
+*@param sources：来源地址->未收齐消息占用的字节数
+*@param parts：来源地址/分片组编号->正在重组的消息
+*@param pruned：上次清理超时消息的时间
+*@param drops：丢包计数，超时丢弃的消息记为expired
+*****************************************************/
+type Reassembler struct {
+	lock    sync.Mutex
+	timeout time.Duration
+	limit   int
+	quota   int
+	size    int
+	sources map[string]int
+	parts   map[string]*partial
+	pruned  time.Time
+	drops   *DropCounter
+}
+
+/****************************************************
+*@function NewReassembler(timeout time.Duration, limit int, quota int, drops *DropCounter) *Reassembler
+*****************************************************
+*@brief 新建分片重组
+*****************************************************
+*@access Public
+*****************************************************
+*@param timeout：一条消息收齐分片的最长时间
+*@param limit：未收齐消息最多占用的字节数
+*@param quota：每个来源地址最多占用的字节数
+*@param drops：丢包计数
+*****************************************************
+*@return *Reassembler：分片重组
+*****************************************************/
+func NewReassembler(timeout time.Duration, limit int, quota int, drops *DropCounter) *Reassembler {
+	return &Reassembler{
+		timeout: timeout,
+		limit:   limit,
+		quota:   quota,
+		sources: make(map[string]int),
+		parts:   make(map[string]*partial),
+		pruned:  time.Now(),
+		drops:   drops,
+	}
+}
+
+/****************************************************
+*@function func (r *Reassembler) Add(source string, data []byte) ([]byte, error)
+*****************************************************
+*@brief 处理收到的一个数据报。不是分片时原样返回；是
+分片时保存，收齐后返回拼接的整帧，未收齐时返回nil
+*****************************************************
+*@access Public
+*****************************************************
+*@param source：来源地址
+*@param data：收到的数据报，返回后可以复用
+*****************************************************
+*@return []byte：可以交给DecodeFrame的整帧，未收齐时为nil
+*@return error：数据报过大、分片不合法或超出内存限制时返回*FrameError
+*****************************************************/
+func (r *Reassembler) Add(source string, data []byte) ([]byte, error) {
+	if len(data) > MaxFrameSize {
+		return nil, &FrameError{Reason: "size", Err: fmt.Errorf("%d bytes exceeds %d", len(data), MaxFrameSize)}
+	}
+	if len(data) < FrameHeader || data[0] != 'I' || data[1] != 'M' || data[2] != FrameVersion || data[3] != FragmentType {
+		return data, nil
+	}
+	if len(data) < FrameHeader+FragmentHeader {
+		return nil, &FrameError{Reason: "fragment", Err: errors.New("short fragment header")}
+	}
+	header := data[FrameHeader : FrameHeader+FragmentHeader]
+	index := int(binary.BigEndian.Uint16(header[8:10]))
+	count := int(binary.BigEndian.Uint16(header[10:12]))
+	if count == 0 || index >= count || count > (MaxMessageSize+FragmentSize-1)/FragmentSize {
+		return nil, &FrameError{Reason: "fragment", Err: fmt.Errorf("fragment %d of %d", index, count)}
+	}
+	key := source + "/" + hex.EncodeToString(header[:8])
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	if now.Sub(r.pruned) > time.Second {
+		for temp, part := range r.parts {
+			if now.Sub(part.started) > r.timeout {
+				r.remove(temp)
+				r.drops.Drop("expired")
+			}
+		}
+		r.pruned = now
+	}
+	part, flag := r.parts[key]
+	if !flag {
+		part = &partial{chunks: make([][]byte, count), source: source, started: now}
+		r.parts[key] = part
+	}
+	if len(part.chunks) != count {
+		r.remove(key)
+		return nil, &FrameError{Reason: "fragment", Err: fmt.Errorf("fragment count changed from %d to %d", len(part.chunks), count)}
+	}
+	if part.chunks[index] != nil {
+		//重复的分片
+		return nil, nil
+	}
+	//分片头同样计入占用，防止大量空分片
+	cost := len(data)
+	if r.sources[source]+cost > r.quota {
+		r.remove(key)
+		return nil, &FrameError{Reason: "memory", Err: fmt.Errorf("%d bytes of fragments waiting from %s, limit %d", r.sources[source], source, r.quota)}
+	}
+	if r.size+cost > r.limit {
+		r.remove(key)
+		return nil, &FrameError{Reason: "memory", Err: fmt.Errorf("%d bytes of fragments waiting, limit %d", r.size, r.limit)}
+	}
+	part.chunks[index] = append([]byte(nil), data[FrameHeader+FragmentHeader:]...)
+	part.received++
+	part.size += cost
+	r.size += cost
+	r.sources[source] += cost
+	if part.received < count {
+		return nil, nil
+	}
+	r.remove(key)
+	frame := make([]byte, 0, part.size)
+	for _, chunk := range part.chunks {
+		frame = append(frame, chunk...)
+	}
+	return frame, nil
+}
+
+/****************************************************
+*@function func (r *Reassembler) remove(key string)
+*****************************************************
+*@brief 删除一条正在重组的消息并释放占用，调用者持锁
+*****************************************************
+*@access Private
+*****************************************************
+*@param key：来源地址/分片组编号
+*****************************************************
+*@return 无
+*****************************************************/
+func (r *Reassembler) remove(key string) {
+	part, flag := r.parts[key]
+	if flag {
+		r.size -= part.size
+		r.sources[part.source] -= part.size
+		if r.sources[part.source] <= 0 {
+			delete(r.sources, part.source)
+		}
+		delete(r.parts, key)
+	}
+}
+
+/****************************************************
+*@brief 定义丢包计数，按丢弃原因分类
+*****************************************************
+*@param lock：计数锁
+*@param counts：丢弃原因->丢弃数
+*****************************************************/
+type DropCounter struct {
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+/****************************************************
+*@function NewDropCounter() *DropCounter
+*****************************************************
+*@brief 新建丢包计数
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return *DropCounter：丢包计数
+*****************************************************/
+func NewDropCounter() *DropCounter {
+	return &DropCounter{counts: make(map[string]int)}
+}
+
+/****************************************************
+*@function func (c *DropCounter) Drop(reason string) int
+*****************************************************
+*@brief 记录一次丢包
+*****************************************************
+*@access Public
+*****************************************************
+*@param reason：丢弃原因
+*****************************************************
+*@return int：该原因累计的丢弃数
+*****************************************************/
+func (c *DropCounter) Drop(reason string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counts[reason]++
+	return c.counts[reason]
+}
+
+/****************************************************
+*@function func (c *DropCounter) Counts() map[string]int
+*****************************************************
+*@brief 输出丢包计数的副本
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return map[string]int：丢弃原因->丢弃数
+*****************************************************/
+func (c *DropCounter) Counts() map[string]int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	counts := make(map[string]int, len(c.counts))
+	for reason, count := range c.counts {
+		counts[reason] = count
+	}
+	return counts
+}
+
+/****************************************************
+*@brief 定义客户端用户
+*****************************************************
+*@param reader:消息接收接口
+*@param remoteAddr:远程服务器地址
+*@param Name：用户名
+*@param Addr：客户端登录时上报的内网udp地址
+*@param PublicAddr：服务器从心跳观察到的公网udp地址
+*@param Peers：正在进行两人会话的对方用户名
+*@param Status：用户设置的状态，登录时为available
+*@param StatusText：状态说明
+*@param BeatCount：心跳累计
+*@param Token：会话令牌
+*@param Key：端到端加密身份公钥，group握手时转交给对方
+*@param Codec：connect时协商的编解码，服务器按此向客户端发送
+*****************************************************/
+type User struct {
+	Name       string
+	Addr       string
+	PublicAddr string
+	Peers      []string
+	Status     string
+	StatusText string
+	BeatCount  int
+	Token      string
+	Key        string
+	Codec      string
+}
+
+/****************************************************
+*@function func (u User) Endpoint() string
+*****************************************************
+*@brief 输出向客户端发送消息使用的udp地址，优先使用
+心跳观察到的公网地址
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return string：udp地址
+*****************************************************/
+func (u User) Endpoint() string {
+	if u.PublicAddr != "" {
+		return u.PublicAddr
+	}
+	return u.Addr
+}
+
+/****************************************************
+*@function func (u User) String() string
+*****************************************************
+*@brief 输出用户信息用于日志，会话令牌不写入日志
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return string：用户信息
+*****************************************************/
+func (u User) String() string {
+	if u.Token != "" {
+		u.Token = "***"
+	}
+	//转换为没有String方法的类型，避免递归
+	type plain User
+	return fmt.Sprintf("%+v", plain(u))
+}
+
+/****************************************************
+*@function func (u User) TalkingWith(name string) bool
+*****************************************************
+*@brief 判断用户是否正在与name进行两人会话
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：对方用户名
+*****************************************************
+*@return bool：是否正在会话
+*****************************************************/
+func (u User) TalkingWith(name string) bool {
+	for _, peer := range u.Peers {
+		if peer == name {
+			return true
+		}
+	}
+	return false
+}
+
+/****************************************************
+*@brief 定义在线用户存储接口，实现必须保证并发安全，
+心跳检查、消息监听与通知协程会同时访问
+*****************************************************
+*@param Add：添加用户
+*@param Change：修改已存在的用户
+*@param Delete：删除用户
+*@param Beat：记录一次心跳与心跳来源地址
+*@param Get：读取用户
+*@param Update：在锁内修改已存在的用户，避免读改写竞争
+*@param Verify：校验会话令牌与来源地址
+*@param Snapshot：输出全部在线用户的副本
+*****************************************************/
+type UserStore interface {
+	Add(name string, user User)
+	Change(name string, user User)
+	Delete(name string)
+	Beat(name string, publicAddr string)
+	Get(name string) (User, bool)
+	Update(name string, fn func(user *User)) bool
+	Verify(name, token, addr string) bool
+	Snapshot() map[string]User
+}
+
+/****************************************************
+*@brief 定义内存在线用户存储
+*****************************************************
+*@param lock：读写锁
+*@param shelf：用户名->用户
+*****************************************************/
+type MemoryStore struct {
+	lock  sync.RWMutex
+	shelf map[string]User
+}
+
+/****************************************************
+*@function NewMemoryStore() *MemoryStore
+*****************************************************
+*@brief 新建一个内存在线用户存储
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return *MemoryStore：内存存储
+*****************************************************/
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{shelf: make(map[string]User)}
+}
+
+/****************************************************
+*@function func (m *MemoryStore) Add(name string, user User)
+*****************************************************
+*@brief 添加用户，同名用户被覆盖
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param user:详细用户信息
+*****************************************************
+*@return 无
+*****************************************************/
+func (m *MemoryStore) Add(name string, user User) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.shelf[name] = user
+}
+
+/****************************************************
+*@function func (m *MemoryStore) Change(name string, user User)
+*****************************************************
+*@brief 修改已存在的用户，用户不存在时不做处理
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param user:详细用户信息
+*****************************************************
+*@return 无
+*****************************************************/
+func (m *MemoryStore) Change(name string, user User) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	_, flag := m.shelf[name]
+	if flag {
+		m.shelf[name] = user
+	}
+}
+
+/****************************************************
+*@function func (m *MemoryStore) Delete(name string)
+*****************************************************
+*@brief 删除用户
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return 无
+*****************************************************/
+func (m *MemoryStore) Delete(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.shelf, name)
+}
+
+/****************************************************
+*@function func (m *MemoryStore) Beat(name string, publicAddr string)
+*****************************************************
+*@brief 用户接收心跳，同时记录心跳的来源地址，即客户
+端的公网udp地址
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param publicAddr：心跳来源地址
+*****************************************************
+*@return 无
+*****************************************************/
+func (m *MemoryStore) Beat(name string, publicAddr string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	tempCell, flag := m.shelf[name]
+	if flag {
+		tempCell.PublicAddr = publicAddr
+		tempCell.BeatCount = tempCell.BeatCount + 1
+		m.shelf[name] = tempCell
+	}
+}
+
+/****************************************************
+*@function func (m *MemoryStore) Get(name string) (User, bool)
+*****************************************************
+*@brief 读取用户
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return User：用户详细信息
+*@return bool：用户是否存在
+*****************************************************/
+func (m *MemoryStore) Get(name string) (User, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	user, flag := m.shelf[name]
+	return user, flag
+}
+
+/****************************************************
+*@function func (m *MemoryStore) Update(name string, fn func(user *User)) bool
+*****************************************************
+*@brief 在锁内修改已存在的用户，fn中不能再访问存储
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param fn：修改函数
+*****************************************************
+*@return bool：用户是否存在
+*****************************************************/
+func (m *MemoryStore) Update(name string, fn func(user *User)) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	tempCell, flag := m.shelf[name]
+	if !flag {
+		return false
+	}
+	fn(&tempCell)
+	m.shelf[name] = tempCell
+	return true
+}
+
+/****************************************************
+*@function func (m *MemoryStore) Verify(name, token, addr string) bool
+*****************************************************
+*@brief 校验udp消息的用户名、会话令牌与来源地址，
+第一个通过令牌校验的消息确定该用户的来源地址
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：消息中的用户名
+*@param token：消息中的会话令牌
+*@param addr：消息的来源地址
+*****************************************************
+*@return bool：校验是否通过
+*****************************************************/
+func (m *MemoryStore) Verify(name, token, addr string) bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	tempCell, flag := m.shelf[name]
+	if !flag || tempCell.Token == "" {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(tempCell.Token)) != 1 {
+		return false
+	}
+	if tempCell.PublicAddr == "" {
+		tempCell.PublicAddr = addr
+		m.shelf[name] = tempCell
+		return true
+	}
+	return tempCell.PublicAddr == addr
+}
+
+/****************************************************
+*@function func (m *MemoryStore) Snapshot() map[string]User
+*****************************************************
+*@brief 输出全部在线用户的副本，调用方可以随意遍历
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return map[string]User：用户名->用户
+*****************************************************/
+func (m *MemoryStore) Snapshot() map[string]User {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	snapshot := make(map[string]User, len(m.shelf))
+	for name, user := range m.shelf {
+		snapshot[name] = user
+	}
+	return snapshot
+}
+
+/****************************************************
+*@brief 定义文件快照在线用户存储，在内存存储的基础上，
+用户增删改后把全部在线用户写入快照文件，服务器重启后
+从快照恢复，客户端继续心跳即可保持会话
+*****************************************************
+*@param MemoryStore：内存存储
+*@param path：快照文件路径
+*@param fileLock：快照文件写锁
+*@param logger：日志文件
+*****************************************************/
+type FileStore struct {
+	MemoryStore
+	path     string
+	fileLock sync.Mutex
+	logger   *log.Logger
+}
+
+/****************************************************
+*@function NewFileStore(path string, logger *log.Logger) (*FileStore, error)
+*****************************************************
+*@brief 新建一个文件快照在线用户存储，快照文件存在时
+从中恢复在线用户，心跳计数清零
+*****************************************************
+*@access Public
+*****************************************************
+*@param path：快照文件路径
+*@param logger：日志文件
+*****************************************************
+*@return *FileStore：文件快照存储
+*@return error：读取快照失败原因
+*****************************************************/
+func NewFileStore(path string, logger *log.Logger) (*FileStore, error) {
+	f := &FileStore{path: path, logger: logger}
+	f.shelf = make(map[string]User)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return f, nil
+	}
+	err = json.Unmarshal(data, &f.shelf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for name, user := range f.shelf {
+		user.BeatCount = 0
+		f.shelf[name] = user
+	}
+	return f, nil
+}
+
+/****************************************************
+*@function func (f *FileStore) save()
+*****************************************************
+*@brief 把全部在线用户写入临时文件后替换快照文件，
+避免写到一半时崩溃留下残缺的快照
+*****************************************************
+*@access Private
+*****************************************************
+*@param 无
+*****************************************************
+*@return 无
+*****************************************************/
+func (f *FileStore) save() {
+	f.fileLock.Lock()
+	defer f.fileLock.Unlock()
+	data, err := json.Marshal(f.Snapshot())
+	if err == nil {
+		err = os.WriteFile(f.path+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(f.path+".tmp", f.path)
+	}
+	if err != nil {
+		fmt.Println(err)
+		f.logger.Printf("FileStore:%v\n", err)
+	}
+}
+
+/****************************************************
+*@function func (f *FileStore) Add(name string, user User)
+*****************************************************
+*@brief 添加用户并写入快照
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param user:详细用户信息
+*****************************************************
+*@return 无
+*****************************************************/
+func (f *FileStore) Add(name string, user User) {
+	f.MemoryStore.Add(name, user)
+	f.save()
+}
+
+/****************************************************
+*@function func (f *FileStore) Change(name string, user User)
+*****************************************************
+*@brief 修改已存在的用户并写入快照
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param user:详细用户信息
+*****************************************************
+*@return 无
+*****************************************************/
+func (f *FileStore) Change(name string, user User) {
+	f.MemoryStore.Change(name, user)
+	f.save()
+}
+
+/****************************************************
+*@function func (f *FileStore) Delete(name string)
+*****************************************************
+*@brief 删除用户并写入快照
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return 无
+*****************************************************/
+func (f *FileStore) Delete(name string) {
+	f.MemoryStore.Delete(name)
+	f.save()
+}
+
+/****************************************************
+*@function func (f *FileStore) Update(name string, fn func(user *User)) bool
+*****************************************************
+*@brief 修改已存在的用户并写入快照，心跳与令牌校验
+只改动内存，不写快照
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param fn：修改函数
+*****************************************************
+*@return bool：用户是否存在
+*****************************************************/
+func (f *FileStore) Update(name string, fn func(user *User)) bool {
+	flag := f.MemoryStore.Update(name, fn)
+	if flag {
+		f.save()
+	}
+	return flag
+}
+
+/****************************************************
+*@brief 定义在线用户存储结构
+*****************************************************
+*@param users：在线用户存储后端，登录与消息监听共用
+*@param claimLock：登录占用用户名的锁
+*@param lock：群聊房间与会话邀请锁
+*@param rooms：群聊房间，房间名->成员用户名
+*@param invites：未处理的会话邀请，发起者/被邀请者->邀请
+*@param logger：在线用户日志
+*****************************************************/
+type Store struct {
+	users     UserStore
+	claimLock sync.Mutex
+	lock      sync.Mutex
+	rooms     map[string][]string
+	invites   map[string]Invite
+	logger    *log.Logger
+}
+
+/****************************************************
+*@function func (s *Store) Sort(outbox *Outbox, minBeats int) []string
+*****************************************************
+*@brief 对在线用户进行一次心跳检查，释放超时用户，由
+分发器的定时check命令触发
+*****************************************************
+*@access Public
+*****************************************************
+*@param outbox *Outbox:发件箱
+*@param minBeats int:每个周期内至少收到的心跳数，不足视为超时
+*****************************************************
+*@return []string：本次释放的超时用户
+*****************************************************/
+func (s *Store) Sort(outbox *Outbox, minBeats int) []string {
+	//遍历快照，检查期间其他协程仍可访问存储
+	shelf := s.GetMap()
+	s.logger.Printf("online users:%v", shelf)
+	released := make([]string, 0)
+	for tempName, tempUser := range shelf {
+		if tempName != "server" {
+			if tempUser.BeatCount < minBeats {
+				s.logger.Printf("user %v timeout\n", tempName)
+				if s.Release(tempName, outbox) {
+					released = append(released, tempName)
+				}
+			} else {
+				s.Update(tempName, func(user *User) {
+					user.BeatCount = 0
+				})
+			}
+		}
+	}
+	return released
+}
+
+/****************************************************
+*@function func (s *Store) Claim(name string, user User) bool
+*****************************************************
+*@brief 登录时占用用户名，用户名未被占用时加入在线
+用户组
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param user:详细用户信息
+*****************************************************
+*@return bool：是否占用成功
+*****************************************************/
+func (s *Store) Claim(name string, user User) bool {
+	s.claimLock.Lock()
+	defer s.claimLock.Unlock()
+	_, flag := s.users.Get(name)
+	if flag {
+		return false
+	}
+	s.users.Add(name, user)
+	return true
+}
+
+/****************************************************
+*@function func (s *Store) Release(name string, outbox *Outbox) bool
+*****************************************************
+*@brief 用户下线，释放用户名。通知会话对方结束会话，
+取消有关的会话邀请，退出所有房间并通知房间内其他成员。
+超时、注销与踢出都经过这里
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param outbox：发件箱
+*****************************************************
+*@return bool：用户是否在线
+*****************************************************/
+func (s *Store) Release(name string, outbox *Outbox) bool {
+	tempUser, flag := s.users.Get(name)
+	if !flag || name == "server" {
+		return false
+	}
+	s.Delete(name)
+	//结束该用户的所有两人会话，quit的Data为离开的用户
+	for _, peer := range tempUser.Peers {
+		if !s.Disconnect(peer, name) {
+			continue
+		}
+		mess := Message{
+			Cmd:      "quit",
+			Sender:   "server",
+			Data:     name,
+			Receiver: peer,
+		}
+		err := outbox.SendReliable(s.GetUser(peer), mess, nil)
+		if err != nil {
+			fmt.Println(err)
+			s.logger.Printf("release:%v\n", err)
+		}
+	}
+	//取消与该用户有关的会话邀请，并告知对方
+	for _, invite := range s.DropInvites(name) {
+		other, text := invite.From, fmt.Sprintf("the user <%s> is not online", invite.To)
+		if invite.From == name {
+			other, text = invite.To, fmt.Sprintf("the invitation from <%s> is cancelled", invite.From)
+		}
+		err := outbox.Send(s.GetUser(other), Message{
+			Cmd:      "invite",
+			Sender:   "server",
+			Data:     text,
+			Receiver: other,
+			Payload:  NewPayload(Payload{Error: &ErrorInfo{Code: CodeNotOnline, Text: text}}),
+		})
+		if err != nil {
+			fmt.Println(err)
+			s.logger.Printf("release:%v\n", err)
+		}
+	}
+	//退出所有房间，并通知房间内其他成员
+	for _, room := range s.LeaveAllRooms(name) {
+		for _, member := range s.RoomMembers(room) {
+			mess := Message{
+				Cmd:      "leave",
+				Sender:   name,
+				Data:     room,
+				Receiver: member,
+			}
+			err := outbox.Send(s.GetUser(member), mess)
+			if err != nil {
+				fmt.Println(err)
+				s.logger.Printf("release:%v\n", err)
+			}
+		}
+	}
+	return true
+}
+
+/****************************************************
+*@function func (s *Store) Add(name string, user User)
+*****************************************************
+*@brief 添加到在线用户组
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param user:详细用户信息
+*****************************************************
+*@return 无
+*****************************************************/
+func (s *Store) Add(name string, user User) {
+	s.users.Add(name, user)
+}
+
+/****************************************************
+*@function func (s *Store) Change(name string, user User)
+*****************************************************
+*@brief 修改在线用户组中的某个用户
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param user:详细用户信息
+*****************************************************
+*@return 无
+*****************************************************/
+func (s *Store) Change(name string, user User) {
+	s.users.Change(name, user)
+}
+
+/****************************************************
+*@function func (s *Store) Update(name string, fn func(user *User)) bool
+*****************************************************
+*@brief 原子地修改在线用户组中的某个用户
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param fn：修改函数
+*****************************************************
+*@return bool：用户是否在线
+*****************************************************/
+func (s *Store) Update(name string, fn func(user *User)) bool {
+	return s.users.Update(name, fn)
+}
+
+/****************************************************
+*@function func (s *Store) Delete(name string, user User)
+*****************************************************
+*@brief 删除在线用户组中的某个用户
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return 无
+*****************************************************/
+func (s *Store) Delete(name string) {
+	s.users.Delete(name)
+}
+
+/****************************************************
+*@function func (s *Store) Beat(name string, publicAddr string)
+*****************************************************
+*@brief 在线用户组中的某个用户接收心跳，同时记录心跳
+的来源地址，即客户端的公网udp地址
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param publicAddr：心跳来源地址
+*****************************************************
+*@return 无
+*****************************************************/
+func (s *Store) Beat(name string, publicAddr string) {
+	s.users.Beat(name, publicAddr)
+}
+
+/****************************************************
+*@function func (s *Store) Verify(name, token, addr string) bool
+*****************************************************
+*@brief 校验udp消息的用户名、会话令牌与来源地址，
+第一个通过令牌校验的消息确定该用户的来源地址
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：消息中的用户名
+*@param token：消息中的会话令牌
+*@param addr：消息的来源地址
+*****************************************************
+*@return bool：校验是否通过
+*****************************************************/
+func (s *Store) Verify(name, token, addr string) bool {
+	return s.users.Verify(name, token, addr)
+}
+
+/****************************************************
+*@function NewToken() (string, error)
+*****************************************************
+*@brief 生成随机会话令牌
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return string：十六进制令牌
+*@return error：随机数生成失败原因
+*****************************************************/
+func NewToken() (string, error) {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+/****************************************************
+*@function func (s *Store) GetUser(name string) User
+*****************************************************
+*@brief 输出在线用户组中的某个用户
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return User：用户详细信息，不在线时为空
+*****************************************************/
+func (s *Store) GetUser(name string) User {
+	user, _ := s.users.Get(name)
+	return user
+}
+
+/****************************************************
+*@function func (s *Store) GetMap()
+*****************************************************
+*@brief 输出在线用户组的副本
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：无
+*****************************************************
+*@return User：在线用户组
+*****************************************************/
+func (s *Store) GetMap() map[string]User {
+	return s.users.Snapshot()
+}
+
+/****************************************************
+*@function func (s *Store) JoinRoom(room, name string) bool
+*****************************************************
+*@brief 用户加入群聊房间，房间不存在时新建
+*****************************************************
+*@access Public
+*****************************************************
+*@param room：房间名
+*@param name：用户名
+*****************************************************
+*@return bool：是否为新加入的成员
+*****************************************************/
+func (s *Store) JoinRoom(room, name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, member := range s.rooms[room] {
+		if member == name {
+			return false
+		}
+	}
+	s.rooms[room] = append(s.rooms[room], name)
+	return true
+}
+
+/****************************************************
+*@function func (s *Store) LeaveRoom(room, name string) bool
+*****************************************************
+*@brief 用户离开群聊房间，房间无人时删除房间
+*****************************************************
+*@access Public
+*****************************************************
+*@param room：房间名
+*@param name：用户名
+*****************************************************
+*@return bool：用户是否在该房间中
+*****************************************************/
+func (s *Store) LeaveRoom(room, name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.leaveRoom(room, name)
+}
+
+/****************************************************
+*@function func (s *Store) leaveRoom(room, name string) bool
+*****************************************************
+*@brief 用户离开群聊房间，调用方需持有房间锁
+*****************************************************
+*@access Private
+*****************************************************
+*@param room：房间名
+*@param name：用户名
+*****************************************************
+*@return bool：用户是否在该房间中
+*****************************************************/
+func (s *Store) leaveRoom(room, name string) bool {
+	members := s.rooms[room]
+	for i, member := range members {
+		if member == name {
+			left := make([]string, 0, len(members)-1)
+			left = append(left, members[:i]...)
+			left = append(left, members[i+1:]...)
+			if len(left) == 0 {
+				delete(s.rooms, room)
+			} else {
+				s.rooms[room] = left
+			}
+			return true
+		}
+	}
+	return false
+}
+
+/****************************************************
+*@function func (s *Store) LeaveAllRooms(name string) []string
+*****************************************************
+*@brief 用户离开所有群聊房间，用于下线清理
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return []string：用户离开的房间名
+*****************************************************/
+func (s *Store) LeaveAllRooms(name string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	left := make([]string, 0)
+	for room := range s.rooms {
+		if s.leaveRoom(room, name) {
+			left = append(left, room)
+		}
+	}
+	return left
+}
+
+/****************************************************
+*@function func (s *Store) RoomMembers(room string) []string
+*****************************************************
+*@brief 输出群聊房间成员的副本
+*****************************************************
+*@access Public
+*****************************************************
+*@param room：房间名
+*****************************************************
+*@return []string：成员用户名，房间不存在时为空
+*****************************************************/
+func (s *Store) RoomMembers(room string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.rooms[room]...)
+}
+
+/****************************************************
+*@function func (s *Store) GetRooms() map[string][]string
+*****************************************************
+*@brief 输出所有群聊房间的副本
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return map[string][]string：房间名->成员用户名
+*****************************************************/
+func (s *Store) GetRooms() map[string][]string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rooms := make(map[string][]string, len(s.rooms))
+	for room, members := range s.rooms {
+		rooms[room] = append([]string(nil), members...)
+	}
+	return rooms
+}
+
+/****************************************************
+*@function func (s *Store) Connect(a, b string)
+*****************************************************
+*@brief 建立a与b的两人会话，双方互相记入Peers
+*****************************************************
+*@access Public
+*****************************************************
+*@param a、b：会话双方的用户名
+*****************************************************
+*@return 无
+*****************************************************/
+func (s *Store) Connect(a, b string) {
+	add := func(name, peer string) {
+		s.Update(name, func(user *User) {
+			//Peers可能与其他副本共用底层数组，修改时复制
+			if !user.TalkingWith(peer) {
+				user.Peers = append(append([]string(nil), user.Peers...), peer)
+			}
+		})
+	}
+	add(a, b)
+	add(b, a)
+}
+
+/****************************************************
+*@function func (s *Store) Disconnect(a, b string) bool
+*****************************************************
+*@brief 结束a与b的两人会话，双方互相从Peers中删除
+*****************************************************
+*@access Public
+*****************************************************
+*@param a、b：会话双方的用户名
+*****************************************************
+*@return bool：a是否正在与b会话
+*****************************************************/
+func (s *Store) Disconnect(a, b string) bool {
+	talking := s.GetUser(a).TalkingWith(b)
+	remove := func(name, peer string) {
+		s.Update(name, func(user *User) {
+			peers := make([]string, 0, len(user.Peers))
+			for _, temp := range user.Peers {
+				if temp != peer {
+					peers = append(peers, temp)
+				}
+			}
+			user.Peers = peers
+		})
+	}
+	remove(a, b)
+	remove(b, a)
+	return talking
+}
+
+/****************************************************
+*@brief 定义会话邀请
+*****************************************************
+*@param From：发起者
+*@param To：被邀请者
+*@param Expires：过期时间
+*****************************************************/
+type Invite struct {
+	From    string
+	To      string
+	Expires time.Time
+}
+
+/****************************************************
+*@function func (s *Store) Invite(from, to string, expires time.Time) bool
+*****************************************************
+*@brief 记录一个会话邀请
+*****************************************************
+*@access Public
+*****************************************************
+*@param from：发起者
+*@param to：被邀请者
+*@param expires：过期时间
+*****************************************************
+*@return bool：是否新邀请，已经邀请过时返回false
+*****************************************************/
+func (s *Store) Invite(from, to string, expires time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	key := from + "/" + to
+	if _, flag := s.invites[key]; flag {
+		return false
+	}
+	s.invites[key] = Invite{From: from, To: to, Expires: expires}
+	return true
+}
+
+/****************************************************
+*@function func (s *Store) TakeInvite(to, from string) (Invite, bool)
+*****************************************************
+*@brief 取出并删除发给to的邀请，from为空时取最早的一个
+*****************************************************
+*@access Public
+*****************************************************
+*@param to：被邀请者
+*@param from：发起者，可以为空
+*****************************************************
+*@return Invite：邀请
+*@return bool：是否有邀请
+*****************************************************/
+func (s *Store) TakeInvite(to, from string) (Invite, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var found Invite
+	flag := false
+	for _, invite := range s.invites {
+		if invite.To != to || (from != "" && invite.From != from) {
+			continue
+		}
+		if !flag || invite.Expires.Before(found.Expires) {
+			found = invite
+			flag = true
+		}
+	}
+	if flag {
+		delete(s.invites, found.From+"/"+found.To)
+	}
+	return found, flag
+}
+
+/****************************************************
+*@function func (s *Store) ExpireInvites(now time.Time) []Invite
+*****************************************************
+*@brief 删除并返回已过期的邀请
+*****************************************************
+*@access Public
+*****************************************************
+*@param now：当前时间
+*****************************************************
+*@return []Invite：已过期的邀请
+*****************************************************/
+func (s *Store) ExpireInvites(now time.Time) []Invite {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	expired := make([]Invite, 0)
+	for key, invite := range s.invites {
+		if now.After(invite.Expires) {
+			expired = append(expired, invite)
+			delete(s.invites, key)
+		}
+	}
+	return expired
+}
+
+/****************************************************
+*@function func (s *Store) DropInvites(name string) []Invite
+*****************************************************
+*@brief 删除并返回与用户有关的全部邀请，用户下线或
+无法送达时调用
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return []Invite：被删除的邀请
+*****************************************************/
+func (s *Store) DropInvites(name string) []Invite {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	dropped := make([]Invite, 0)
+	for key, invite := range s.invites {
+		if invite.From == name || invite.To == name {
+			dropped = append(dropped, invite)
+			delete(s.invites, key)
+		}
+	}
+	return dropped
+}
+
+/****************************************************
+*@brief 定义udp数据报端口，*net.UDPConn实现该接口，
+测试中替换为模拟NAT后面的端口
+*****************************************************/
+type PacketConn interface {
+	ReadFromUDP(b []byte) (int, *net.UDPAddr, error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+/****************************************************
+*@brief 定义发件队列已满的错误
+*****************************************************/
+var ErrOutboxFull = errors.New("outbox: the queue of the receiver is full")
+
+/****************************************************
+*@brief 定义服务器发件箱，所有发往客户端的消息都经过
+监听端口用WriteToUDP发出，不再为每条消息新建socket。
+每个接收地址有自己的发送队列与发送协程，队列满时立即
+放弃并返回ErrOutboxFull，不阻塞分发器，空闲超过idle的
+发送协程自动退出。一条消息的全部分片作为一项入队，
+不会只发出部分分片
+*****************************************************
+*@param conn：udp消息监听端口
+*@param size：每个接收地址的队列长度，按消息计
+*@param idle：发送协程的最长空闲时间
+*@param lock：队列锁
+*@param queues：接收地址->发送队列
+*@param acks：服务器发出的需要确认的消息
+*@param logger：日志文件
+*****************************************************/
+type Outbox struct {
+	conn   PacketConn
+	size   int
+	idle   time.Duration
+	lock   sync.Mutex
+	queues map[string]chan [][]byte
+	acks   *Reliable
+	logger *log.Logger
+}
+
+/****************************************************
+*@function NewOutbox(conn PacketConn, size int, acks *Reliable, logger *log.Logger) *Outbox
+*****************************************************
+*@brief 新建服务器发件箱
+*****************************************************
+*@access Public
+*****************************************************
+*@param conn：udp消息监听端口
+*@param size：每个接收地址的队列长度
+*@param acks：可靠投递，用于SendReliable
+*@param logger：日志文件
+*****************************************************
+*@return *Outbox：发件箱
+*****************************************************/
+func NewOutbox(conn PacketConn, size int, acks *Reliable, logger *log.Logger) *Outbox {
+	return &Outbox{
+		conn:   conn,
+		size:   size,
+		idle:   time.Minute,
+		queues: make(map[string]chan [][]byte),
+		acks:   acks,
+		logger: logger,
+	}
+}
+
+/****************************************************
+*@function func (o *Outbox) Send(user User, mess Message) error
+*****************************************************
+*@brief 按用户协商的编解码编码消息，必要时分片，全部
+分片作为一项放入用户udp地址的发送队列。队列满时立即
+返回ErrOutboxFull，整条消息都不发送，由调用方丢弃或
+报告失败，慢速接收方不会阻塞分发器
+*****************************************************
+*@access Public
+*****************************************************
+*@param user：接收用户
+*@param mess：待发送消息
+*****************************************************
+*@return error：编码失败、地址错误或队列已满
+*****************************************************/
+func (o *Outbox) Send(user User, mess Message) error {
+	frames, err := EncodeFrames(CodecByName(user.Codec), mess)
+	if err != nil {
+		return err
+	}
+	return o.enqueue(user.Endpoint(), frames)
+}
+
+/****************************************************
+*@function func (o *Outbox) enqueue(addr string, frames [][]byte) error
+*****************************************************
+*@brief 把一条消息的全部数据报放入接收地址的发送队列，
+队列满时不等待
+*****************************************************
+*@access Private
+*****************************************************
+*@param addr：接收地址
+*@param frames：一条消息的全部数据报
+*****************************************************
+*@return error：地址错误或队列已满
+*****************************************************/
+func (o *Outbox) enqueue(addr string, frames [][]byte) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	queue, flag := o.queues[addr]
+	if !flag {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return err
+		}
+		queue = make(chan [][]byte, o.size)
+		o.queues[addr] = queue
+		go o.deliver(addr, udpAddr, queue)
+	}
+	//入队在锁内完成，发送协程退出前同样持锁检查队列
+	select {
+	case queue <- frames:
+		return nil
+	default:
+		return ErrOutboxFull
+	}
+}
+
+/****************************************************
+*@function func (o *Outbox) SendReliable(user User, mess Message, fail func(Message)) error
+*****************************************************
+*@brief 发送需要确认的消息，用户未确认时按指数退避
+重传
+*****************************************************
+*@access Public
+*****************************************************
+*@param user：接收用户
+*@param mess：待发送消息
+*@param fail：重传用尽时的回调，为nil时只记录日志
+*****************************************************
+*@return error：第一次发送失败的原因
+*****************************************************/
+func (o *Outbox) SendReliable(user User, mess Message, fail func(Message)) error {
+	if fail == nil {
+		fail = func(mess Message) {
+			o.logger.Printf("outbox: %v not delivered to %v\n", mess.Cmd, mess.Receiver)
+		}
+	}
+	return o.acks.Send(mess, func(mess Message) error {
+		return o.Send(user, mess)
+	}, fail)
+}
+
+/****************************************************
+*@function func (o *Outbox) deliver(key string, addr *net.UDPAddr, queue chan [][]byte)
+*****************************************************
+*@brief 发送协程，按顺序把队列中的消息从监听端口发出，
+空闲超过idle且队列为空时退出
+*****************************************************
+*@access Private
+*****************************************************
+*@param key：接收地址字符串
+*@param addr：接收地址
+*@param queue：发送队列
+*****************************************************
+*@return 无
+*****************************************************/
+func (o *Outbox) deliver(key string, addr *net.UDPAddr, queue chan [][]byte) {
+	idle := time.NewTimer(o.idle)
+	defer idle.Stop()
+	for {
+		select {
+		case frames := <-queue:
+			for _, data := range frames {
+				_, err := o.conn.WriteToUDP(data, addr)
+				if err != nil {
+					fmt.Println(err)
+					o.logger.Printf("outbox:%v\n", err)
+				}
+			}
+			idle.Reset(o.idle)
+		case <-idle.C:
+			o.lock.Lock()
+			if len(queue) == 0 {
+				delete(o.queues, key)
+				o.lock.Unlock()
+				return
+			}
+			o.lock.Unlock()
+			idle.Reset(o.idle)
+		}
+	}
+}
+
+/****************************************************
+*@brief 可靠投递的重传上限，保证逐次加倍的等待时间与
+重复消息的保留时间不会溢出
+*****************************************************/
+const (
+	MaxRetries = 16
+	MaxAckWait = time.Minute
+)
+
+/****************************************************
+*@brief 定义可靠投递：需要确认的消息带上消息ID，对方
+收到后回复ack，超时未确认时按指数退避重传，重传用尽后
+回调fail。接收方按发送者+消息ID记录已收到的消息，
+重传造成的重复消息只回复ack不再处理
+*****************************************************
+*@param lock：锁
+*@param prefix：消息ID前缀，每次启动随机生成，避免重启后ID重复
+*@param next：消息ID计数
+*@param retries：最多重传次数
+*@param wait：第一次重传前的等待时间，之后每次加倍
+*@param pending：未确认的消息ID->确认通知
+*@param seen：已收到的发送者/消息ID->收到时间
+*@param window：已收到的消息ID保留时间
+*@param pruned：上次清理seen的时间
+*****************************************************/
+type Reliable struct {
+	lock    sync.Mutex
+	prefix  string
+	next    uint64
+	retries int
+	wait    time.Duration
+	pending map[string]chan struct{}
+	seen    map[string]time.Time
+	window  time.Duration
+	pruned  time.Time
+}
+
+/****************************************************
+*@function NewReliable(retries int, wait time.Duration) *Reliable
+*****************************************************
+*@brief 新建可靠投递
+*****************************************************
+*@access Public
+*****************************************************
+*@param retries：最多重传次数
+*@param wait：第一次重传前的等待时间
+*****************************************************
+*@return *Reliable：可靠投递
+*****************************************************/
+func NewReliable(retries int, wait time.Duration) *Reliable {
+	prefix := make([]byte, 4)
+	rand.Read(prefix)
+	return &Reliable{
+		prefix:  hex.EncodeToString(prefix),
+		retries: retries,
+		wait:    wait,
+		pending: make(map[string]chan struct{}),
+		seen:    make(map[string]time.Time),
+		//重传全部结束之前收到的重复消息都需要识别
+		window: wait<<uint(retries+1) + time.Minute,
+		pruned: time.Now(),
+	}
+}
+
+/****************************************************
+*@function func (r *Reliable) Send(mess Message, send func(Message) error, fail func(Message)) error
+*****************************************************
+*@brief 给消息分配ID后发送，在后台等待确认，超时按
+指数退避重传，重传用尽仍未确认时调用fail
+*****************************************************
+*@access Public
+*****************************************************
+*@param mess：待发送消息
+*@param send：发送一次消息的函数
+*@param fail：投递失败时的回调，可以为nil
+*****************************************************
+*@return error：第一次发送失败的原因，此时不再重传
+*****************************************************/
+func (r *Reliable) Send(mess Message, send func(Message) error, fail func(Message)) error {
+	return r.SendAcked(mess, send, nil, fail)
+}
+
+/****************************************************
+*@function func (r *Reliable) SendAcked(mess Message, send func(Message) error, ok func(Message), fail func(Message)) error
+*****************************************************
+*@brief 与Send相同，收到确认时调用ok，用于确认之后
+才能清理的消息
+*****************************************************
+*@access Public
+*****************************************************
+*@param mess：待发送消息
+*@param send：发送一次消息的函数
+*@param ok：收到确认时的回调，可以为nil
+*@param fail：投递失败时的回调，可以为nil
+*****************************************************
+*@return error：第一次发送失败的原因，此时不再重传
+*****************************************************/
+func (r *Reliable) SendAcked(mess Message, send func(Message) error, ok func(Message), fail func(Message)) error {
+	acked := make(chan struct{})
+	r.lock.Lock()
+	r.next++
+	mess.ID = fmt.Sprintf("%s-%d", r.prefix, r.next)
+	r.pending[mess.ID] = acked
+	r.lock.Unlock()
+	err := send(mess)
+	if err != nil {
+		r.Ack(mess.ID)
+		return err
+	}
+	go func() {
+		wait := r.wait
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		for i := 0; ; i++ {
+			select {
+			case <-acked:
+				if ok != nil {
+					ok(mess)
+				}
+				return
+			case <-timer.C:
+			}
+			if i == r.retries {
+				break
+			}
+			//重传失败与丢包同样处理，等待下一次重传
+			send(mess)
+			wait *= 2
+			timer.Reset(wait)
+		}
+		r.Ack(mess.ID)
+		if fail != nil {
+			fail(mess)
+		}
+	}()
+	return nil
+}
+
+/****************************************************
+*@function func (r *Reliable) Ack(id string)
+*****************************************************
+*@brief 收到对方的确认，停止重传
+*****************************************************
+*@access Public
+*****************************************************
+*@param id：消息ID
+*****************************************************
+*@return 无
+*****************************************************/
+func (r *Reliable) Ack(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	acked, flag := r.pending[id]
+	if flag {
+		close(acked)
+		delete(r.pending, id)
+	}
+}
+
+/****************************************************
+*@function func (r *Reliable) Duplicate(sender string, id string) bool
+*****************************************************
+*@brief 记录收到的消息，判断是否为重传造成的重复消息
+*****************************************************
+*@access Public
+*****************************************************
+*@param sender：发送者
+*@param id：消息ID
+*****************************************************
+*@return bool：是否已经收到过
+*****************************************************/
+func (r *Reliable) Duplicate(sender string, id string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	now := time.Now()
+	if now.Sub(r.pruned) > r.window {
+		for key, seen := range r.seen {
+			if now.Sub(seen) > r.window {
+				delete(r.seen, key)
+			}
+		}
+		r.pruned = now
+	}
+	key := sender + "/" + id
+	if _, flag := r.seen[key]; flag {
+		return true
+	}
+	r.seen[key] = now
+	return false
+}
+
+/****************************************************
+*@function NewStore(config *Config) (*Store, error)
+*****************************************************
+*@brief 新建一个在线用户组，配置了StoreFile时使用文件
+快照存储，否则使用内存存储
+*****************************************************
+*@access Public
+*****************************************************
+*@param config：服务器配置，包括在线用户日志、快照文件与心跳检查参数
+*****************************************************
+*@return *Store：在线用户组
+*@return error：读取快照失败原因
+*****************************************************/
+func NewStore(config *Config) (*Store, error) {
+	logger := OpenLog(config.OnlineLog)
+	temp := new(Store)
+	temp.logger = logger
+	if config.StoreFile == "" {
+		temp.users = NewMemoryStore()
+	} else {
+		users, err := NewFileStore(config.StoreFile, logger)
+		if err != nil {
+			return nil, err
+		}
+		temp.users = users
+	}
+	temp.rooms = make(map[string][]string)
+	temp.invites = make(map[string]Invite)
+	return temp, nil
+}
+
+/****************************************************
+*@brief 定义注册账号
+*****************************************************
+*@param Name：用户名
+*@param Salt：随机盐，十六进制
+*@param Hash：加盐后的密码摘要，十六进制
+*****************************************************/
+type Account struct {
+	Name string
+	Salt string
+	Hash string
+}
+
+/****************************************************
+*@brief 定义注册账号仓库，账号按行以json格式保存在文件中
+*****************************************************
+*@param path：账号文件路径
+*@param lock：账号读写锁，登录服务并发访问
+*@param accounts：用户名->账号
+*****************************************************/
+type Accounts struct {
+	path     string
+	lock     sync.Mutex
+	accounts map[string]Account
+}
+
+/****************************************************
+*@function NewAccounts(path string) (*Accounts, error)
+*****************************************************
+*@brief 新建注册账号仓库，读取已有的账号文件
+*****************************************************
+*@access Public
+*****************************************************
+*@param path：账号文件路径，文件不存在时视为空仓库
+*****************************************************
+*@return *Accounts：账号仓库
+*@return error：账号文件读取失败原因
+*****************************************************/
+func NewAccounts(path string) (*Accounts, error) {
+	temp := &Accounts{
+		path:     path,
+		accounts: make(map[string]Account),
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return temp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var account Account
+		err = json.Unmarshal(scanner.Bytes(), &account)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		temp.accounts[account.Name] = account
+	}
+	return temp, scanner.Err()
+}
+
+/****************************************************
+*@function HashPassword(password, salt string) string
+*****************************************************
+*@brief 计算加盐密码摘要
+*****************************************************
+*@access Public
+*****************************************************
+*@param password：密码
+*@param salt：随机盐，十六进制
+*****************************************************
+*@return string：密码摘要，十六进制
+*****************************************************/
+func HashPassword(password, salt string) string {
+	key, err := pbkdf2.Key(sha256.New, password, []byte(salt), 100000, 32)
+	if err != nil {
+		return ""
+	}
+	return hex.EncodeToString(key)
+}
+
+/****************************************************
+*@function func (a *Accounts) Exists(name string) bool
+*****************************************************
+*@brief 判断用户名是否已注册
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return bool：是否已注册
+*****************************************************/
+func (a *Accounts) Exists(name string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	_, flag := a.accounts[name]
+	return flag
+}
+
+/****************************************************
+*@function func (a *Accounts) Register(name, password string) error
+*****************************************************
+*@brief 注册新账号，生成随机盐并追加写入账号文件
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param password：密码
+*****************************************************
+*@return error：注册失败原因
+*****************************************************/
+func (a *Accounts) Register(name, password string) error {
+	if password == "" {
+		return errors.New("the password can not be empty")
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if _, flag := a.accounts[name]; flag {
+		return errors.New("the name has already been registered")
+	}
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	account := Account{
+		Name: name,
+		Salt: hex.EncodeToString(salt),
+	}
+	account.Hash = HashPassword(password, account.Salt)
+	data, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	a.accounts[name] = account
+	return nil
+}
+
+/****************************************************
+*@function func (a *Accounts) Verify(name, password string) bool
+*****************************************************
+*@brief 校验账号密码
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param password：密码
+*****************************************************
+*@return bool：密码是否正确
+*****************************************************/
+func (a *Accounts) Verify(name, password string) bool {
+	a.lock.Lock()
+	account, flag := a.accounts[name]
+	a.lock.Unlock()
+	if !flag {
+		return false
+	}
+	hash := HashPassword(password, account.Salt)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(account.Hash)) == 1
+}
+
+/****************************************************
+*@brief 定义离线留言
+*****************************************************
+*@param ID：留言编号，收件人确认后按编号删除
+*@param Sender：留言者
+*@param Data：留言内容
+*@param Time：留言时间
+*****************************************************/
+type Mail struct {
+	ID     string `json:",omitempty"`
+	Sender string
+	Data   string
+	Time   time.Time
+}
+
+/****************************************************
+*@brief 定义离线留言箱，每个用户的留言按行以json格式
+保存在dir下的单独文件中
+*****************************************************
+*@param dir：留言目录
+*@param quota：每个用户最多保存的留言数
+*@param lock：登录服务与消息监听并发访问锁
+*****************************************************/
+type Mailbox struct {
+	dir   string
+	quota int
+	lock  sync.Mutex
+}
+
+/****************************************************
+*@function NewMailbox(dir string, quota int) (*Mailbox, error)
+*****************************************************
+*@brief 新建离线留言箱，目录不存在时创建
+*****************************************************
+*@access Public
+*****************************************************
+*@param dir：留言目录
+*@param quota：每个用户最多保存的留言数
+*****************************************************
+*@return *Mailbox：离线留言箱
+*@return error：目录创建失败原因
+*****************************************************/
+func NewMailbox(dir string, quota int) (*Mailbox, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &Mailbox{dir: dir, quota: quota}, nil
+}
+
+/****************************************************
+*@function func (m *Mailbox) path(name string) string
+*****************************************************
+*@brief 输出用户留言文件路径，用户名编码后作为文件名
+*****************************************************
+*@access Private
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return string：留言文件路径
+*****************************************************/
+func (m *Mailbox) path(name string) string {
+	return filepath.Join(m.dir, hex.EncodeToString([]byte(name))+".txt")
+}
+
+/****************************************************
+*@function func (m *Mailbox) read(name string) ([]Mail, error)
+*****************************************************
+*@brief 读取用户的全部留言，调用者需持有锁
+*****************************************************
+*@access Private
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return []Mail：按留言顺序排列的留言
+*@return error：读取失败原因
+*****************************************************/
+func (m *Mailbox) read(name string) ([]Mail, error) {
+	mails := make([]Mail, 0)
+	file, err := os.Open(m.path(name))
+	if os.IsNotExist(err) {
+		return mails, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 65536), 1<<20)
+	for scanner.Scan() {
+		var mail Mail
+		err = json.Unmarshal(scanner.Bytes(), &mail)
+		if err != nil {
+			return nil, err
+		}
+		//旧版本保存的留言没有编号，以留言时间作为编号
+		if mail.ID == "" {
+			mail.ID = fmt.Sprintf("%d", mail.Time.UnixNano())
+		}
+		mails = append(mails, mail)
+	}
+	return mails, scanner.Err()
+}
+
+/****************************************************
+*@function func (m *Mailbox) Put(name string, mail Mail) error
+*****************************************************
+*@brief 保存一条给name的留言，超过配额时拒绝
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：收件人用户名
+*@param mail：留言
+*****************************************************
+*@return error：配额已满或保存失败原因
+*****************************************************/
+func (m *Mailbox) Put(name string, mail Mail) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	mails, err := m.read(name)
+	if err != nil {
+		return err
+	}
+	if len(mails) >= m.quota {
+		return fmt.Errorf("the mailbox of <%s> is full", name)
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	mail.ID = hex.EncodeToString(id)
+	data, err := json.Marshal(mail)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(m.path(name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+/****************************************************
+*@function func (m *Mailbox) Peek(name string) ([]Mail, error)
+*****************************************************
+*@brief 读取name的全部留言，不删除，留言在收件人确认
+后由Remove删除
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return []Mail：按留言顺序排列的留言
+*@return error：读取失败原因
+*****************************************************/
+func (m *Mailbox) Peek(name string) ([]Mail, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.read(name)
+}
+
+/****************************************************
+*@function func (m *Mailbox) Remove(name string, id string) error
+*****************************************************
+*@brief 删除收件人已确认的一条留言，留言箱为空时删除
+留言文件
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param id：留言编号
+*****************************************************
+*@return error：读取或保存失败原因
+*****************************************************/
+func (m *Mailbox) Remove(name string, id string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	mails, err := m.read(name)
+	if err != nil {
+		return err
+	}
+	rest := make([]byte, 0)
+	found := false
+	for _, mail := range mails {
+		if mail.ID == id && !found {
+			found = true
+			continue
+		}
+		data, err := json.Marshal(mail)
+		if err != nil {
+			return err
+		}
+		rest = append(append(rest, data...), '\n')
+	}
+	if !found {
+		return nil
+	}
+	if len(rest) == 0 {
+		return os.Remove(m.path(name))
+	}
+	//先写临时文件再替换，中途失败不会丢失其他留言
+	temp := m.path(name) + ".tmp"
+	err = os.WriteFile(temp, rest, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp, m.path(name))
+}
+
+/****************************************************
+*@brief 定义联系人仓库，每个用户关注的联系人以json数组
+保存在dir下的单独文件中，启动时全部读入内存
+*****************************************************
+*@param dir：联系人目录
+*@param lock：并发访问锁
+*@param lists：用户名->关注的联系人
+*****************************************************/
+type Contacts struct {
+	dir   string
+	lock  sync.Mutex
+	lists map[string][]string
+}
+
+/****************************************************
+*@function NewContacts(dir string) (*Contacts, error)
+*****************************************************
+*@brief 新建联系人仓库，目录不存在时创建，读取已有的
+联系人文件
+*****************************************************
+*@access Public
+*****************************************************
+*@param dir：联系人目录
+*****************************************************
+*@return *Contacts：联系人仓库
+*@return error：目录创建或者读取失败原因
+*****************************************************/
+func NewContacts(dir string) (*Contacts, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	temp := &Contacts{
+		dir:   dir,
+		lists: make(map[string][]string),
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name, err := hex.DecodeString(strings.TrimSuffix(entry.Name(), ".json"))
+		if err != nil || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var list []string
+		err = json.Unmarshal(data, &list)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", entry.Name(), err)
+		}
+		temp.lists[string(name)] = list
+	}
+	return temp, nil
+}
+
+/****************************************************
+*@function func (c *Contacts) path(name string) string
+*****************************************************
+*@brief 输出用户联系人文件路径，用户名编码后作为文件名
+*****************************************************
+*@access Private
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return string：联系人文件路径
+*****************************************************/
+func (c *Contacts) path(name string) string {
+	return filepath.Join(c.dir, hex.EncodeToString([]byte(name))+".json")
+}
+
+/****************************************************
+*@function func (c *Contacts) save(name string) error
+*****************************************************
+*@brief 保存用户的联系人，没有联系人时删除文件，调用者
+需持有锁
+*****************************************************
+*@access Private
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return error：保存失败原因
+*****************************************************/
+func (c *Contacts) save(name string) error {
+	list := c.lists[name]
+	if len(list) == 0 {
+		delete(c.lists, name)
+		err := os.Remove(c.path(name))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	data, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path(name), data, 0600)
+}
+
+/****************************************************
+*@function func (c *Contacts) Watch(name, contact string) (bool, error)
+*****************************************************
+*@brief name关注contact
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param contact：被关注的用户名
+*****************************************************
+*@return bool：是否为新关注
+*@return error：保存失败原因
+*****************************************************/
+func (c *Contacts) Watch(name, contact string) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, temp := range c.lists[name] {
+		if temp == contact {
+			return false, nil
+		}
+	}
+	c.lists[name] = append(c.lists[name], contact)
+	sort.Strings(c.lists[name])
+	return true, c.save(name)
+}
+
+/****************************************************
+*@function func (c *Contacts) Unwatch(name, contact string) (bool, error)
+*****************************************************
+*@brief name取消关注contact
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param contact：被关注的用户名
+*****************************************************
+*@return bool：之前是否关注
+*@return error：保存失败原因
+*****************************************************/
+func (c *Contacts) Unwatch(name, contact string) (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	list := make([]string, 0, len(c.lists[name]))
+	for _, temp := range c.lists[name] {
+		if temp != contact {
+			list = append(list, temp)
+		}
+	}
+	if len(list) == len(c.lists[name]) {
+		return false, nil
+	}
+	c.lists[name] = list
+	return true, c.save(name)
+}
+
+/****************************************************
+*@function func (c *Contacts) List(name string) []string
+*****************************************************
+*@brief 输出name关注的联系人
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return []string：按用户名排序的联系人
+*****************************************************/
+func (c *Contacts) List(name string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]string(nil), c.lists[name]...)
+}
+
+/****************************************************
+*@function func (c *Contacts) Watchers(contact string) []string
+*****************************************************
+*@brief 输出关注contact的全部用户
+*****************************************************
+*@access Public
+*****************************************************
+*@param contact：被关注的用户名
+*****************************************************
+*@return []string：关注者
+*****************************************************/
+func (c *Contacts) Watchers(contact string) []string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	watchers := make([]string, 0)
+	for name, list := range c.lists {
+		for _, temp := range list {
+			if temp == contact {
+				watchers = append(watchers, name)
+				break
+			}
+		}
+	}
+	return watchers
+}
+
+/****************************************************
+*@function func (c *Contacts) Forget(name string) error
+*****************************************************
+*@brief 删除name的全部联系人，游客下线后调用，用户名
+被他人再次使用时不会继承
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return error：删除失败原因
+*****************************************************/
+func (c *Contacts) Forget(name string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.lists[name]; !ok {
+		return nil
+	}
+	delete(c.lists, name)
+	return c.save(name)
+}
+
+/****************************************************
+*@brief 定义封禁名单，用户名与ip分别记录解禁时间，过期
+的封禁在查询时删除
+*****************************************************
+*@param lock：登录服务与分发器并发访问锁
+*@param names：用户名->解禁时间
+*@param ips：ip->解禁时间
+*****************************************************/
+type Bans struct {
+	lock  sync.Mutex
+	names map[string]time.Time
+	ips   map[string]time.Time
+}
+
+/****************************************************
+*@function NewBans() *Bans
+*****************************************************
+*@brief 新建空的封禁名单
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return *Bans：封禁名单
+*****************************************************/
+func NewBans() *Bans {
+	return &Bans{
+		names: make(map[string]time.Time),
+		ips:   make(map[string]time.Time),
+	}
+}
+
+/****************************************************
+*@function func (b *Bans) table(target string) map[string]time.Time
+*****************************************************
+*@brief 按目标选择封禁表，能解析为ip的目标视为ip，调用
+者需持有锁
+*****************************************************
+*@access Private
+*****************************************************
+*@param target：用户名或者ip
+*****************************************************
+*@return map[string]time.Time：封禁表
+*****************************************************/
+func (b *Bans) table(target string) map[string]time.Time {
+	if net.ParseIP(target) != nil {
+		return b.ips
+	}
+	return b.names
+}
+
+/****************************************************
+*@function func (b *Bans) Ban(target string, until time.Time)
+*****************************************************
+*@brief 封禁用户名或者ip直到until
+*****************************************************
+*@access Public
+*****************************************************
+*@param target：用户名或者ip
+*@param until：解禁时间
+*****************************************************
+*@return 无
+*****************************************************/
+func (b *Bans) Ban(target string, until time.Time) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.table(target)[target] = until
+}
+
+/****************************************************
+*@function func (b *Bans) Unban(target string) bool
+*****************************************************
+*@brief 解除用户名或者ip的封禁
+*****************************************************
+*@access Public
+*****************************************************
+*@param target：用户名或者ip
+*****************************************************
+*@return bool：之前是否被封禁
+*****************************************************/
+func (b *Bans) Unban(target string) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	table := b.table(target)
+	_, ok := table[target]
+	delete(table, target)
+	return ok
+}
+
+/****************************************************
+*@function func (b *Bans) Banned(name, ip string) (time.Time, bool)
+*****************************************************
+*@brief 判断用户名或者ip是否被封禁，删除已过期的封禁
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param ip：来源ip，可以为空
+*****************************************************
+*@return time.Time：解禁时间，两者都被封禁时取较晚者
+*@return bool：是否被封禁
+*****************************************************/
+func (b *Bans) Banned(name, ip string) (time.Time, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	var latest time.Time
+	check := func(table map[string]time.Time, target string) {
+		until, ok := table[target]
+		if !ok {
+			return
+		}
+		if !until.After(now) {
+			delete(table, target)
+			return
+		}
+		if until.After(latest) {
+			latest = until
+		}
+	}
+	check(b.names, name)
+	if ip != "" {
+		check(b.ips, ip)
+	}
+	return latest, !latest.IsZero()
+}
+
+/****************************************************
+*@function func (b *Bans) List() []string
+*****************************************************
+*@brief 列出未过期的封禁，每行为 目标 解禁时间
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return []string：按目标排序的封禁
+*****************************************************/
+func (b *Bans) List() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	lines := make([]string, 0)
+	for _, table := range []map[string]time.Time{b.names, b.ips} {
+		for target, until := range table {
+			if until.After(now) {
+				lines = append(lines, fmt.Sprintf("%s until %s", target, until.Format("2006-01-02 15:04:05")))
+			}
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+/****************************************************
+*@brief 定义一条会话记录
+*****************************************************
+*@param Time：消息时间
+*@param Sender：发送者
+*@param Receiver：接受者
+*@param Data：消息内容
+*@param Nonce：端到端加密随机数，非空时Data为密文
+*****************************************************/
+type Record struct {
+	Time     time.Time
+	Sender   string
+	Receiver string
+	Data     string
+	Nonce    string
+}
+
+/****************************************************
+*@brief 定义会话记录仓库，保存经服务器中转的会话，
+每个会话的记录按行以json格式保存在dir下的单独文件中
+*****************************************************
+*@param dir：记录目录
+*@param lock：并发访问锁
+*****************************************************/
+type History struct {
+	dir  string
+	lock sync.Mutex
+}
+
+/****************************************************
+*@function NewHistory(dir string) (*History, error)
+*****************************************************
+*@brief 新建会话记录仓库，目录不存在时创建
+*****************************************************
+*@access Public
+*****************************************************
+*@param dir：记录目录
+*****************************************************
+*@return *History：会话记录仓库
+*@return error：目录创建失败原因
+*****************************************************/
+func NewHistory(dir string) (*History, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &History{dir: dir}, nil
+}
+
+/****************************************************
+*@function func (h *History) path(a, b string) string
+*****************************************************
+*@brief 输出a与b之间会话的记录文件路径，与双方顺序无关
+*****************************************************
+*@access Private
+*****************************************************
+*@param a：会话一方用户名
+*@param b：会话另一方用户名
+*****************************************************
+*@return string：记录文件路径
+*****************************************************/
+func (h *History) path(a, b string) string {
+	if a > b {
+		a, b = b, a
+	}
+	return filepath.Join(h.dir, fmt.Sprintf("%x_%x.txt", a, b))
+}
+
+/****************************************************
+*@function func (h *History) Append(record Record) error
+*****************************************************
+*@brief 追加一条会话记录
+*****************************************************
+*@access Public
+*****************************************************
+*@param record：会话记录
+*****************************************************
+*@return error：保存失败原因
+*****************************************************/
+func (h *History) Append(record Record) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	file, err := os.OpenFile(h.path(record.Sender, record.Receiver), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+/****************************************************
+*@function func (h *History) Last(a, b string, n int) ([]Record, error)
+*****************************************************
+*@brief 输出a与b之间最近的n条会话记录
+*****************************************************
+*@access Public
+*****************************************************
+*@param a：会话一方用户名
+*@param b：会话另一方用户名
+*@param n：记录条数
+*****************************************************
+*@return []Record：按时间顺序排列的记录
+*@return error：读取失败原因
+*****************************************************/
+func (h *History) Last(a, b string, n int) ([]Record, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	records := make([]Record, 0)
+	file, err := os.Open(h.path(a, b))
+	if os.IsNotExist(err) {
+		return records, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	for decoder.More() {
+		var record Record
+		err = decoder.Decode(&record)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+		if len(records) > n {
+			records = records[1:]
+		}
+	}
+	return records, nil
+}
+
+/****************************************************
+*@function LoadTLSConfig(certFile, keyFile string, dev bool, loginPort string) (*tls.Config, error)
+*****************************************************
+*@brief 生成登录端口的TLS配置，开发模式下生成自签名
+证书，并把证书写入certFile供客户端固定信任
+*****************************************************
+*@access Public
+*****************************************************
+*@param certFile：证书路径，开发模式下为证书输出路径
+*@param keyFile：私钥路径，开发模式下不使用
+*@param dev：是否为开发模式
+*@param loginPort：登录监听地址，开发模式证书包含其中的主机
+*****************************************************
+*@return *tls.Config：TLS配置，未配置证书时为nil
+*@return error：证书读取或生成失败原因
+*****************************************************/
+func LoadTLSConfig(certFile, keyFile string, dev bool, loginPort string) (*tls.Config, error) {
+	if !dev {
+		if certFile == "" && keyFile == "" {
+			return nil, nil
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+	}
+	//开发模式，生成自签名证书，包含localhost、回环地址以及登录监听主机
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "im dev server"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(30 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	host, _, err := net.SplitHostPort(loginPort)
+	if err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	if certFile == "" {
+		certFile = "server-dev.crt"
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	err = os.WriteFile(certFile, certPEM, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("development certificate written to %s\n", certFile)
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+/****************************************************
+*@function ChooseCodec(offer string) string
+*****************************************************
+*@brief 从客户端按优先顺序列出的编解码中选择第一个
+服务器支持的
+*****************************************************
+*@access Public
+*****************************************************
+*@param offer：逗号分隔的编解码名称
+*****************************************************
+*@return string：选中的编解码，没有可用的时为json
+*****************************************************/
+func ChooseCodec(offer string) string {
+	for _, name := range strings.Split(offer, ",") {
+		codec := CodecByName(strings.TrimSpace(name))
+		if codec != nil {
+			return codec.Name()
+		}
+	}
+	return JSONCodec{}.Name()
+}
+
+/****************************************************
+*@function NameTaken(name string, config *Config) string
+*****************************************************
+*@brief 输出用户名被在线用户占用时的登录提示，说明
+用户名何时释放
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param config：服务器配置，包括心跳检查周期
+*****************************************************
+*@return string：提示内容
+*****************************************************/
+func NameTaken(name string, config *Config) string {
+	return fmt.Sprintf("the name %s is used by an online user, it is released when that user logs out, is kicked, or stops sending heartbeats for %v, please try another name", name, 2*config.CheckInterval)
+}
+
+/****************************************************
+*@function Login(config *Config, userCh chan User, logger *log.Logger, onLineUsers *Store, accounts *Accounts, tlsConfig *tls.Config, mailbox *Mailbox, bans *Bans)
+*****************************************************
+*@brief 服务器开启登录服务，获取user远程端口、发送welcome
+*		介绍，返回已登录用户的信息
+		向chat监听端口发送用户信息，保证登录用户的同步性
+		支持register注册账号、login账号密码登录，以及可选的游客登录
+		登录成功后告知离线留言数，留言由分发器可靠投递
+		与消息监听共用在线用户组，用户下线后用户名即可再次使用
+*****************************************************
+*@access Public
+*****************************************************
+*@param config *Config 服务器配置，包括登录、监听地址以及是否允许游客登录
+*@param userCh chan User 用户类型channel
+*@param onLineUsers *Store 在线用户组
+*@param accounts *Accounts 注册账号仓库
+*@param tlsConfig *tls.Config 登录端口TLS配置，为nil时使用明文tcp
+*@param mailbox *Mailbox 离线留言箱
+*@param bans *Bans 封禁名单，被封禁的用户名与ip不能登录
+*****************************************************
+*@return 无
+*****************************************************/
+func Login(config *Config, userCh chan User, logger *log.Logger, onLineUsers *Store, accounts *Accounts, tlsConfig *tls.Config, mailbox *Mailbox, bans *Bans) {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	loginPort, listenPort := config.LoginAddr, config.ListenAddr
+	//开启登录监听端口
+	var loginService net.Listener
+	var err error
+	if tlsConfig != nil {
+		loginService, err = tls.Listen("tcp", loginPort, tlsConfig)
+	} else {
+		loginService, err = net.Listen("tcp", loginPort)
+	}
+	if err != nil {
+		fmt.Println(err)
+		logger.Printf("login:%v\n", err)
+	}
+	fmt.Println("login listener setted successfully")
+	for {
+		//接收tcp连接
+		loginConn, err := loginService.Accept()
+		if err != nil {
+			fmt.Println(err)
+			logger.Printf("login:%v\n", err)
+		}
+		defer loginConn.Close()
+		//处理登录请求
+		go func(conn net.Conn, ch chan User) {
+			//关闭连接
+			defer conn.Close()
+			//声明用户、消息以及json解码编码接口
+			var mess Message
+			var user User
+			decoder := json.NewDecoder(conn)
+			encoder := json.NewEncoder(conn)
+			//json解码，收到login请求
+			err := decoder.Decode(&mess)
+			if err != nil {
+				fmt.Println(err)
+				logger.Printf("login:%v\n", err)
+			}
+			fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mess.Cmd, mess.Data, mess.Sender, mess.Receiver)
+			user.Addr = mess.Data
+			user.Key = mess.Key
+			//登录来源ip，用于封禁检查
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			//协商udp消息的编解码，旧客户端不携带Codec，使用json
+			user.Codec = ChooseCodec(mess.Codec)
+			//发送chat端口
+			mess = Message{
+				Cmd:      "connect",
+				Sender:   conn.LocalAddr().String(),
+				Data:     listenPort,
+				Receiver: conn.RemoteAddr().String(),
+				Codec:    user.Codec,
+			}
+			//fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mess.Cmd, mess.Data, mess.Sender, mess.Receiver)
+			err = encoder.Encode(mess)
+			if err != nil {
+				fmt.Println(err)
+				logger.Printf("login:%v\n", err)
+			}
+			//发送welcome、介绍
+			mess = Message{
+				Cmd:      "login",
+				Sender:   conn.LocalAddr().String(),
+				Data:     config.Welcome,
+				Receiver: conn.RemoteAddr().String(),
+			}
+			//fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mess.Cmd, mess.Data, mess.Sender, mess.Receiver)
+			err = encoder.Encode(mess)
+			if err != nil {
+				fmt.Println(err)
+				logger.Printf("login:%v\n", err)
+				conn.Close()
+			}
+			flag := true
+			//如果一直输入不对，一直处于监听状态
+			for flag {
+				//获取客户端输入的用户名
+				err = decoder.Decode(&mess)
+				if err != nil {
+					fmt.Println(err)
+					logger.Printf("login:%v\n", err)
+					conn.Close()
+					break
+				}
+				//mess.Data为 用户名/密码，游客登录时只有用户名
+				loginList := strings.SplitN(mess.Data, "/", 2)
+				name := loginList[0]
+				password := ""
+				if len(loginList) == 2 {
+					password = loginList[1]
+				}
+				fmt.Printf("CMD:%v,Name:%v,Sender:%v,Receiver:%v\n", mess.Cmd, name, mess.Sender, mess.Receiver)
+				//校验账号以及用户名是否被占用
+				//如果校验失败，提示原因并重新输入
+				reason := ""
+				if name == "" {
+					reason = "the name can not be empty"
+				} else if name == "server" {
+					reason = "the name is reserved,please try another name"
+				} else if until, banned := bans.Banned(name, host); banned {
+					reason = fmt.Sprintf("you are banned until %s", until.Format("2006-01-02 15:04:05"))
+				} else if strings.ContainsAny(name, " \t,:") {
+					//旧格式的列表以这些字符分隔，用户名中不能出现
+					reason = "the name can not contain spaces, ',' or ':'"
+				} else if "" != onLineUsers.GetUser(name).Name {
+					reason = NameTaken(name, config)
+				} else if mess.Cmd == "register" {
+					err = accounts.Register(name, password)
+					if err != nil {
+						reason = err.Error()
+					} else {
+						logger.Printf("account %v registered\n", name)
+					}
+				} else if len(loginList) == 2 {
+					if !accounts.Verify(name, password) {
+						reason = "wrong name or password"
+					}
+				} else if !config.AllowGuest {
+					reason = "guest login is disabled, please login with your password"
+				} else if accounts.Exists(name) {
+					reason = "the name is registered, please login with your password"
+				}
+				if reason == "" {
+					user.Token, err = NewToken()
+					if err != nil {
+						reason = "the server can not create a session, please try again"
+						logger.Printf("login:%v\n", err)
+					}
+				}
+				if reason == "" {
+					//与消息监听共用在线用户组，占用用户名，下线后释放
+					user.Name = name
+					user.Status = StatusAvailable
+					user.BeatCount = 2
+					if !onLineUsers.Claim(name, user) {
+						reason = NameTaken(name, config)
+					}
+				}
+				if reason != "" {
+					mess = Message{
+						Cmd:      "login",
+						Sender:   conn.LocalAddr().String(),
+						Data:     reason,
+						Receiver: conn.RemoteAddr().String(),
+					}
+				} else {
+					mess = Message{
+						Cmd:      "login",
+						Sender:   "server",
+						Data:     "success",
+						Receiver: user.Name,
+						Token:    user.Token,
+					}
+					flag = false
+				}
+				//fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mes.Cmd, mes.Data, mes.Sender, mes.Receiver)
+				err = encoder.Encode(mess)
+				if err != nil {
+					fmt.Println(err)
+					logger.Printf("login:%v\n", err)
+					conn.Close()
+					break
+				}
+			}
+			if flag {
+				return
+			}
+			//告知离线留言数，以mailend结束，留言由分发器经udp
+			//可靠投递，收件人确认后才删除
+			mails, err := mailbox.Peek(user.Name)
+			if err != nil {
+				fmt.Println(err)
+				logger.Printf("login:%v\n", err)
+			}
+			err = encoder.Encode(Message{
+				Cmd:      "mailend",
+				Sender:   "server",
+				Data:     fmt.Sprintf("%d", len(mails)),
+				Receiver: user.Name,
+			})
+			if err != nil {
+				fmt.Println(err)
+				logger.Printf("login:%v\n", err)
+			}
+			logger.Printf("user %v login\n", user)
+			ch <- user
+		}(loginConn, userCh)
+	}
+}
+
+/****************************************************
+*@brief 定义服务器命令队列中的一条命令
+*****************************************************
+*@param Mess：命令消息
+*@param Addr：来源udp地址，为nil时是服务器内部产生的命令
+*@param Reply：管理命令的结果，处理函数处理完成后一次写入
+全部结果行，需要至少一个缓冲，分发器不会阻塞
+*****************************************************/
+type Command struct {
+	Mess  Message
+	Addr  *net.UDPAddr
+	Reply chan []string
+}
+
+/****************************************************
+*@brief 定义命令处理函数
+*****************************************************/
+type Handler func(cmd Command)
+
+/****************************************************
+*@brief 定义服务器命令分发器。读取数据报、登录注册、
+定时检查等生产者各自运行，把命令放入同一个队列，
+分发器逐条取出并交给注册的处理函数，处理函数也可以
+向队列放入新的命令
+*****************************************************
+*@param Config：服务器配置
+*@param Logger：日志文件
+*@param Conn：udp消息监听端口
+*@param Outbox：发件箱，所有回复经监听端口发出
+*@param Drops：丢包计数，包括无法解析与未通过令牌校验的数据报
+*@param Acks：可靠投递，服务器发出消息的确认以及收到请求的去重
+*@param Fragments：分片重组
+*@param Users：在线用户组
+*@param Accounts：注册账号仓库
+*@param Mailbox：离线留言箱
+*@param History：中转会话记录
+*@param Contacts：联系人仓库
+*@param Bans：封禁名单
+*@param queue：命令队列
+*@param handlers：客户端命令->处理函数
+*@param internal：内部命令->处理函数
+*@param mailing：刚登录、等待第一次心跳后投递离线留言的用户，
+只在分发协程中访问
+*****************************************************/
+type Dispatcher struct {
+	Config    *Config
+	Logger    *log.Logger
+	Conn      PacketConn
+	Outbox    *Outbox
+	Drops     *DropCounter
+	Acks      *Reliable
+	Fragments *Reassembler
+	Users     *Store
+	Accounts  *Accounts
+	Mailbox   *Mailbox
+	History   *History
+	Contacts  *Contacts
+	Bans      *Bans
+	queue     chan Command
+	handlers  map[string]Handler
+	internal  map[string]Handler
+	mailing   map[string]bool
+}
+
+/****************************************************
+*@function NewDispatcher(config *Config, logger *log.Logger, conn PacketConn, onLineUsers *Store, accounts *Accounts, mailbox *Mailbox, history *History, contacts *Contacts, bans *Bans) *Dispatcher
+*****************************************************
+*@brief 新建命令分发器，注册所有命令的处理函数
+*****************************************************
+*@access Public
+*****************************************************
+*@param config：服务器配置
+*@param logger：日志文件
+*@param conn：udp消息监听端口
+*@param onLineUsers：在线用户组
+*@param accounts：注册账号仓库
+*@param mailbox：离线留言箱
+*@param history：中转会话记录
+*@param contacts：联系人仓库
+*@param bans：封禁名单
+*****************************************************
+*@return *Dispatcher：命令分发器
+*****************************************************/
+func NewDispatcher(config *Config, logger *log.Logger, conn PacketConn, onLineUsers *Store, accounts *Accounts, mailbox *Mailbox, history *History, contacts *Contacts, bans *Bans) *Dispatcher {
+	acks := NewReliable(config.Retries, config.AckWait)
+	drops := NewDropCounter()
+	d := &Dispatcher{
+		Config:    config,
+		Logger:    logger,
+		Conn:      conn,
+		Outbox:    NewOutbox(conn, config.OutQueue, acks, logger),
+		Drops:     drops,
+		Acks:      acks,
+		Fragments: NewReassembler(config.FragWait, config.FragMemory, config.FragSource, drops),
+		Users:     onLineUsers,
+		Accounts:  accounts,
+		Mailbox:   mailbox,
+		History:   history,
+		Contacts:  contacts,
+		Bans:      bans,
+		queue:     make(chan Command, 1024),
+		handlers:  make(map[string]Handler),
+		internal:  make(map[string]Handler),
+		mailing:   make(map[string]bool),
+	}
+	d.Handle("beat", d.HandleBeat)
+	d.Handle("list", d.HandleList)
+	d.Handle("group", d.HandleGroup)
+	d.Handle("accept", d.HandleAccept)
+	d.Handle("decline", d.HandleDecline)
+	d.Handle("quit", d.HandleQuit)
+	d.Handle("logout", d.HandleLogout)
+	d.Handle("mail", d.HandleMail)
+	d.Handle("msg", d.HandleMsg)
+	d.Handle("status", d.HandleStatus)
+	d.Handle("watch", d.HandleWatch)
+	d.Handle("unwatch", d.HandleUnwatch)
+	d.Handle("chat", d.HandleChat)
+	d.Handle("history", d.HandleHistory)
+	d.Handle("join", d.HandleJoin)
+	d.Handle("leave", d.HandleLeave)
+	d.Handle("rooms", d.HandleRooms)
+	d.Handle("roomchat", d.HandleRoomChat)
+	d.Handle("ack", d.HandleAck)
+	d.HandleInternal("online", d.HandleOnline)
+	d.HandleInternal("check", d.HandleCheck)
+	d.HandleInternal("undelivered", d.HandleUndelivered)
+	d.HandleInternal("admin", d.HandleAdmin)
+	return d
+}
+
+/****************************************************
+*@function func (d *Dispatcher) Handle(cmd string, handler Handler)
+*****************************************************
+*@brief 注册客户端命令的处理函数，客户端命令需通过
+令牌校验
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：命令名
+*@param handler：处理函数
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) Handle(cmd string, handler Handler) {
+	d.handlers[cmd] = handler
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleInternal(cmd string, handler Handler)
+*****************************************************
+*@brief 注册内部命令的处理函数，客户端无法触发内部命令
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：命令名
+*@param handler：处理函数
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleInternal(cmd string, handler Handler) {
+	d.internal[cmd] = handler
+}
+
+/****************************************************
+*@function func (d *Dispatcher) Push(cmd Command)
+*****************************************************
+*@brief 向命令队列放入一条命令，队列满时等待
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：命令
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) Push(cmd Command) {
+	d.queue <- cmd
+}
+
+/****************************************************
+*@function func (d *Dispatcher) ReadLoop()
+*****************************************************
+*@brief 生产者：逐个读取数据报，每个数据报解码为一条
+消息，记录来源地址后放入队列。不合法的数据报计数后
+丢弃，不影响后续数据报，端口关闭后退出
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) ReadLoop() {
+	buffer := make([]byte, 65536)
+	for {
+		count, remoteAddr, err := d.Conn.ReadFromUDP(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Println(err)
+			d.Logger.Printf("ListenMess:%v\n", err)
+			continue
+		}
+		//分片收齐之前无法校验令牌，每个来源地址的占用受fragsource限制
+		data, err := d.Fragments.Add(remoteAddr.String(), buffer[:count])
+		if err == nil && data == nil {
+			//分片未收齐
+			continue
+		}
+		var mess Message
+		if err == nil {
+			mess, err = DecodeFrame(data)
+		}
+		if err != nil {
+			reason := "payload"
+			var frameErr *FrameError
+			if errors.As(err, &frameErr) {
+				reason = frameErr.Reason
+			}
+			dropped := d.Drops.Drop(reason)
+			d.Logger.Printf("ListenMess drop from %v (%d %s drops):%v\n", remoteAddr, dropped, reason, err)
+			continue
+		}
+		d.Push(Command{Mess: mess, Addr: remoteAddr})
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) LoginLoop(userCh chan User)
+*****************************************************
+*@brief 生产者：接收登录成功的用户，放入online命令，
+登录协程不再等待数据报到达
+*****************************************************
+*@access Public
+*****************************************************
+*@param userCh：登录成功的用户
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) LoginLoop(userCh chan User) {
+	for user := range userCh {
+		d.Push(Command{Mess: Message{Cmd: "online", Sender: user.Name, Receiver: "server"}})
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) TimerLoop(interval time.Duration)
+*****************************************************
+*@brief 生产者：每个心跳检查周期放入一条check命令
+*****************************************************
+*@access Public
+*****************************************************
+*@param interval：心跳检查周期
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) TimerLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.Push(Command{Mess: Message{Cmd: "check", Sender: "server", Receiver: "server"}})
+	}
+}
+
+/****************************************************
+*@function ListenAdmin(addr string) (net.Listener, error)
+*****************************************************
+*@brief 开启管理控制台监听。unix socket先在同目录下权限
+为0700的临时目录中创建并设为0600，再改名到addr，其他
+用户在任何时刻都无法连接
+*****************************************************
+*@access Public
+*****************************************************
+*@param addr：回环tcp地址，或者unix:socket路径
+*****************************************************
+*@return net.Listener：管理控制台监听
+*@return error：监听失败原因
+*****************************************************/
+func ListenAdmin(addr string) (net.Listener, error) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	address := strings.TrimPrefix(addr, "unix:")
+	dir, err := os.MkdirTemp(filepath.Dir(address), ".admin-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	temp := filepath.Join(dir, "admin.sock")
+	listener, err := net.Listen("unix", temp)
+	if err != nil {
+		return nil, err
+	}
+	//改名后关闭监听时删除的是原路径，由改名后的路径替代
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	err = os.Chmod(temp, 0600)
+	if err == nil {
+		//覆盖上次运行遗留的socket文件
+		err = os.Rename(temp, address)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+/****************************************************
+*@function func (d *Dispatcher) AdminLoop(addr string)
+*****************************************************
+*@brief 生产者：开启管理控制台监听，每个连接按行读取
+管理命令，放入admin命令并把处理结果写回连接
+*****************************************************
+*@access Public
+*****************************************************
+*@param addr：回环tcp地址，或者unix:socket路径
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) AdminLoop(addr string) {
+	listener, err := ListenAdmin(addr)
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("admin:%v\n", err)
+		return
+	}
+	fmt.Println("admin listener setted successfully")
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			d.Logger.Printf("admin:%v\n", err)
+			continue
+		}
+		go d.ServeAdmin(conn)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) ServeAdmin(conn net.Conn)
+*****************************************************
+*@brief 处理一个管理控制台连接，输入exit关闭连接。
+结果在本协程中写入连接，控制台读取缓慢时不影响分发器
+*****************************************************
+*@access Public
+*****************************************************
+*@param conn：管理控制台连接
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) ServeAdmin(conn net.Conn) {
+	defer conn.Close()
+	d.Logger.Printf("admin: console from %v\n", conn.RemoteAddr())
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == "exit" {
+			return
+		}
+		reply := make(chan []string, 1)
+		d.Push(Command{Mess: Message{Cmd: "admin", Sender: "admin", Data: line, Receiver: "server"}, Reply: reply})
+		for _, text := range <-reply {
+			_, err := fmt.Fprintln(conn, text)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) Run()
+*****************************************************
+*@brief 逐条取出命令并分发。来自客户端的命令先校验用户
+名、令牌以及来源地址，防止伪造Sender
+*****************************************************
+*@access Public
+*****************************************************
+*@param 无
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) Run() {
+	for cmd := range d.queue {
+		mess := cmd.Mess
+		if cmd.Addr == nil {
+			handler, flag := d.internal[mess.Cmd]
+			if flag {
+				handler(cmd)
+			}
+			continue
+		}
+		if !d.Users.Verify(mess.Sender, mess.Token, cmd.Addr.String()) {
+			d.Drops.Drop("token")
+			d.Logger.Printf("ListenMess reject %v from %v\n", mess.Cmd, cmd.Addr)
+			continue
+		}
+		//令牌不能转发给其他客户端
+		cmd.Mess.Token = ""
+		//需要确认的请求由服务器回复ack，重传造成的重复请求不再处理
+		if mess.ID != "" && mess.Receiver == "server" {
+			d.Confirm(mess)
+			if d.Acks.Duplicate(mess.Sender, mess.ID) {
+				continue
+			}
+		}
+		if mess.Cmd != "beat" && mess.Cmd != "ack" {
+			fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mess.Cmd, mess.Data, mess.Sender, mess.Receiver)
+			d.Logger.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mess.Cmd, mess.Data, mess.Sender, mess.Receiver)
+		}
+		handler, flag := d.handlers[mess.Cmd]
+		if !flag {
+			d.Logger.Printf("ListenMess unknown command %v from %v\n", mess.Cmd, mess.Sender)
+			continue
+		}
+		handler(cmd)
+	}
+}
+
+/****************************************************
+*@function ListenMess(config *Config, userCh chan User, logger *log.Logger, onLineUsers *Store, accounts *Accounts, mailbox *Mailbox, history *History, contacts *Contacts, bans *Bans)
+*****************************************************
+*@brief 开启本地消息监听，启动各生产者后由分发器处理
+所有命令
+*****************************************************
+*@access Public
+*****************************************************
+*@param config：服务器配置
+*@param userCh：用户注册进程
+*@param logger：日志文件
+*@param onLineUsers：在线用户组
+*@param accounts：注册账号仓库，只给注册用户保存离线留言
+*@param mailbox：离线留言箱
+*@param history：中转会话记录
+*@param contacts：联系人仓库
+*@param bans：封禁名单
+*****************************************************
+*@return 无
+*****************************************************/
+func ListenMess(config *Config, userCh chan User, logger *log.Logger, onLineUsers *Store, accounts *Accounts, mailbox *Mailbox, history *History, contacts *Contacts, bans *Bans) {
+	runtime.GOMAXPROCS(runtime.NumCPU())
+	listenPort := config.ListenAddr
+	server := User{
+		Name:      "server",
+		Addr:      listenPort,
+		BeatCount: 2,
+	}
+	onLineUsers.Add("server", server)
+	udpAddr, err := net.ResolveUDPAddr("udp", listenPort)
+	if err != nil {
+		fmt.Println(err)
+		logger.Printf("ListenMess:%v\n", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		fmt.Println(err)
+		logger.Printf("ListenMess:%v\n", err)
+		return
+	}
+	fmt.Println("chat listener setted successfully")
+	dispatcher := NewDispatcher(config, logger, conn, onLineUsers, accounts, mailbox, history, contacts, bans)
+	go dispatcher.ReadLoop()
+	go dispatcher.LoginLoop(userCh)
+	go dispatcher.TimerLoop(config.CheckInterval)
+	if config.AdminAddr != "" {
+		go dispatcher.AdminLoop(config.AdminAddr)
+	}
+	dispatcher.Run()
+}
+
+/****************************************************
+*@function func (d *Dispatcher) Fail(name string, cmd string, code int, text string)
+*****************************************************
+*@brief 向用户返回带错误码的错误，Data中为错误描述，
+兼容旧客户端
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param cmd：出错的命令
+*@param code：错误码
+*@param text：错误描述
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) Fail(name string, cmd string, code int, text string) {
+	err := d.Outbox.Send(d.Users.GetUser(name), Message{
+		Cmd:      cmd,
+		Sender:   "server",
+		Data:     text,
+		Receiver: name,
+		Payload:  NewPayload(Payload{Error: &ErrorInfo{Code: code, Text: text}}),
+	})
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleOnline(cmd Command)
+*****************************************************
+*@brief 用户登录成功，用户在登录时已加入在线用户组，
+通知关注者，离线留言在第一次心跳确定公网地址后投递
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：online命令，Sender为新用户
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleOnline(cmd Command) {
+	fmt.Println("-------------------new User from login-----------------")
+	d.Logger.Printf("ListenMess new user:%v\n", cmd.Mess.Sender)
+	d.mailing[cmd.Mess.Sender] = true
+	d.Presence(cmd.Mess.Sender)
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleCheck(cmd Command)
+*****************************************************
+*@brief 心跳检查，释放超时用户并通知关注者，清理过期的
+会话邀请
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：check命令
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleCheck(cmd Command) {
+	for _, name := range d.Users.Sort(d.Outbox, d.Config.MinBeats) {
+		d.Presence(name)
+	}
+	for _, invite := range d.Users.ExpireInvites(time.Now()) {
+		d.Fail(invite.From, "group", CodeExpired, fmt.Sprintf("the invitation to <%s> expired", invite.To))
+		d.Fail(invite.To, "invite", CodeExpired, fmt.Sprintf("the invitation from <%s> expired", invite.From))
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleBeat(cmd Command)
+*****************************************************
+*@brief 记录心跳，同时记录心跳来源地址，登录后的第一次
+心跳投递离线留言
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleBeat(cmd Command) {
+	mess := cmd.Mess
+	d.Users.Beat(mess.Sender, cmd.Addr.String())
+	if d.mailing[mess.Sender] {
+		delete(d.mailing, mess.Sender)
+		d.DeliverMail(mess.Sender)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) DeliverMail(name string)
+*****************************************************
+*@brief 以可靠投递发送name的离线留言，收件人确认后
+才从留言箱删除，未确认的留言保留到下次登录
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：收件人用户名
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) DeliverMail(name string) {
+	mails, err := d.Mailbox.Peek(name)
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+		return
+	}
+	user := d.Users.GetUser(name)
+	for _, mail := range mails {
+		id := mail.ID
+		stamp := mail.Time.Format("2006-01-02 15:04:05")
+		//以server为发送者，收件人的ack发给服务器而不是留言者
+		err = d.Acks.SendAcked(Message{
+			Cmd:      "mailbox",
+			Sender:   "server",
+			Data:     fmt.Sprintf("%s/%s", stamp, mail.Data),
+			Receiver: name,
+			Payload:  NewPayload(Payload{Note: &NoteInfo{From: mail.Sender, Text: mail.Data, Time: stamp}}),
+		}, func(mess Message) error {
+			return d.Outbox.Send(user, mess)
+		}, func(mess Message) {
+			err := d.Mailbox.Remove(name, id)
+			if err != nil {
+				d.Logger.Printf("ListenMess:%v\n", err)
+			}
+		}, func(mess Message) {
+			d.Logger.Printf("ListenMess mail for %v kept until the next login\n", name)
+		})
+		if err != nil {
+			fmt.Println(err)
+			d.Logger.Printf("ListenMess:%v\n", err)
+			return
+		}
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleList(cmd Command)
+*****************************************************
+*@brief 向发送者返回按用户名排序的在线用户列表及其状态
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleList(cmd Command) {
+	mess := cmd.Mess
+	strList := make([]string, 0)
+	shelf := d.Users.GetMap()
+	for tempName, _ := range shelf {
+		if tempName != "server" {
+			strList = append(strList, tempName)
+		}
+	}
+	sort.Strings(strList)
+	statuses := make([]UserStatus, 0, len(strList))
+	for _, tempName := range strList {
+		statuses = append(statuses, UserStatus{
+			Name:   tempName,
+			Status: shelf[tempName].Status,
+			Text:   shelf[tempName].StatusText,
+		})
+	}
+	err := d.Outbox.Send(d.Users.GetUser(mess.Sender), Message{
+		Cmd:      "list",
+		Sender:   "server",
+		Data:     strings.Join(strList, "/"),
+		Receiver: mess.Sender,
+		Payload:  NewPayload(Payload{List: &UserList{Users: strList, Statuses: statuses}}),
+	})
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleGroup(cmd Command)
+*****************************************************
+*@brief 邀请对方建立两人会话，对方接受后才建立会话
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令，Data为被邀请者
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleGroup(cmd Command) {
+	mess := cmd.Mess
+	//不能邀请自己，否则会记录一条只能由自己接受的邀请
+	if mess.Data == mess.Sender {
+		d.Fail(mess.Sender, "group", CodeBusy, "you can not talk to yourself")
+		return
+	}
+	//读取会话的对方的信息
+	callee := d.Users.GetUser(mess.Data)
+	if callee.Name == "" || callee.Name == "server" {
+		//被叫方不在线
+		d.Fail(mess.Sender, "group", CodeNotOnline, fmt.Sprintf("the user <%s> is not online, use mail to leave a message", mess.Data))
+		return
+	} else if callee.TalkingWith(mess.Sender) {
+		//双方已经建立group会话
+		d.Fail(mess.Sender, "group", CodeBusy, fmt.Sprintf("you are talking with <%s> already", mess.Data))
+		return
+	} else if callee.Status == StatusDND {
+		//被叫方设置了请勿打扰
+		d.Fail(mess.Sender, "group", CodeBusy, fmt.Sprintf("the user <%s> does not want to be disturbed", mess.Data))
+		return
+	}
+	//记录邀请，被叫方接受后建立会话，超时未处理则过期
+	if !d.Users.Invite(mess.Sender, callee.Name, time.Now().Add(d.Config.InviteWait)) {
+		d.Fail(mess.Sender, "group", CodeBusy, fmt.Sprintf("you have invited <%s> already", callee.Name))
+		return
+	}
+	invite := NewPayload(Payload{Invite: &InviteInfo{
+		From:    mess.Sender,
+		To:      callee.Name,
+		Timeout: int(d.Config.InviteWait / time.Second),
+	}})
+	err := d.Outbox.SendReliable(callee, Message{
+		Cmd:      "invite",
+		Sender:   "server",
+		Data:     fmt.Sprintf("%s want talk to you, input accept or decline", mess.Sender),
+		Receiver: callee.Name,
+		Payload:  invite,
+	}, d.Undelivered)
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+	err = d.Outbox.Send(d.Users.GetUser(mess.Sender), Message{
+		Cmd:      "invite",
+		Sender:   "server",
+		Data:     fmt.Sprintf("waiting for <%s> to accept", callee.Name),
+		Receiver: mess.Sender,
+		Payload:  invite,
+	})
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleAccept(cmd Command)
+*****************************************************
+*@brief 接受会话邀请，发起者在线时建立会话
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令，Data为发起者，为空时
+接受最早的邀请
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleAccept(cmd Command) {
+	mess := cmd.Mess
+	invite, flag := d.Users.TakeInvite(mess.Sender, mess.Data)
+	if !flag {
+		d.Fail(mess.Sender, "accept", CodeNoInvite, "there is no invitation to accept")
+		return
+	}
+	sponsor := d.Users.GetUser(invite.From)
+	callee := d.Users.GetUser(mess.Sender)
+	if sponsor.Name == "" {
+		d.Fail(callee.Name, "accept", CodeNotOnline, fmt.Sprintf("the user <%s> is not online", invite.From))
+	} else if callee.TalkingWith(sponsor.Name) {
+		d.Fail(callee.Name, "accept", CodeBusy, fmt.Sprintf("you are talking with <%s> already", invite.From))
+	} else {
+		d.StartSession(sponsor, callee)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleDecline(cmd Command)
+*****************************************************
+*@brief 拒绝会话邀请，并告知发起者
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令，Data为发起者，为空时
+拒绝最早的邀请
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleDecline(cmd Command) {
+	mess := cmd.Mess
+	invite, flag := d.Users.TakeInvite(mess.Sender, mess.Data)
+	if !flag {
+		d.Fail(mess.Sender, "decline", CodeNoInvite, "there is no invitation to decline")
+		return
+	}
+	d.Fail(invite.From, "group", CodeDeclined, fmt.Sprintf("<%s> declined your invitation", invite.To))
+	err := d.Outbox.Send(d.Users.GetUser(mess.Sender), Message{
+		Cmd:      "decline",
+		Sender:   "server",
+		Data:     fmt.Sprintf("you declined the invitation from <%s>", invite.From),
+		Receiver: mess.Sender,
+	})
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) StartSession(sponsor User, callee User)
+*****************************************************
+*@brief 建立两人会话，双方互相记入Peers，向双方转交
+对方的地址与身份公钥
+*****************************************************
+*@access Public
+*****************************************************
+*@param sponsor：发起者
+*@param callee：被邀请者
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) StartSession(sponsor User, callee User) {
+	d.Users.Connect(sponsor.Name, callee.Name)
+	//向被呼叫方发送通知，对方地址包括公网地址与内网地址，双方据此打洞，同时转交对方身份公钥
+	err := d.Outbox.SendReliable(callee, Message{
+		Cmd:      "group",
+		Sender:   "server",
+		Data:     fmt.Sprintf("0/%s/%s/%s/%s", sponsor.Name, sponsor.Endpoint(), sponsor.Addr, sponsor.Key),
+		Receiver: callee.Name,
+		Payload: NewPayload(Payload{Offer: &SessionOffer{
+			Name:        sponsor.Name,
+			PublicAddr:  sponsor.Endpoint(),
+			PrivateAddr: sponsor.Addr,
+			Key:         sponsor.Key,
+		}}),
+	}, d.Undelivered)
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+	//向发起方返回远程client地址
+	err = d.Outbox.SendReliable(sponsor, Message{
+		Cmd:      "group",
+		Sender:   "server",
+		Data:     fmt.Sprintf("1/%s/%s/%s/%s", callee.Name, callee.Endpoint(), callee.Addr, callee.Key),
+		Receiver: sponsor.Name,
+		Payload: NewPayload(Payload{Offer: &SessionOffer{
+			Sponsor:     true,
+			Name:        callee.Name,
+			PublicAddr:  callee.Endpoint(),
+			PrivateAddr: callee.Addr,
+			Key:         callee.Key,
+		}}),
+	}, d.Undelivered)
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleQuit(cmd Command)
+*****************************************************
+*@brief 结束会话，Data为空时结束发送者的全部会话，中转模式下通知对方
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleQuit(cmd Command) {
+	mess := cmd.Mess
+	fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mess.Cmd, mess.Data, mess.Sender, mess.Receiver)
+	//中转模式下，quit的Receiver为对方用户名，需要转发给对方
+	if mess.Receiver != "server" && mess.Receiver != "" {
+		if d.Users.Disconnect(mess.Sender, mess.Receiver) {
+			err := d.Outbox.Send(d.Users.GetUser(mess.Receiver), mess)
+			if err != nil {
+				fmt.Println(err)
+				d.Logger.Printf("ListenMess:%v\n", err)
+			}
+		}
+		return
+	}
+	//发往服务器的quit，Data为结束会话的对方，为空时结束全部会话并通知对方
+	if mess.Data != "" {
+		d.Users.Disconnect(mess.Sender, mess.Data)
+		return
+	}
+	for _, peer := range d.Users.GetUser(mess.Sender).Peers {
+		d.Users.Disconnect(mess.Sender, peer)
+		err := d.Outbox.SendReliable(d.Users.GetUser(peer), Message{
+			Cmd:      "quit",
+			Sender:   "server",
+			Data:     mess.Sender,
+			Receiver: peer,
+		}, nil)
+		if err != nil {
+			fmt.Println(err)
+			d.Logger.Printf("ListenMess:%v\n", err)
+		}
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleLogout(cmd Command)
+*****************************************************
+*@brief 注销，释放用户名
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleLogout(cmd Command) {
+	mess := cmd.Mess
+	//注销，释放用户名，会话对方与房间成员收到通知
+	if d.Users.Release(mess.Sender, d.Outbox) {
+		d.Logger.Printf("user %v logout\n", mess.Sender)
+		d.Presence(mess.Sender)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleMail(cmd Command)
+*****************************************************
+*@brief 留言，对方在线时直接投递，离线时保存到留言箱
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleMail(cmd Command) {
+	mess := cmd.Mess
+	//留言，对方在线时直接投递，离线时保存到留言箱
+	receiver := d.Users.GetUser(mess.Receiver)
+	data := ""
+	if receiver.Name != "" && receiver.Name != "server" {
+		err := d.Outbox.Send(receiver, mess)
+		if err != nil {
+			fmt.Println(err)
+			d.Logger.Printf("ListenMess:%v\n", err)
+		}
+		data = fmt.Sprintf("<%s> is online, the message is delivered", mess.Receiver)
+	} else if !d.Accounts.Exists(mess.Receiver) {
+		d.Fail(mess.Sender, "mail", CodeNotRegistered, fmt.Sprintf("the user <%s> is not registered", mess.Receiver))
+		return
+	} else {
+		err := d.Mailbox.Put(mess.Receiver, Mail{
+			Sender: mess.Sender,
+			Data:   mess.Data,
+			Time:   time.Now(),
+		})
+		if err != nil {
+			d.Logger.Printf("ListenMess:%v\n", err)
+			d.Fail(mess.Sender, "mail", CodeMailbox, err.Error())
+			return
+		} else {
+			data = fmt.Sprintf("the message is saved for <%s>", mess.Receiver)
+		}
+	}
+	err := d.Outbox.Send(d.Users.GetUser(mess.Sender), Message{
+		Cmd:      "mail",
+		Sender:   "server",
+		Data:     data,
+		Receiver: mess.Sender,
+	})
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleMsg(cmd Command)
+*****************************************************
+*@brief 单条消息，不建立会话，按Receiver投递给在线用户，
+对方离线、未注册或者未确认时告知发送者
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleMsg(cmd Command) {
+	mess := cmd.Mess
+	receiver := d.Users.GetUser(mess.Receiver)
+	if receiver.Name == "" || receiver.Name == "server" {
+		if d.Accounts.Exists(mess.Receiver) {
+			d.Fail(mess.Sender, "msg", CodeNotOnline, fmt.Sprintf("the user <%s> is not online, use mail to leave a message", mess.Receiver))
+		} else {
+			d.Fail(mess.Sender, "msg", CodeNotRegistered, fmt.Sprintf("the user <%s> is unknown", mess.Receiver))
+		}
+		return
+	} else if receiver.Status == StatusDND {
+		d.Fail(mess.Sender, "msg", CodeBusy, fmt.Sprintf("the user <%s> does not want to be disturbed, use mail to leave a message", mess.Receiver))
+		return
+	}
+	//对方未确认时重传，用尽后告知发送者。以server为发送者，
+	//接收方的ack发给服务器，作者放在Payload中
+	sender := mess.Sender
+	err := d.Outbox.SendReliable(receiver, Message{
+		Cmd:      "msg",
+		Sender:   "server",
+		Data:     mess.Data,
+		Receiver: receiver.Name,
+		Payload:  NewPayload(Payload{Note: &NoteInfo{From: sender, Text: mess.Data}}),
+	}, func(mess Message) {
+		d.Fail(sender, "msg", CodeNotDelivered, fmt.Sprintf("the message to <%s> is not delivered", mess.Receiver))
+	})
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleStatus(cmd Command)
+*****************************************************
+*@brief 设置发送者的状态以及可选的状态说明，返回设置
+结果并通知关注者
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令，Data为 状态/状态说明
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleStatus(cmd Command) {
+	mess := cmd.Mess
+	status := UserStatus{Name: mess.Sender}
+	statusList := strings.SplitN(mess.Data, "/", 2)
+	status.Status = statusList[0]
+	if len(statusList) == 2 {
+		status.Text = statusList[1]
+	}
+	if payload, ok := ParsePayload(mess); ok && payload.Status != nil {
+		status.Status, status.Text = payload.Status.Status, payload.Status.Text
+	}
+	if !ValidStatus(status.Status) {
+		d.Fail(mess.Sender, "status", CodeBadStatus, fmt.Sprintf("unknown status <%s>, use available, away, busy or dnd", status.Status))
+		return
+	}
+	d.Users.Update(mess.Sender, func(user *User) {
+		user.Status = status.Status
+		user.StatusText = status.Text
+	})
+	d.Presence(mess.Sender)
+	data := fmt.Sprintf("your status is %s", status.Status)
+	if status.Text != "" {
+		data += ": " + status.Text
+	}
+	err := d.Outbox.Send(d.Users.GetUser(mess.Sender), Message{
+		Cmd:      "status",
+		Sender:   "server",
+		Data:     data,
+		Receiver: mess.Sender,
+		Payload:  NewPayload(Payload{Status: &status}),
+	})
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) Presence(name string)
+*****************************************************
+*@brief 向关注name的在线用户推送name的当前状态，不在线
+时状态为offline。游客下线后删除其联系人
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：状态变化的用户名
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) Presence(name string) {
+	status := d.StatusOf(name)
+	for _, watcher := range d.Contacts.Watchers(name) {
+		d.SendPresence(watcher, status)
+	}
+	if status.Status == StatusOffline && !d.Accounts.Exists(name) {
+		err := d.Contacts.Forget(name)
+		if err != nil {
+			d.Logger.Printf("ListenMess:%v\n", err)
+		}
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) SendPresence(watcher string, status UserStatus)
+*****************************************************
+*@brief 向关注者发送一条presence通知，Data为
+用户名/状态/状态说明
+*****************************************************
+*@access Public
+*****************************************************
+*@param watcher：关注者
+*@param status：被关注用户的状态
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) SendPresence(watcher string, status UserStatus) {
+	user := d.Users.GetUser(watcher)
+	if user.Name == "" {
+		return
+	}
+	err := d.Outbox.Send(user, Message{
+		Cmd:      "presence",
+		Sender:   "server",
+		Data:     fmt.Sprintf("%s/%s/%s", status.Name, status.Status, status.Text),
+		Receiver: watcher,
+		Payload:  NewPayload(Payload{Status: &status}),
+	})
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) StatusOf(name string) UserStatus
+*****************************************************
+*@brief 获取用户的当前状态
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*****************************************************
+*@return UserStatus：用户状态，不在线时为offline
+*****************************************************/
+func (d *Dispatcher) StatusOf(name string) UserStatus {
+	user := d.Users.GetUser(name)
+	if user.Name == "" || user.Name == "server" {
+		return UserStatus{Name: name, Status: StatusOffline}
+	}
+	return UserStatus{Name: name, Status: user.Status, Text: user.StatusText}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleWatch(cmd Command)
+*****************************************************
+*@brief 关注联系人，之后其上线、下线或者改变状态时收到
+presence通知。Data为空时返回全部联系人的当前状态
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令，Data为联系人用户名
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleWatch(cmd Command) {
+	mess := cmd.Mess
+	if mess.Data == "" {
+		contacts := d.Contacts.List(mess.Sender)
+		statuses := make([]UserStatus, 0, len(contacts))
+		for _, contact := range contacts {
+			statuses = append(statuses, d.StatusOf(contact))
+		}
+		err := d.Outbox.Send(d.Users.GetUser(mess.Sender), Message{
+			Cmd:      "watch",
+			Sender:   "server",
+			Data:     strings.Join(contacts, "/"),
+			Receiver: mess.Sender,
+			Payload:  NewPayload(Payload{List: &UserList{Users: contacts, Statuses: statuses}}),
+		})
+		if err != nil {
+			fmt.Println(err)
+			d.Logger.Printf("ListenMess:%v\n", err)
+		}
+		return
+	}
+	if mess.Data == mess.Sender {
+		d.Fail(mess.Sender, "watch", CodeNotRegistered, "you can not watch yourself")
+		return
+	}
+	if d.StatusOf(mess.Data).Status == StatusOffline && !d.Accounts.Exists(mess.Data) {
+		d.Fail(mess.Sender, "watch", CodeNotRegistered, fmt.Sprintf("the user <%s> is unknown", mess.Data))
+		return
+	}
+	added, err := d.Contacts.Watch(mess.Sender, mess.Data)
+	if err != nil {
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+	if !added {
+		d.Fail(mess.Sender, "watch", CodeBusy, fmt.Sprintf("you are watching <%s> already", mess.Data))
+		return
+	}
+	//关注成功后立即返回联系人的当前状态
+	d.SendPresence(mess.Sender, d.StatusOf(mess.Data))
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleUnwatch(cmd Command)
+*****************************************************
+*@brief 取消关注联系人
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令，Data为联系人用户名
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleUnwatch(cmd Command) {
+	mess := cmd.Mess
+	removed, err := d.Contacts.Unwatch(mess.Sender, mess.Data)
+	if err != nil {
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+	if !removed {
+		d.Fail(mess.Sender, "unwatch", CodeNotWatching, fmt.Sprintf("you are not watching <%s>", mess.Data))
+		return
+	}
+	err = d.Outbox.Send(d.Users.GetUser(mess.Sender), Message{
+		Cmd:      "unwatch",
+		Sender:   "server",
+		Data:     fmt.Sprintf("you stopped watching <%s>", mess.Data),
+		Receiver: mess.Sender,
+	})
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleAdmin(cmd Command)
+*****************************************************
+*@brief 处理管理控制台的一行命令：sessions、kick、ban、
+unban、bans、broadcast、help，结果收集后一次写入cmd.Reply，
+由控制台协程输出
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：admin命令，Data为控制台输入的一行
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleAdmin(cmd Command) {
+	lines := make([]string, 0)
+	defer func() {
+		if cmd.Reply != nil {
+			cmd.Reply <- lines
+		}
+	}()
+	reply := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	d.Logger.Printf("admin:%v\n", cmd.Mess.Data)
+	args := strings.Fields(cmd.Mess.Data)
+	if len(args) == 0 {
+		return
+	}
+	switch args[0] {
+	case "sessions":
+		shelf := d.Users.GetMap()
+		names := make([]string, 0, len(shelf))
+		for name := range shelf {
+			if name != "server" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		reply("%d sessions", len(names))
+		for _, name := range names {
+			user := shelf[name]
+			reply("%s public=%s private=%s beats=%d status=%s peers=%s codec=%s", name, user.PublicAddr, user.Addr, user.BeatCount, user.Status, strings.Join(user.Peers, ","), user.Codec)
+		}
+	case "kick":
+		if len(args) < 2 {
+			reply("usage: kick NAME [REASON]")
+			return
+		}
+		text := "you were kicked by the administrator"
+		if len(args) > 2 {
+			text += ": " + strings.Join(args[2:], " ")
+		}
+		if !d.Kick(args[1], text) {
+			reply("the user <%s> is not online", args[1])
+			return
+		}
+		reply("kicked <%s>", args[1])
+	case "ban":
+		if len(args) < 3 {
+			reply("usage: ban NAME|IP DURATION [REASON]")
+			return
+		}
+		duration, err := time.ParseDuration(args[2])
+		if err != nil || duration <= 0 {
+			reply("invalid duration <%s>, use for example 30m or 2h", args[2])
+			return
+		}
+		until := time.Now().Add(duration)
+		d.Bans.Ban(args[1], until)
+		reply("banned <%s> until %s", args[1], until.Format("2006-01-02 15:04:05"))
+		//踢出被封禁的在线用户，ip按服务器观察到的地址匹配
+		text := fmt.Sprintf("you are banned until %s", until.Format("2006-01-02 15:04:05"))
+		if len(args) > 3 {
+			text += ": " + strings.Join(args[3:], " ")
+		}
+		for name, user := range d.Users.GetMap() {
+			host, _, err := net.SplitHostPort(user.Endpoint())
+			if name != args[1] && (err != nil || host != args[1]) {
+				continue
+			}
+			if d.Kick(name, text) {
+				reply("kicked <%s>", name)
+			}
+		}
+	case "unban":
+		if len(args) != 2 {
+			reply("usage: unban NAME|IP")
+		} else if d.Bans.Unban(args[1]) {
+			reply("unbanned <%s>", args[1])
+		} else {
+			reply("<%s> is not banned", args[1])
+		}
+	case "bans":
+		bans := d.Bans.List()
+		if len(bans) == 0 {
+			reply("there is no ban")
+		}
+		for _, line := range bans {
+			reply("%s", line)
+		}
+	case "broadcast":
+		text := strings.TrimSpace(strings.TrimPrefix(cmd.Mess.Data, "broadcast"))
+		if text == "" {
+			reply("usage: broadcast TEXT")
+			return
+		}
+		count := 0
+		for name, user := range d.Users.GetMap() {
+			if name == "server" {
+				continue
+			}
+			err := d.Outbox.Send(user, Message{
+				Cmd:      "broadcast",
+				Sender:   "server",
+				Data:     text,
+				Receiver: name,
+			})
+			if err != nil {
+				fmt.Println(err)
+				d.Logger.Printf("admin:%v\n", err)
+				continue
+			}
+			count++
+		}
+		reply("sent to %d users", count)
+	case "help":
+		reply("sessions: list online users with their addresses and heartbeats")
+		reply("kick NAME [REASON]: disconnect a user")
+		reply("ban NAME|IP DURATION [REASON]: refuse logins for DURATION, such as 30m, and kick matching users")
+		reply("unban NAME|IP: lift a ban")
+		reply("bans: list active bans")
+		reply("broadcast TEXT: send a notice to every online user")
+		reply("exit: close the console")
+	default:
+		reply("unknown command <%s>, input help", args[0])
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) Kick(name string, text string) bool
+*****************************************************
+*@brief 通知用户被踢出，然后释放用户名，会话对方、房间
+成员与关注者收到通知
+*****************************************************
+*@access Public
+*****************************************************
+*@param name：用户名
+*@param text：告知用户的原因
+*****************************************************
+*@return bool：用户是否在线
+*****************************************************/
+func (d *Dispatcher) Kick(name string, text string) bool {
+	user := d.Users.GetUser(name)
+	if user.Name == "" || user.Name == "server" {
+		return false
+	}
+	err := d.Outbox.Send(user, Message{
+		Cmd:      "kick",
+		Sender:   "server",
+		Data:     text,
+		Receiver: name,
+	})
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("admin:%v\n", err)
+	}
+	if d.Users.Release(name, d.Outbox) {
+		d.Logger.Printf("user %v kicked\n", name)
+		d.Presence(name)
+	}
+	return true
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleChat(cmd Command)
+*****************************************************
+*@brief 中转模式下向会话对方转发消息，并记录会话
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleChat(cmd Command) {
+	mess := cmd.Mess
+	//中转模式，按Receiver转发给会话中的对方
+	receiver := d.Users.GetUser(mess.Receiver)
+	if receiver.Name == "" {
+		d.Fail(mess.Sender, "chat", CodeNotOnline, fmt.Sprintf("the user <%s> is not online", mess.Receiver))
+		return
+	} else if !receiver.TalkingWith(mess.Sender) {
+		d.Fail(mess.Sender, "chat", CodeNotTalking, fmt.Sprintf("you are not talking with <%s>", mess.Receiver))
+		return
+	}
+	err := d.Outbox.Send(receiver, mess)
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+	err = d.History.Append(Record{
+		Time:     time.Now(),
+		Sender:   mess.Sender,
+		Receiver: mess.Receiver,
+		Data:     mess.Data,
+		Nonce:    mess.Nonce,
+	})
+	if err != nil {
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleHistory(cmd Command)
+*****************************************************
+*@brief 向发送者返回中转会话记录
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleHistory(cmd Command) {
+	mess := cmd.Mess
+	//mess.Data格式为：对方用户名/条数，逐条返回，最后由server返回条数
+	historyList := strings.Split(mess.Data, "/")
+	n := 20
+	if len(historyList) == 2 {
+		count, err := strconv.Atoi(historyList[1])
+		if err == nil && count > 0 {
+			n = count
+		}
+	}
+	//一次最多返回100条
+	if n > 100 {
+		n = 100
+	}
+	records, err := d.History.Last(mess.Sender, historyList[0], n)
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+	sender := d.Users.GetUser(mess.Sender)
+	for _, record := range records {
+		err = d.Outbox.Send(sender, Message{
+			Cmd:      "history",
+			Sender:   record.Sender,
+			Data:     fmt.Sprintf("%s/%s", record.Time.Format("2006-01-02 15:04:05"), record.Data),
+			Receiver: record.Receiver,
+			Nonce:    record.Nonce,
+		})
+		if err != nil {
+			fmt.Println(err)
+			d.Logger.Printf("ListenMess:%v\n", err)
+		}
+	}
+	err = d.Outbox.Send(sender, Message{
+		Cmd:      "history",
+		Sender:   "server",
+		Data:     fmt.Sprintf("%d", len(records)),
+		Receiver: historyList[0],
+	})
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleJoin(cmd Command)
+*****************************************************
+*@brief 加入群聊房间，并通知房间内成员。只能加入自己，
+其他被邀请的成员收到邀请后自行加入
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleJoin(cmd Command) {
+	mess := cmd.Mess
+	//优先读取Payload中的房间信息，旧客户端的mess.Data包含：1.房间名；2.可选的邀请成员
+	joinList := strings.Split(mess.Data, "/")
+	room, invited := joinList[0], joinList[1:]
+	if payload, flag := ParsePayload(mess); flag && payload.Room != nil {
+		room, invited = payload.Room.Name, payload.Room.Members
+	}
+	if room == "" || d.Users.GetUser(mess.Sender).Name == "" {
+		return
+	}
+	//只有发起者加入房间，被邀请的在线成员收到邀请，自行join后才加入
+	for _, name := range invited {
+		if name == "" || name == mess.Sender {
+			continue
+		}
+		if name == "server" || d.Users.GetUser(name).Name == "" {
+			d.Fail(mess.Sender, "join", CodeNotOnline, fmt.Sprintf("the user <%s> is not online", name))
+			continue
+		}
+		err := d.Outbox.Send(d.Users.GetUser(name), Message{
+			Cmd:      "join",
+			Sender:   "server",
+			Data:     fmt.Sprintf("%s invites you to room <%s>, use join %s to enter", mess.Sender, room, room),
+			Receiver: name,
+		})
+		if err != nil {
+			fmt.Println(err)
+			d.Logger.Printf("ListenMess:%v\n", err)
+		}
+	}
+	//已在房间中的发起者也需要收到通知，以便重新进入群聊
+	d.Users.JoinRoom(room, mess.Sender)
+	//通知房间内所有成员新成员加入，Sender为新成员
+	members := d.Users.RoomMembers(room)
+	for _, member := range members {
+		err := d.Outbox.Send(d.Users.GetUser(member), Message{
+			Cmd:      "join",
+			Sender:   mess.Sender,
+			Data:     fmt.Sprintf("%s/%s", room, strings.Join(members, "/")),
+			Receiver: member,
+			Payload:  NewPayload(Payload{Room: &RoomInfo{Name: room, Members: members}}),
+		})
+		if err != nil {
+			fmt.Println(err)
+			d.Logger.Printf("ListenMess:%v\n", err)
+		}
+	}
+}
+
+/****************************************************
+*@function func (d *Dispatcher) HandleLeave(cmd Command)
+*****************************************************
+*@brief 离开群聊房间，并通知房间内成员
+*****************************************************
+*@access Public
+*****************************************************
+*@param cmd：客户端发来的命令
+*****************************************************
+*@return 无
+*****************************************************/
+func (d *Dispatcher) HandleLeave(cmd Command) {
+	mess := cmd.Mess
+	if !d.Users.LeaveRoom(mess.Data, mess.Sender) {
+		return
+	}
+	//通知离开者以及房间内剩余成员
+	for _, member := range append([]string{mess.Sender}, d.Users.RoomMembers(mess.Data)...) {
+		err := d.Outbox.Send(d.Users.GetUser(member), Message{
+			Cmd:      "leave",
+			Sender:   mess.Sender,
+			Data:     mess.Data,
+			Receiver: member,
+		})
+		if err != nil {
+			fmt.Println(err)
+			d.Logger.Printf("ListenMess:%v\n", err)
+		}
+	}
 }
 
 /****************************************************
-*@brief 定义在线用户存储结构
+*@function func (d *Dispatcher) HandleRooms(cmd Command)
+*****************************************************
+*@brief 向发送者返回所有群聊房间
+*****************************************************
+*@access Public
 *****************************************************
-*@param shelf：存储结构
+*@param cmd：客户端发来的命令
+*****************************************************
+*@return 无
 *****************************************************/
-type Store struct {
-	shelf map[string]User
+func (d *Dispatcher) HandleRooms(cmd Command) {
+	mess := cmd.Mess
+	//每个房间格式为 房间名:成员1,成员2
+	strList := make([]string, 0)
+	roomList := RoomList{Rooms: make([]RoomInfo, 0)}
+	for room, members := range d.Users.GetRooms() {
+		strList = append(strList, fmt.Sprintf("%s:%s", room, strings.Join(members, ",")))
+		roomList.Rooms = append(roomList.Rooms, RoomInfo{Name: room, Members: members})
+	}
+	err := d.Outbox.Send(d.Users.GetUser(mess.Sender), Message{
+		Cmd:      "rooms",
+		Sender:   "server",
+		Data:     strings.Join(strList, "/"),
+		Receiver: mess.Sender,
+		Payload:  NewPayload(Payload{Rooms: &roomList}),
+	})
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+		return
+	}
 }
 
 /****************************************************
-*@function (s *Store) Sort(logger *log.Logger)
+*@function func (d *Dispatcher) HandleRoomChat(cmd Command)
 *****************************************************
-*@brief 定时对在线用户进行心跳检查，
+*@brief 向房间内其他成员转发群聊消息
 *****************************************************
 *@access Public
 *****************************************************
-*@param logger *log.Logger:日志文件
+*@param cmd：客户端发来的命令
 *****************************************************
 *@return 无
 *****************************************************/
-func (s *Store) Sort(logger *log.Logger) {
-	timer := time.NewTimer(2 * time.Second)
-	for {
-		select {
-		case <-timer.C:
-			{
-				logger.Printf("online users:%v", s.shelf)
-				for tempName, tempUser := range s.shelf {
-					if tempName != "server" {
-						if tempUser.BeatCount <= 1 {
-							if tempUser.RemoteName != "server" {
-								remoteAddr, err := net.ResolveUDPAddr("udp", s.shelf[tempUser.RemoteName].Addr)
-								if err != nil {
-									fmt.Println(err)
-									logger.Printf("sort:%v", err)
-								}
-								quitConn, err := net.DialUDP("udp", nil, remoteAddr)
-								if err != nil {
-									fmt.Println(err)
-									logger.Printf("sort:%v", err)
-								}
-								defer quitConn.Close()
-								encoder := json.NewEncoder(quitConn)
-								mess := Message{
-									Cmd:      "quit",
-									Sender:   "server",
-									Data:     "",
-									Receiver: tempUser.RemoteName,
-								}
-								err = encoder.Encode(mess)
-								if err != nil {
-									fmt.Println(err)
-									logger.Printf("sort:%v", err)
-								}
-							}
-							s.Delete(tempName)
-							tempUser = s.shelf[tempUser.RemoteName]
-							s.shelf[tempUser.RemoteName] = User{
-								Name:       tempUser.Name,
-								Addr:       tempUser.Addr,
-								RemoteName: "server",
-								BeatCount:  tempUser.BeatCount,
-							}
-						} else {
-							s.shelf[tempName] = User{
-								Name:       tempUser.Name,
-								Addr:       tempUser.Addr,
-								RemoteName: tempUser.RemoteName,
-								BeatCount:  0,
-							}
-						}
-					}
-				}
-			}
+func (d *Dispatcher) HandleRoomChat(cmd Command) {
+	mess := cmd.Mess
+	//群聊消息，Receiver为房间名，转发给房间内其他成员
+	members := d.Users.RoomMembers(mess.Receiver)
+	isMember := false
+	for _, member := range members {
+		if member == mess.Sender {
+			isMember = true
+		}
+	}
+	if !isMember {
+		d.Fail(mess.Sender, "roomchat", CodeNotInRoom, fmt.Sprintf("you are not in the room <%s>", mess.Receiver))
+		return
+	}
+	for _, member := range members {
+		if member == mess.Sender {
+			continue
+		}
+		err := d.Outbox.Send(d.Users.GetUser(member), mess)
+		if err != nil {
+			fmt.Println(err)
+			d.Logger.Printf("ListenMess:%v\n", err)
 		}
-		timer.Reset(3 * time.Second)
 	}
 }
 
 /****************************************************
-*@function func (s *Store) Add(name string, user User)
+*@function func (d *Dispatcher) Confirm(mess Message)
 *****************************************************
-*@brief 添加到在线用户组
+*@brief 向发送者回复ack，确认收到需要确认的请求
 *****************************************************
 *@access Public
 *****************************************************
-*@param name：用户名
-*@param user:详细用户信息
+*@param mess：收到的请求，ID非空
 *****************************************************
 *@return 无
 *****************************************************/
-func (s *Store) Add(name string, user User) {
-	s.shelf[name] = user
+func (d *Dispatcher) Confirm(mess Message) {
+	err := d.Outbox.Send(d.Users.GetUser(mess.Sender), Message{
+		Cmd:      "ack",
+		Sender:   "server",
+		Data:     mess.ID,
+		Receiver: mess.Sender,
+	})
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
+	}
 }
 
 /****************************************************
-*@function func (s *Store) Change(name string, user User)
+*@function func (d *Dispatcher) HandleAck(cmd Command)
 *****************************************************
-*@brief 修改在线用户组中的某个用户
+*@brief 收到确认。Receiver为server时确认服务器发出的
+消息，否则是中转会话中对方的确认，转发给原发送者
 *****************************************************
 *@access Public
 *****************************************************
-*@param name：用户名
-*@param user:详细用户信息
+*@param cmd：客户端发来的命令，Data为消息ID
 *****************************************************
 *@return 无
 *****************************************************/
-func (s *Store) Change(name string, user User) {
-	_, flag := s.shelf[name]
-	if flag {
-		s.shelf[name] = user
+func (d *Dispatcher) HandleAck(cmd Command) {
+	mess := cmd.Mess
+	if mess.Receiver == "server" {
+		d.Acks.Ack(mess.Data)
+		return
+	}
+	receiver := d.Users.GetUser(mess.Receiver)
+	if receiver.Name == "" {
+		return
+	}
+	err := d.Outbox.Send(receiver, mess)
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
 	}
 }
 
 /****************************************************
-*@function func (s *Store) Delete(name string, user User)
+*@function func (d *Dispatcher) Undelivered(mess Message)
 *****************************************************
-*@brief 删除在线用户组中的某个用户
+*@brief 服务器发出的消息重传用尽，放入undelivered命令，
+由分发器处理，可在任意协程中调用，附带原消息的Payload
 *****************************************************
 *@access Public
 *****************************************************
-*@param name：用户名
+*@param mess：未送达的消息
 *****************************************************
 *@return 无
 *****************************************************/
-func (s *Store) Delete(name string) {
-	delete(s.shelf, name)
+func (d *Dispatcher) Undelivered(mess Message) {
+	d.Push(Command{Mess: Message{
+		Cmd:      "undelivered",
+		Sender:   "server",
+		Data:     fmt.Sprintf("%s/%s", mess.Cmd, mess.Receiver),
+		Receiver: "server",
+		Payload:  mess.Payload,
+	}})
 }
 
 /****************************************************
-*@function func (s *Store) Beat(name string, user User)
+*@function func (d *Dispatcher) HandleUndelivered(cmd Command)
 *****************************************************
-*@brief 在线用户组中的某个用户接收心跳
+*@brief 处理未送达的消息。邀请未送达时取消邀请，会话
+通知未送达时结束半开的会话，并通知会话另一方
 *****************************************************
 *@access Public
 *****************************************************
-*@param name：用户名
+*@param cmd：undelivered命令，Data为 命令/接收者，Payload为原消息的Payload
 *****************************************************
 *@return 无
 *****************************************************/
-func (s *Store) Beat(name string) {
-	tempCell, flag := s.shelf[name]
-	if flag == true {
-		s.shelf[name] = User{
-			Name:       tempCell.Name,
-			Addr:       tempCell.Addr,
-			RemoteName: tempCell.RemoteName,
-			BeatCount:  tempCell.BeatCount + 1,
+func (d *Dispatcher) HandleUndelivered(cmd Command) {
+	undeliveredList := strings.SplitN(cmd.Mess.Data, "/", 2)
+	if len(undeliveredList) != 2 {
+		return
+	}
+	name := undeliveredList[1]
+	fmt.Printf("%s is not delivered to %s\n", undeliveredList[0], name)
+	d.Logger.Printf("ListenMess %v not delivered to %v\n", undeliveredList[0], name)
+	if undeliveredList[0] == "invite" {
+		//邀请无法送达，取消邀请并告知发起者
+		for _, invite := range d.Users.DropInvites(name) {
+			if invite.To == name {
+				d.Fail(invite.From, "group", CodeNotDelivered, fmt.Sprintf("the user <%s> can not be reached", name))
+			}
 		}
+		return
+	}
+	if undeliveredList[0] != "group" {
+		return
+	}
+	//会话通知中的Offer记录了会话另一方
+	payload, ok := ParsePayload(cmd.Mess)
+	if !ok || payload.Offer == nil {
+		return
+	}
+	remoteName := payload.Offer.Name
+	if !d.Users.Disconnect(name, remoteName) {
+		return
+	}
+	d.Fail(remoteName, "group", CodeNotDelivered, fmt.Sprintf("the user <%s> can not be reached", name))
+	err := d.Outbox.SendReliable(d.Users.GetUser(remoteName), Message{
+		Cmd:      "quit",
+		Sender:   "server",
+		Data:     name,
+		Receiver: remoteName,
+	}, nil)
+	if err != nil {
+		fmt.Println(err)
+		d.Logger.Printf("ListenMess:%v\n", err)
 	}
 }
 
 /****************************************************
-*@function func (s *Store) GetUser(name string) User
-*****************************************************
-*@brief 输出在线用户组中的某个用户
-*****************************************************
-*@access Public
-*****************************************************
-*@param name：用户名
+*@brief 定义服务器配置，来自命令行参数以及可选的json
+配置文件，命令行参数优先
 *****************************************************
-*@return User：用户详细信息
+*@param LoginAddr：tcp登录监听地址
+*@param ListenAddr：udp消息监听地址
+*@param LogFile：日志文件
+*@param OnlineLog：在线用户日志文件
+*@param CheckInterval：心跳检查周期
+*@param MinBeats：每个检查周期至少收到的心跳数
+*@param Welcome：登录欢迎介绍
+*@param AccountsFile：注册账号文件
+*@param AllowGuest：是否允许游客登录
+*@param TLSCert、TLSKey：登录端口证书与私钥
+*@param TLSDev：是否生成开发用自签名证书
+*@param MailboxDir：离线留言目录
+*@param MailQuota：每个用户最多保存的留言数
+*@param HistoryDir：中转会话记录目录
+*@param ContactsDir：联系人目录
+*@param StoreFile：在线用户快照文件，为空时只保存在内存中
+*@param OutQueue：每个接收地址的发送队列长度
+*@param Retries：需要确认的消息最多重传次数
+*@param AckWait：第一次重传前等待确认的时间，之后每次加倍
+*@param FragWait：一条分片消息收齐的最长时间
+*@param FragMemory：未收齐的分片最多占用的字节数
+*@param FragSource：每个来源地址未收齐的分片最多占用的字节数
+*@param InviteWait：会话邀请的有效时间
+*@param AdminAddr：管理控制台监听地址，回环tcp地址或者
+unix:socket路径，为空时不开启
 *****************************************************/
-func (s *Store) GetUser(name string) User {
-	return s.shelf[name]
+type Config struct {
+	LoginAddr     string
+	ListenAddr    string
+	LogFile       string
+	OnlineLog     string
+	CheckInterval time.Duration
+	MinBeats      int
+	Welcome       string
+	AccountsFile  string
+	AllowGuest    bool
+	TLSCert       string
+	TLSKey        string
+	TLSDev        bool
+	MailboxDir    string
+	MailQuota     int
+	HistoryDir    string
+	ContactsDir   string
+	StoreFile     string
+	OutQueue      int
+	Retries       int
+	AckWait       time.Duration
+	FragWait      time.Duration
+	FragMemory    int
+	FragSource    int
+	InviteWait    time.Duration
+	AdminAddr     string
 }
 
 /****************************************************
-*@function func (s *Store) GetMap()
+*@function NewConfig(args []string) (*Config, error)
 *****************************************************
-*@brief 输出在线用户组
+*@brief 解析命令行参数，-config指定的配置文件补充
+命令行未给出的参数，最后校验配置
 *****************************************************
 *@access Public
 *****************************************************
-*@param name：无
+*@param args：命令行参数，不含程序名
 *****************************************************
-*@return User：在线用户组
+*@return *Config：服务器配置
+*@return error：参数或配置文件错误原因
 *****************************************************/
-func (s *Store) GetMap() map[string]User {
-	return s.shelf
+func NewConfig(args []string) (*Config, error) {
+	config := new(Config)
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	configFile := fs.String("config", "", "optional json config file, keys are the flag names")
+	fs.StringVar(&config.LoginAddr, "login", "172.16.18.163:8080", "tcp login listen address")
+	fs.StringVar(&config.ListenAddr, "listen", "172.16.18.163:8081", "udp message listen address")
+	fs.StringVar(&config.LogFile, "log", "log.txt", "log file")
+	fs.StringVar(&config.OnlineLog, "onlinelog", "onlineusers.txt", "online users log file")
+	fs.DurationVar(&config.CheckInterval, "check", 3*time.Second, "heartbeat check interval")
+	fs.IntVar(&config.MinBeats, "minbeats", 2, "heartbeats required per check interval before a user times out")
+	fs.StringVar(&config.Welcome, "welcome", "welcome to use this communication app\ninput \"register NAME PASSWORD\" to create an account, \"login NAME PASSWORD\" to login, or just NAME to login as a guest\nplease do not use these words:\n1:list;  2:group;  3.quit;  4.join;  5.leave;  6.rooms;  7.mode;  8.register;  9.login;  10.mail;  11.history;  12.logout;  13.accept;  14.decline;  15.switch;  16.msg;  17.status;  18.watch;  19.unwatch\n", "welcome text sent at login")
+	fs.StringVar(&config.AccountsFile, "accounts", "accounts.txt", "registered accounts file")
+	fs.BoolVar(&config.AllowGuest, "guest", true, "allow guest logins without a password")
+	fs.StringVar(&config.TLSCert, "tlscert", "", "tls certificate for the login listener, or the output path with -tlsdev")
+	fs.StringVar(&config.TLSKey, "tlskey", "", "tls private key for the login listener")
+	fs.BoolVar(&config.TLSDev, "tlsdev", false, "generate a self-signed development certificate")
+	fs.StringVar(&config.MailboxDir, "mailbox", "mailbox", "offline mailbox directory")
+	fs.IntVar(&config.MailQuota, "mailquota", 100, "offline messages kept per user")
+	fs.StringVar(&config.HistoryDir, "history", "history", "relayed chat history directory")
+	fs.StringVar(&config.ContactsDir, "contacts", "contacts", "watched contacts directory")
+	fs.StringVar(&config.StoreFile, "store", "", "snapshot file for online users, empty keeps them in memory only")
+	fs.IntVar(&config.OutQueue, "outqueue", 64, "outbound queue length per receiver, in messages")
+	fs.IntVar(&config.Retries, "retries", 4, "how many times an unacknowledged group or quit notice is resent")
+	fs.DurationVar(&config.AckWait, "ackwait", 300*time.Millisecond, "how long to wait for an ack before the first resend, doubled on each resend")
+	fs.DurationVar(&config.FragWait, "fragwait", 5*time.Second, "how long the fragments of a long message may take to arrive")
+	fs.IntVar(&config.FragMemory, "fragmemory", 16<<20, "bytes of incomplete fragments kept for all clients together")
+	fs.IntVar(&config.FragSource, "fragsource", 2<<20, "bytes of incomplete fragments kept for one source address")
+	fs.DurationVar(&config.InviteWait, "invitewait", 30*time.Second, "how long a conversation invitation waits to be accepted")
+	fs.StringVar(&config.AdminAddr, "admin", "", "admin console address, a loopback tcp address or unix:PATH, empty disables it")
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if *configFile != "" {
+		err = LoadConfigFile(fs, *configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, config.Validate()
 }
 
 /****************************************************
-*@function NewStore (s *Store) Store
+*@function LoadConfigFile(fs *flag.FlagSet, path string) error
 *****************************************************
-*@brief 新建一个在线用户组
+*@brief 读取json配置文件，键为参数名，只设置命令行
+中未给出的参数
 *****************************************************
 *@access Public
 *****************************************************
-*@param name：无
+*@param fs：已解析的命令行参数
+*@param path：配置文件路径
 *****************************************************
-*@return User：在线用户组
+*@return error：读取失败、未知参数或参数值错误的原因
 *****************************************************/
-func NewStore() Store {
-	data := make(map[string]User)
-	temp := new(Store)
-	temp.shelf = data
-	//加上对仓库的定时整理
-	file, err := os.OpenFile("onlineusers.txt", os.O_APPEND, 0666)
+func LoadConfigFile(fs *flag.FlagSet, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	values := make(map[string]interface{})
+	//数字保留原文交给flag解析，避免大数被格式化为科学计数法
+	decoder := json.NewDecoder(file)
+	decoder.UseNumber()
+	err = decoder.Decode(&values)
+	if err == nil && decoder.More() {
+		err = errors.New("unexpected data after the settings")
+	}
 	if err != nil {
-		file, err = os.Create("onlineusers.txt")
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for name, value := range values {
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s: unknown setting %q", path, name)
+		}
+		if given[name] {
+			continue
+		}
+		err = fs.Set(name, fmt.Sprint(value))
 		if err != nil {
-			fmt.Println(err)
+			return fmt.Errorf("%s: %s: %v", path, name, err)
 		}
 	}
-
-	year, month, day := time.Now().Date()
-	logger := log.New(file, fmt.Sprintf("R:%v-%v-%v:", year, month, day), log.Ltime)
-	go temp.Sort(logger)
-	return *temp
+	return nil
 }
 
 /****************************************************
-*@function Login(loginPort, listenPort,beatPort string, userCh chan User)
+*@function func (c *Config) Validate() error
 *****************************************************
-*@brief 服务器开启登录服务，获取user远程端口、发送welcome
-*		介绍，返回已登录用户的信息
-		向chat监听端口发送用户信息，保证登录用户的同步性
+*@brief 校验服务器配置
 *****************************************************
 *@access Public
 *****************************************************
-*@param loginPort string 登陆认证端口号
-*@param listenPort string 监听端口号
-*@param userCh chan User 用户类型channel
+*@param 无
 *****************************************************
-*@return 无
+*@return error：第一个错误配置的原因
 *****************************************************/
-func Login(loginPort, listenPort string, userCh chan User, logger *log.Logger) {
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	//创建map
-	UserMap := make(map[string]User)
-	UserMap["server"] = User{
-		Name:       "server",
-		Addr:       listenPort,
-		RemoteName: "server",
-		BeatCount:  2,
+func (c *Config) Validate() error {
+	_, err := net.ResolveTCPAddr("tcp", c.LoginAddr)
+	if err != nil {
+		return fmt.Errorf("login: invalid address %q: %v", c.LoginAddr, err)
 	}
-	//开启登录监听端口
-	loginService, err := net.Listen("tcp", loginPort)
+	_, err = net.ResolveUDPAddr("udp", c.ListenAddr)
 	if err != nil {
-		fmt.Println(err)
-		logger.Printf("login:%v\n", err)
+		return fmt.Errorf("listen: invalid address %q: %v", c.ListenAddr, err)
 	}
-	fmt.Println("login listener setted successfully")
-	for {
-		//接收tcp连接
-		loginConn, err := loginService.Accept()
+	if c.LogFile == "" || c.OnlineLog == "" {
+		return errors.New("log, onlinelog: log files can not be empty")
+	}
+	if c.CheckInterval <= 0 {
+		return fmt.Errorf("check: interval must be positive, got %v", c.CheckInterval)
+	}
+	if c.MinBeats < 1 {
+		return fmt.Errorf("minbeats: must be at least 1, got %d", c.MinBeats)
+	}
+	if strings.TrimSpace(c.Welcome) == "" {
+		return errors.New("welcome: text can not be empty")
+	}
+	if c.AccountsFile == "" || c.MailboxDir == "" || c.HistoryDir == "" || c.ContactsDir == "" {
+		return errors.New("accounts, mailbox, history, contacts: paths can not be empty")
+	}
+	if !c.TLSDev && (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tlscert, tlskey: both or neither must be given")
+	}
+	if c.MailQuota < 1 {
+		return fmt.Errorf("mailquota: must be at least 1, got %d", c.MailQuota)
+	}
+	if c.OutQueue < 1 {
+		return fmt.Errorf("outqueue: must be at least 1, got %d", c.OutQueue)
+	}
+	if c.Retries < 0 || c.Retries > MaxRetries {
+		return fmt.Errorf("retries: must be between 0 and %d, got %d", MaxRetries, c.Retries)
+	}
+	if c.AckWait <= 0 || c.AckWait > MaxAckWait {
+		return fmt.Errorf("ackwait: must be positive and at most %v, got %v", MaxAckWait, c.AckWait)
+	}
+	if c.FragWait <= 0 {
+		return fmt.Errorf("fragwait: must be positive, got %v", c.FragWait)
+	}
+	if c.FragMemory < MaxMessageSize {
+		return fmt.Errorf("fragmemory: must be at least %d, got %d", MaxMessageSize, c.FragMemory)
+	}
+	if c.FragSource < MaxMessageSize || c.FragSource > c.FragMemory {
+		return fmt.Errorf("fragsource: must be between %d and fragmemory, got %d", MaxMessageSize, c.FragSource)
+	}
+	if c.InviteWait <= 0 {
+		return fmt.Errorf("invitewait: must be positive, got %v", c.InviteWait)
+	}
+	//管理控制台没有认证，只能在本机访问
+	if c.AdminAddr == "unix:" {
+		return errors.New("admin: the socket path can not be empty")
+	}
+	if c.AdminAddr != "" && !strings.HasPrefix(c.AdminAddr, "unix:") {
+		host, _, err := net.SplitHostPort(c.AdminAddr)
 		if err != nil {
-			fmt.Println(err)
-			logger.Printf("login:%v\n", err)
+			return fmt.Errorf("admin: invalid address %q: %v", c.AdminAddr, err)
+		}
+		ip := net.ParseIP(host)
+		if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("admin: must be a loopback address or unix:PATH, got %q", c.AdminAddr)
 		}
-		defer loginConn.Close()
-		//处理登录请求
-		go func(conn net.Conn, ch chan User) {
-			//关闭连接
-			defer conn.Close()
-			//声明用户、消息以及json解码编码接口
-			var mess Message
-			var user User
-			decoder := json.NewDecoder(conn)
-			encoder := json.NewEncoder(conn)
-			//json解码，收到login请求
-			err = decoder.Decode(&mess)
-			if err != nil {
-				fmt.Println(err)
-				logger.Printf("login:%v\n", err)
-			}
-			fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mess.Cmd, mess.Data, mess.Sender, mess.Receiver)
-			user.Addr = mess.Data
-			//发送chat端口
-			mess = Message{
-				Cmd:      "connect",
-				Sender:   conn.LocalAddr().String(),
-				Data:     listenPort,
-				Receiver: conn.RemoteAddr().String(),
-			}
-			//fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mess.Cmd, mess.Data, mess.Sender, mess.Receiver)
-			err = encoder.Encode(mess)
-			if err != nil {
-				fmt.Println(err)
-				logger.Printf("login:%v\n", err)
-			}
-			//发送welcome、介绍
-			mess = Message{
-				Cmd:      "login",
-				Sender:   conn.LocalAddr().String(),
-				Data:     "welcome to use this communication app,input your name to login\nplease do not use these words:\n1:list;  2:group;  3.quit\n",
-				Receiver: conn.RemoteAddr().String(),
-			}
-			//fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mess.Cmd, mess.Data, mess.Sender, mess.Receiver)
-			err = encoder.Encode(mess)
-			if err != nil {
-				fmt.Println(err)
-				logger.Printf("login:%v\n", err)
-				conn.Close()
-			}
-			flag := true
-			//如果一直输入不对，一直处于监听状态
-			for flag {
-				//获取客户端输入的用户名
-				err = decoder.Decode(&mess)
-				if err != nil {
-					fmt.Println(err)
-					logger.Printf("login:%v\n", err)
-					conn.Close()
-					break
-				}
-				fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mess.Cmd, mess.Data, mess.Sender, mess.Receiver)
-				//校验用户名是否被占用
-				//如果被占用，提示重新输入
-				if "" != UserMap[mess.Data].Name {
-					mess = Message{
-						Cmd:      "login",
-						Sender:   conn.LocalAddr().String(),
-						Data:     "fail",
-						Receiver: conn.RemoteAddr().String(),
-					}
-				} else {
-					user.Name = mess.Data
-					user.RemoteName = "server"
-					user.BeatCount = 2
-					UserMap[user.Name] = user
-					mess = Message{
-						Cmd:      "login",
-						Sender:   "server",
-						Data:     "success",
-						Receiver: user.Name,
-					}
-					flag = false
-				}
-				//fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mes.Cmd, mes.Data, mes.Sender, mes.Receiver)
-				err = encoder.Encode(mess)
-				if err != nil {
-					fmt.Println(err)
-					logger.Printf("login:%v\n", err)
-					conn.Close()
-					break
-				}
-			}
-			logger.Printf("user %v login\n", user)
-			ch <- user
-		}(loginConn, userCh)
 	}
+	return nil
 }
 
 /****************************************************
-*@function ListenMess(listenPort string, userCh chan User, logger *log.Logger)
+*@function OpenLog(path string) *log.Logger
 *****************************************************
-*@brief 开启本地消息监听
+*@brief 以追加方式打开日志文件，文件不存在时创建，
+打开失败时输出到标准错误
 *****************************************************
 *@access Public
 *****************************************************
-*@param listenPort：监听端口
-*@param userCh：用户注册进程
-*@param logger：日志文件
+*@param path：日志文件路径
 *****************************************************
-*@return 无
+*@return *log.Logger：日志接口
 *****************************************************/
-func ListenMess(listenPort string, userCh chan User, logger *log.Logger) {
+func OpenLog(path string) *log.Logger {
+	year, month, day := time.Now().Date()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		fmt.Println(err)
+		return log.New(os.Stderr, fmt.Sprintf("R:%v-%v-%v:", year, month, day), log.Ltime)
+	}
+	return log.New(file, fmt.Sprintf("R:%v-%v-%v:", year, month, day), log.Ltime)
+}
+
+func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	onLineUsers := NewStore()
-	server := User{
-		Name:       "server",
-		Addr:       listenPort,
-		RemoteName: "server",
-		BeatCount:  2,
+	config, err := NewConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
 	}
-	onLineUsers.Add("server", server)
-	udpAddr, err := net.ResolveUDPAddr("udp", listenPort)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger := OpenLog(config.LogFile)
+	accounts, err := NewAccounts(config.AccountsFile)
 	if err != nil {
 		fmt.Println(err)
-		logger.Printf("ListenMess:%v\n", err)
+		logger.Fatalf("accounts:%v\n", err)
 	}
-	fmt.Println("chat listener setted successfully")
-	conn, err := net.ListenUDP("udp", udpAddr)
+	//登录端口TLS，证书与私钥为空时使用明文tcp，TLSDev生成自签名证书
+	tlsConfig, err := LoadTLSConfig(config.TLSCert, config.TLSKey, config.TLSDev, config.LoginAddr)
 	if err != nil {
 		fmt.Println(err)
-		logger.Printf("ListenMess:%v\n", err)
+		logger.Fatalf("tls:%v\n", err)
 	}
-	decoder := json.NewDecoder(conn)
-	for {
-		select {
-		case tempUser := <-userCh:
-			{
-				fmt.Println("-------------------new User from login-----------------")
-				logger.Printf("ListenMess insert new user:%v\n", tempUser)
-				onLineUsers.Add(tempUser.Name, tempUser)
-			}
-		default:
-			{
-				var mess Message
-				err := decoder.Decode(&mess)
-				if err != nil {
-					fmt.Println(err)
-					logger.Printf("ListenMess:%v\n", err)
-					continue
-				}
-				if mess.Cmd != "beat" {
-					fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mess.Cmd, mess.Data, mess.Sender, mess.Receiver)
-					logger.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mess.Cmd, mess.Data, mess.Sender, mess.Receiver)
-				}
-				switch mess.Cmd {
-				case "beat":
-					{
-						onLineUsers.Beat(mess.Sender)
-					}
-				case "list":
-					{
-						tempUser := onLineUsers.GetUser(mess.Sender)
-						fmt.Println(tempUser)
-						remoteUdpAddr, err := net.ResolveUDPAddr("udp", tempUser.Addr)
-						if err != nil {
-							fmt.Println(err)
-							logger.Printf("ListenMess:%v\n", err)
-							continue
-						}
-						remoteUdpConn, err := net.DialUDP("udp", nil, remoteUdpAddr)
-						defer remoteUdpConn.Close()
-						if err != nil {
-							fmt.Println(err)
-							logger.Printf("ListenMess:%v\n", err)
-							continue
-						}
-						fmt.Println(remoteUdpConn.RemoteAddr())
-						encoder := json.NewEncoder(remoteUdpConn)
-						strList := make([]string, 0)
-						/*
-							修改
-						*/
-						for tempName, _ := range onLineUsers.GetMap() {
-							if tempName != "server" {
-								tempList := append(strList, tempName)
-								strList = tempList
-							}
-						}
-						mess = Message{
-							Cmd:      "list",
-							Sender:   "server",
-							Data:     strings.Join(strList[0:], "/"),
-							Receiver: mess.Sender,
-						}
-						err = encoder.Encode(mess)
-						if err != nil {
-							fmt.Println(err)
-							logger.Printf("ListenMess:%v\n", err)
-							continue
-						}
-					}
-				case "group":
-					{
-						//fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mess.Cmd, mess.Data, mess.Sender, mess.Receiver)
-						//读取会话的对方的信息
-						if onLineUsers.GetUser(mess.Data).Name != "" {
-							//被动方在线
-							if onLineUsers.GetUser(mess.Data).RemoteName != "server" {
-								//被动方已经建立group会话
-								remoteUdpAddr, err := net.ResolveUDPAddr("udp", onLineUsers.GetUser(mess.Sender).Addr)
-								if err != nil {
-									fmt.Println(err)
-									continue
-								}
-								remoteUdpConn, err := net.DialUDP("udp", nil, remoteUdpAddr)
-								defer remoteUdpConn.Close()
-								if err != nil {
-									fmt.Println(err)
-									logger.Printf("ListenMess:%v\n", err)
-									continue
-								}
-								encoder := json.NewEncoder(remoteUdpConn)
-								mess = Message{
-									Cmd:      "group",
-									Sender:   "server",
-									Data:     fmt.Sprintf("the user <%s> is chatting with other people", mess.Data),
-									Receiver: mess.Receiver,
-								}
-								err = encoder.Encode(mess)
-								if err != nil {
-									fmt.Println(err)
-									logger.Printf("ListenMess:%v\n", err)
-									continue
-								}
-							} else {
-								//被动方未建立group会话，建立会话
-								clientUdpAddrs := make([]string, 0)
-								tempList := append(clientUdpAddrs, onLineUsers.GetUser(mess.Data).Name, onLineUsers.GetUser(mess.Data).Addr)
-								fmt.Println(tempList)
-								//修改二者的属性，对RemoteName做标记
-								tempUser := User{
-									Name:       onLineUsers.GetUser(mess.Data).Name,
-									Addr:       onLineUsers.GetUser(mess.Data).Addr,
-									RemoteName: mess.Sender,
-									BeatCount:  onLineUsers.GetUser(mess.Data).BeatCount,
-								}
-								onLineUsers.Change(mess.Data, tempUser)
-								tempUser = User{
-									Name:       onLineUsers.GetUser(mess.Sender).Name,
-									Addr:       onLineUsers.GetUser(mess.Sender).Addr,
-									RemoteName: mess.Data,
-									BeatCount:  onLineUsers.GetUser(mess.Sender).BeatCount,
-								}
-								onLineUsers.Change(mess.Sender, tempUser)
-								//向被呼叫方，发送通知
-								go func(remoteClientAddr string, sponsor string) {
-									remoteUdpAddr, err := net.ResolveUDPAddr("udp", remoteClientAddr)
-									if err != nil {
-										fmt.Println(err)
-										logger.Printf("ListenMess:%v\n", err)
-									}
-									remoteUdpConn, err := net.DialUDP("udp", nil, remoteUdpAddr)
-									defer remoteUdpConn.Close()
-									if err != nil {
-										fmt.Println(err)
-										logger.Printf("ListenMess:%v\n", err)
-									}
-									encoder := json.NewEncoder(remoteUdpConn)
-									mess = Message{
-										Cmd:      "group",
-										Sender:   "server",
-										Data:     fmt.Sprintf("0/%s/%s", sponsor, onLineUsers.GetUser(sponsor).Addr),
-										Receiver: mess.Receiver,
-									}
-									err = encoder.Encode(mess)
-									if err != nil {
-										fmt.Println(err)
-										logger.Printf("ListenMess:%v\n", err)
-									}
-								}(onLineUsers.GetUser(mess.Data).Addr, mess.Sender)
-								//向发起方返回远程client地址
-								remoteUdpAddr, err := net.ResolveUDPAddr("udp", onLineUsers.GetUser(mess.Sender).Addr)
-								if err != nil {
-									fmt.Println(err)
-									continue
-								}
-								remoteUdpConn, err := net.DialUDP("udp", nil, remoteUdpAddr)
-								defer remoteUdpConn.Close()
-								if err != nil {
-									fmt.Println(err)
-									logger.Printf("ListenMess:%v\n", err)
-									continue
-								}
-								encoder := json.NewEncoder(remoteUdpConn)
-								mess = Message{
-									Cmd:      "group",
-									Sender:   "server",
-									Data:     fmt.Sprintf("1/%s", strings.Join(tempList, "/")),
-									Receiver: mess.Receiver,
-								}
-								err = encoder.Encode(mess)
-								if err != nil {
-									fmt.Println(err)
-									logger.Printf("ListenMess:%v\n", err)
-									continue
-								}
-							}
-						} else {
-							//被叫方不在线
-							remoteUdpAddr, err := net.ResolveUDPAddr("udp", onLineUsers.GetUser(mess.Sender).Addr)
-							if err != nil {
-								fmt.Println(err)
-								continue
-							}
-							remoteUdpConn, err := net.DialUDP("udp", nil, remoteUdpAddr)
-							defer remoteUdpConn.Close()
-							if err != nil {
-								fmt.Println(err)
-								logger.Printf("ListenMess:%v\n", err)
-								continue
-							}
-							encoder := json.NewEncoder(remoteUdpConn)
-							mess = Message{
-								Cmd:      "group",
-								Sender:   "server",
-								Data:     fmt.Sprintf("the user <%s> is not online", mess.Data),
-								Receiver: mess.Receiver,
-							}
-							err = encoder.Encode(mess)
-							if err != nil {
-								fmt.Println(err)
-								logger.Printf("ListenMess:%v\n", err)
-								continue
-							}
-						}
-					}
-				case "quit":
-					{
-						fmt.Printf("CMD:%v,DATA:%v,Sender:%v,Receiver:%v\n", mess.Cmd, mess.Data, mess.Sender, mess.Receiver)
-						tempUser := User{
-							Name:       onLineUsers.GetUser(mess.Sender).Name,
-							Addr:       onLineUsers.GetUser(mess.Sender).Addr,
-							RemoteName: "server",
-							BeatCount:  onLineUsers.GetUser(mess.Sender).BeatCount,
-						}
-						onLineUsers.Change(mess.Sender, tempUser)
-						tempUser = User{
-							Name:       onLineUsers.GetUser(mess.Data).Name,
-							Addr:       onLineUsers.GetUser(mess.Data).Addr,
-							RemoteName: "server",
-							BeatCount:  onLineUsers.GetUser(mess.Data).BeatCount,
-						}
-						onLineUsers.Change(mess.Data, tempUser)
-					}
-				}
-
-			}
-
-		}
-
+	//离线留言箱，每个用户最多保存MailQuota条留言
+	mailbox, err := NewMailbox(config.MailboxDir, config.MailQuota)
+	if err != nil {
+		fmt.Println(err)
+		logger.Fatalf("mailbox:%v\n", err)
 	}
-}
-func main() {
-	runtime.GOMAXPROCS(runtime.NumCPU())
-	file, err := os.OpenFile("log.txt", os.O_APPEND, 0666)
+	history, err := NewHistory(config.HistoryDir)
 	if err != nil {
-		file, err = os.Create("log.txt")
-		if err != nil {
-			fmt.Println(err)
-		}
+		fmt.Println(err)
+		logger.Fatalf("history:%v\n", err)
 	}
-	year, month, day := time.Now().Date()
-	logger := log.New(file, fmt.Sprintf("R:%v-%v-%v:", year, month, day), log.Ltime)
-	listenPort := "172.16.18.163:8081"
-	loginPort := "172.16.18.163:8080"
+	//联系人，每个用户关注的联系人保存在单独文件中
+	contacts, err := NewContacts(config.ContactsDir)
+	if err != nil {
+		fmt.Println(err)
+		logger.Fatalf("contacts:%v\n", err)
+	}
+	//在线用户组，登录与消息监听共用，StoreFile为空时只保存在内存中
+	onLineUsers, err := NewStore(config)
+	if err != nil {
+		fmt.Println(err)
+		logger.Fatalf("store:%v\n", err)
+	}
+	//封禁名单，登录服务与管理控制台共用
+	bans := NewBans()
 	userCh := make(chan User)
-	go Login(loginPort, listenPort, userCh, logger)
-	ListenMess(listenPort, userCh, logger)
+	go Login(config, userCh, logger, onLineUsers, accounts, tlsConfig, mailbox, bans)
+	ListenMess(config, userCh, logger, onLineUsers, accounts, mailbox, history, contacts, bans)
 }
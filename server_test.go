@@ -0,0 +1,1854 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/****************************************************
+*@function newTestDispatcher(t *testing.T, conn PacketConn, args ...string) *Dispatcher
+*****************************************************
+*@brief 新建使用临时目录的分发器，args为额外的命令行参数
+*****************************************************/
+func newTestDispatcher(t *testing.T, conn PacketConn, args ...string) *Dispatcher {
+	t.Helper()
+	dir := t.TempDir()
+	args = append([]string{
+		"-onlinelog", filepath.Join(dir, "onlineusers.txt"),
+		"-accounts", filepath.Join(dir, "accounts.txt"),
+		"-mailbox", filepath.Join(dir, "mailbox"),
+		"-history", filepath.Join(dir, "history"),
+		"-contacts", filepath.Join(dir, "contacts"),
+	}, args...)
+	config, err := NewConfig(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := NewAccounts(config.AccountsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailbox, err := NewMailbox(config.MailboxDir, config.MailQuota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := NewHistory(config.HistoryDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contacts, err := NewContacts(config.ContactsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New(io.Discard, "", 0)
+	return NewDispatcher(config, logger, conn, users, accounts, mailbox, history, contacts, NewBans())
+}
+
+/****************************************************
+*@function simSend(t *testing.T, conn *SimConn, to *net.UDPAddr, mess Message)
+*****************************************************
+*@brief 以json编码发送一条消息
+*****************************************************/
+func simSend(t *testing.T, conn *SimConn, to *net.UDPAddr, mess Message) {
+	t.Helper()
+	data, err := EncodeFrame(nil, mess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteToUDP(data, to)
+}
+
+/****************************************************
+*@function simRead(conn *SimConn, cmd string) (Message, *net.UDPAddr, error)
+*****************************************************
+*@brief 读取消息直到收到cmd，两秒内没有收到时返回错误，
+可以在测试的其他协程中使用
+*****************************************************/
+func simRead(conn *SimConn, cmd string) (Message, *net.UDPAddr, error) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	buffer := make([]byte, 65536)
+	for {
+		count, from, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return Message{}, nil, fmt.Errorf("waiting for %s: %v", cmd, err)
+		}
+		mess, err := DecodeFrame(buffer[:count])
+		if err == nil && mess.Cmd == cmd {
+			return mess, from, nil
+		}
+	}
+}
+
+/****************************************************
+*@function simWait(t *testing.T, conn *SimConn, cmd string) (Message, *net.UDPAddr)
+*****************************************************
+*@brief 读取消息直到收到cmd，两秒内没有收到时失败
+*****************************************************/
+func simWait(t *testing.T, conn *SimConn, cmd string) (Message, *net.UDPAddr) {
+	t.Helper()
+	mess, from, err := simRead(conn, cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mess, from
+}
+
+/****************************************************
+*@function simAck(t *testing.T, conn *SimConn, to *net.UDPAddr, name, token string, mess Message)
+*****************************************************
+*@brief 按客户端Read的方式确认收到的消息：ack发给消息的
+Sender，来自服务器的消息携带令牌
+*****************************************************/
+func simAck(t *testing.T, conn *SimConn, to *net.UDPAddr, name, token string, mess Message) {
+	t.Helper()
+	simSend(t, conn, to, Message{Cmd: "ack", Sender: name, Data: mess.ID, Receiver: mess.Sender, Token: token})
+}
+
+/****************************************************
+*@function simQuiet(t *testing.T, conn *SimConn, wait time.Duration, cmds ...string)
+*****************************************************
+*@brief 在wait内读取全部消息，收到cmds中的指令时失败
+*****************************************************/
+func simQuiet(t *testing.T, conn *SimConn, wait time.Duration, cmds ...string) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(wait))
+	defer conn.SetReadDeadline(time.Time{})
+	buffer := make([]byte, 65536)
+	for {
+		count, _, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		mess, err := DecodeFrame(buffer[:count])
+		if err != nil {
+			continue
+		}
+		for _, cmd := range cmds {
+			if mess.Cmd == cmd {
+				t.Errorf("unexpected %s: %v", cmd, mess)
+			}
+		}
+	}
+}
+
+/****************************************************
+*@function simOnline(t *testing.T, simNet *SimNet, d *Dispatcher, name, token, public string) *SimConn
+*****************************************************
+*@brief 在公网地址为public的NAT后面新建与登录后相同的
+在线用户，并发送一次心跳记录公网地址
+*****************************************************/
+func simOnline(t *testing.T, simNet *SimNet, d *Dispatcher, name, token, public string) *SimConn {
+	t.Helper()
+	conn := simNet.NAT(NATPortRestricted, public).Listen("192.168.1.10:5000")
+	d.Users.Add(name, User{Name: name, Addr: "192.168.1.10:5000", Token: token, Status: StatusAvailable})
+	simSend(t, conn, d.Conn.LocalAddr().(*net.UDPAddr), Message{Cmd: "beat", Sender: name, Receiver: "server", Token: token})
+	return conn
+}
+
+/****************************************************
+*@function simFail(t *testing.T, conn *SimConn, cmd string) int
+*****************************************************
+*@brief 读取消息直到收到cmd，返回其中的错误码，不是
+错误时返回0
+*****************************************************/
+func simFail(t *testing.T, conn *SimConn, cmd string) int {
+	t.Helper()
+	mess, _ := simWait(t, conn, cmd)
+	if payload, typed := ParsePayload(mess); typed && payload.Error != nil {
+		return payload.Error.Code
+	}
+	return 0
+}
+
+/****************************************************
+*@function simSession(t *testing.T, d *Dispatcher, a, b *SimConn, nameA, tokenA, nameB, tokenB string)
+*****************************************************
+*@brief a邀请b、b接受，建立两人会话并确认双方收到的
+邀请与会话通知
+*****************************************************/
+func simSession(t *testing.T, d *Dispatcher, a, b *SimConn, nameA, tokenA, nameB, tokenB string) {
+	t.Helper()
+	server := d.Conn.LocalAddr().(*net.UDPAddr)
+	simSend(t, a, server, Message{Cmd: "group", Sender: nameA, Data: nameB, Receiver: "server", Token: tokenA})
+	invite, _ := simWait(t, b, "invite")
+	simAck(t, b, server, nameB, tokenB, invite)
+	simSend(t, b, server, Message{Cmd: "accept", Sender: nameB, Data: nameA, Receiver: "server", Token: tokenB})
+	for name, conn := range map[string]*SimConn{nameA: a, nameB: b} {
+		token := tokenA
+		if name == nameB {
+			token = tokenB
+		}
+		mess, _ := simWait(t, conn, "group")
+		simAck(t, conn, server, name, token, mess)
+	}
+}
+
+/****************************************************
+*@brief 服务器从心跳记录NAT映射后的公网地址，group
+握手把公网地址与内网地址转交双方，双方向对方公网地址
+同时打洞后可以直连
+*****************************************************/
+func TestSessionOfferCarriesObservedEndpoint(t *testing.T) {
+	simNet := NewSimNet()
+	serverConn := simNet.Listen("198.51.100.1:8081")
+	d := newTestDispatcher(t, serverConn)
+	go d.ReadLoop()
+	go d.Run()
+	defer serverConn.Close()
+	server := serverConn.addr
+
+	//两个客户端在不同NAT后面，内网地址相同
+	natA := simNet.NAT(NATPortRestricted, "203.0.113.1")
+	natB := simNet.NAT(NATPortRestricted, "203.0.113.2")
+	alice := natA.Listen("192.168.1.10:5000")
+	bob := natB.Listen("192.168.1.10:5000")
+	d.Users.Add("alice", User{Name: "alice", Addr: "192.168.1.10:5000", Token: "ta"})
+	d.Users.Add("bob", User{Name: "bob", Addr: "192.168.1.10:5000", Token: "tb"})
+	simSend(t, alice, server, Message{Cmd: "beat", Sender: "alice", Receiver: "server", Token: "ta"})
+	simSend(t, bob, server, Message{Cmd: "beat", Sender: "bob", Receiver: "server", Token: "tb"})
+
+	simSend(t, alice, server, Message{Cmd: "group", Sender: "alice", Data: "bob", Receiver: "server", Token: "ta"})
+	simWait(t, bob, "invite")
+	simSend(t, bob, server, Message{Cmd: "accept", Sender: "bob", Data: "alice", Receiver: "server", Token: "tb"})
+
+	publicA := natA.Public(alice, server.String())
+	publicB := natB.Public(bob, server.String())
+	offers := make(map[string]*SessionOffer)
+	for name, conn := range map[string]*SimConn{"alice": alice, "bob": bob} {
+		mess, _ := simWait(t, conn, "group")
+		payload, typed := ParsePayload(mess)
+		if !typed || payload.Offer == nil {
+			t.Fatalf("%s got a group notice without an offer: %v", name, mess)
+		}
+		offers[name] = payload.Offer
+	}
+	if offers["alice"].Name != "bob" || offers["alice"].PublicAddr != publicB || offers["alice"].PrivateAddr != "192.168.1.10:5000" {
+		t.Errorf("alice was offered %+v, bob is at %s", *offers["alice"], publicB)
+	}
+	if offers["bob"].Name != "alice" || offers["bob"].PublicAddr != publicA {
+		t.Errorf("bob was offered %+v, alice is at %s", *offers["bob"], publicA)
+	}
+
+	//双方向对方的公网地址打洞，第一个数据报可能被对方NAT过滤，之后互相可达
+	addrA, _ := net.ResolveUDPAddr("udp", offers["bob"].PublicAddr)
+	addrB, _ := net.ResolveUDPAddr("udp", offers["alice"].PublicAddr)
+	simSend(t, alice, addrB, Message{Cmd: "punch", Sender: "alice", Receiver: "bob"})
+	simSend(t, bob, addrA, Message{Cmd: "punch", Sender: "bob", Receiver: "alice"})
+	simSend(t, alice, addrB, Message{Cmd: "punch", Sender: "alice", Receiver: "bob"})
+	if _, from := simWait(t, alice, "punch"); from.String() != publicB {
+		t.Errorf("alice got bob's punch from %s, want %s", from, publicB)
+	}
+	if _, from := simWait(t, bob, "punch"); from.String() != publicA {
+		t.Errorf("bob got alice's punch from %s, want %s", from, publicA)
+	}
+}
+
+/****************************************************
+*@brief 在线用户日志只记录用户名与地址，不记录会话令牌
+*****************************************************/
+func TestOnlineLogHidesToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "onlineusers.txt")
+	config, err := NewConfig([]string{"-onlinelog", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users.Add("alice", User{Name: "alice", Addr: "10.0.0.1:5000", Token: "secret-token", BeatCount: 3})
+	users.Sort(nil, 1)
+	if line := fmt.Sprintf("user %v login", users.GetUser("alice")); strings.Contains(line, "secret-token") {
+		t.Errorf("login log shows the token: %s", line)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret-token") {
+		t.Errorf("online log shows the token: %s", data)
+	}
+	if !strings.Contains(string(data), "alice") || !strings.Contains(string(data), "10.0.0.1:5000") {
+		t.Errorf("online log misses the user: %s", data)
+	}
+}
+
+/****************************************************
+*@brief 配置文件中的大整数与时长按原文解析，命令行参数
+优先于配置文件
+*****************************************************/
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.json")
+	err := os.WriteFile(path, []byte(`{"fragmemory": 33554432, "outqueue": 1000000, "ackwait": "250ms", "guest": false, "retries": 2}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := NewConfig([]string{"-config", path, "-retries", "6"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.FragMemory != 33554432 || config.OutQueue != 1000000 || config.AckWait != 250*time.Millisecond || config.AllowGuest {
+		t.Errorf("settings from the file not applied: %+v", *config)
+	}
+	if config.Retries != 6 {
+		t.Errorf("retries %d, the command line should win", config.Retries)
+	}
+	err = os.WriteFile(path, []byte(`{"fragmemory": 1.5}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewConfig([]string{"-config", path}); err == nil {
+		t.Error("a fractional fragmemory was accepted")
+	}
+}
+
+/****************************************************
+*@brief 重传次数与等待时间超过上限时配置无效，上限内
+重复消息的保留时间不溢出
+*****************************************************/
+func TestRetriesLimit(t *testing.T) {
+	for _, args := range [][]string{
+		{"-retries", "17"},
+		{"-retries", "1000"},
+		{"-ackwait", "2m"},
+	} {
+		if _, err := NewConfig(args); err == nil {
+			t.Errorf("%v was accepted", args)
+		}
+	}
+	config, err := NewConfig([]string{"-retries", "16", "-ackwait", "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReliable(config.Retries, config.AckWait)
+	if r.window < config.AckWait<<uint(config.Retries+1) {
+		t.Errorf("window %v is shorter than the last resend", r.window)
+	}
+}
+
+/****************************************************
+*@brief 两种存储实现在并发增删改查下不丢失更新，
+文件快照与内存一致
+*****************************************************/
+func TestUserStoreConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "online.json")
+	fileStore, err := NewFileStore(path, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, users := range map[string]UserStore{"memory": NewMemoryStore(), "file": fileStore} {
+		t.Run(name, func(t *testing.T) {
+			const workers, rounds, names = 16, 50, 4
+			for i := 0; i < names; i++ {
+				name := fmt.Sprintf("u%d", i)
+				users.Add(name, User{Name: name, Token: "t" + name})
+			}
+			var wg sync.WaitGroup
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					for r := 0; r < rounds; r++ {
+						name := fmt.Sprintf("u%d", (w+r)%names)
+						users.Update(name, func(user *User) {
+							user.BeatCount++
+						})
+						users.Verify(name, "t"+name, "10.0.0.1:5000")
+						users.Get(name)
+						users.Snapshot()
+						//临时用户反复加入删除，与固定用户互不影响
+						temp := fmt.Sprintf("temp%d", w)
+						users.Add(temp, User{Name: temp})
+						users.Beat(temp, "10.0.0.2:5000")
+						users.Change(temp, User{Name: temp, Status: StatusAway})
+						users.Delete(temp)
+					}
+				}(w)
+			}
+			wg.Wait()
+			snapshot := users.Snapshot()
+			if len(snapshot) != names {
+				t.Errorf("%d users left, want %d: %v", len(snapshot), names, snapshot)
+			}
+			total := 0
+			for _, user := range snapshot {
+				total += user.BeatCount
+				if user.PublicAddr != "10.0.0.1:5000" {
+					t.Errorf("%s public address %q", user.Name, user.PublicAddr)
+				}
+			}
+			if total != workers*rounds {
+				t.Errorf("%d updates recorded, want %d", total, workers*rounds)
+			}
+		})
+	}
+	//快照文件可以重新载入
+	reloaded, err := NewFileStore(path, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reloaded.Snapshot()) != len(fileStore.Snapshot()) {
+		t.Errorf("reloaded %d users, saved %d", len(reloaded.Snapshot()), len(fileStore.Snapshot()))
+	}
+}
+
+/****************************************************
+*@brief 同一用户名并发登录只有一个成功；登录、下线、
+房间与会话操作以及心跳检查并发进行
+*****************************************************/
+func TestStoreConcurrent(t *testing.T) {
+	simNet := NewSimNet()
+	conn := simNet.Listen("198.51.100.1:8081")
+	defer conn.Close()
+	d := newTestDispatcher(t, conn)
+	store := d.Users
+	const workers = 16
+	var wg sync.WaitGroup
+	claimed := make(chan string, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			if store.Claim("alice", User{Name: "alice", Addr: fmt.Sprintf("10.0.0.%d:5000", w)}) {
+				claimed <- "alice"
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(claimed)
+	if len(claimed) != 1 {
+		t.Errorf("alice was claimed %d times", len(claimed))
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			name := fmt.Sprintf("user%d", w)
+			peer := fmt.Sprintf("user%d", (w+1)%workers)
+			for r := 0; r < 20; r++ {
+				store.Claim(name, User{Name: name, Addr: "198.51.100.9:5000", BeatCount: 5})
+				store.JoinRoom("lobby", name)
+				store.Connect(name, peer)
+				store.Invite(name, peer, time.Now().Add(time.Minute))
+				store.RoomMembers("lobby")
+				store.GetRooms()
+				if r%5 == 4 {
+					store.Sort(d.Outbox, 1)
+				}
+				store.TakeInvite(peer, name)
+				store.Disconnect(name, peer)
+				store.LeaveRoom("lobby", name)
+				if r%3 == 2 {
+					store.Release(name, d.Outbox)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for name, members := range store.GetRooms() {
+		if len(members) != 0 {
+			t.Errorf("room %s still has %v", name, members)
+		}
+	}
+	for name, user := range store.GetMap() {
+		if len(user.Peers) != 0 {
+			t.Errorf("%s still talks with %v", name, user.Peers)
+		}
+	}
+}
+
+/****************************************************
+*@brief 多个协程同时向多个用户发送，每条消息都从监听
+端口发出且恰好送达一次
+*****************************************************/
+func TestOutboxConcurrent(t *testing.T) {
+	simNet := NewSimNet()
+	conn := simNet.Listen("198.51.100.1:8081")
+	defer conn.Close()
+	outbox := NewOutbox(conn, 1024, NewReliable(1, time.Second), log.New(io.Discard, "", 0))
+	const senders, receivers, rounds = 8, 32, 50
+	users := make([]User, receivers)
+	counts := make([]int, receivers)
+	var readers sync.WaitGroup
+	for i := range users {
+		addr := fmt.Sprintf("198.51.100.2:%d", 6000+i)
+		users[i] = User{Name: fmt.Sprintf("user%d", i), Addr: addr}
+		inbox := simNet.Listen(addr)
+		defer inbox.Close()
+		readers.Add(1)
+		go func(i int) {
+			defer readers.Done()
+			buffer := make([]byte, 2048)
+			inbox.SetReadDeadline(time.Now().Add(10 * time.Second))
+			for counts[i] < senders*rounds {
+				count, from, err := inbox.ReadFromUDP(buffer)
+				if err != nil {
+					return
+				}
+				if _, err := DecodeFrame(buffer[:count]); err != nil || from.String() != conn.addr.String() {
+					t.Errorf("bad datagram from %v: %v", from, err)
+				}
+				counts[i]++
+			}
+		}(i)
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < senders; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < rounds; r++ {
+				for _, user := range users {
+					err := outbox.Send(user, Message{Cmd: "list", Sender: "server", Data: fmt.Sprintf("%d/%d", w, r), Receiver: user.Name})
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	readers.Wait()
+	for i, count := range counts {
+		if count != senders*rounds {
+			t.Errorf("%s got %d messages, want %d", users[i].Name, count, senders*rounds)
+		}
+	}
+	if dropped := simNet.Dropped(); dropped != 0 {
+		t.Errorf("%d datagrams dropped", dropped)
+	}
+}
+
+/****************************************************
+*@brief 定义测试用端口，丢弃写出的数据报并计数，hold
+不为nil时写操作阻塞到hold关闭，模拟发送缓慢的网络
+*****************************************************/
+type discardConn struct {
+	hold    chan struct{}
+	lock    sync.Mutex
+	written int
+}
+
+func (c *discardConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	return 0, nil, net.ErrClosed
+}
+
+func (c *discardConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	if c.hold != nil {
+		<-c.hold
+	}
+	c.lock.Lock()
+	c.written++
+	c.lock.Unlock()
+	return len(b), nil
+}
+
+func (c *discardConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 8081}
+}
+
+func (c *discardConn) Close() error {
+	return nil
+}
+
+/****************************************************
+*@brief 接收方的队列满时Send立即返回ErrOutboxFull，
+不等待，其他接收方不受影响
+*****************************************************/
+func TestOutboxFullFailsFast(t *testing.T) {
+	conn := &discardConn{hold: make(chan struct{})}
+	defer close(conn.hold)
+	outbox := NewOutbox(conn, 4, NewReliable(1, time.Second), log.New(io.Discard, "", 0))
+	slow := User{Name: "slow", Addr: "198.51.100.2:6000"}
+	start := time.Now()
+	sent, full := 0, 0
+	for i := 0; i < 100; i++ {
+		err := outbox.Send(slow, Message{Cmd: "list", Sender: "server", Data: fmt.Sprint(i), Receiver: "slow"})
+		if errors.Is(err, ErrOutboxFull) {
+			full++
+		} else if err != nil {
+			t.Fatal(err)
+		} else {
+			sent++
+		}
+	}
+	//发送协程取走一条后阻塞在写操作上，队列中最多再放size条
+	if sent > 5 || full != 100-sent {
+		t.Errorf("%d sent and %d rejected, want at most 5 sent", sent, full)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("100 sends to a full queue took %v", elapsed)
+	}
+	err := outbox.Send(User{Name: "fast", Addr: "198.51.100.3:6000"}, Message{Cmd: "list", Sender: "server", Receiver: "fast"})
+	if err != nil {
+		t.Errorf("another receiver was blocked: %v", err)
+	}
+}
+
+/****************************************************
+*@brief 分片消息整条入队，队列满时整条放弃，接收方
+不会只收到部分分片
+*****************************************************/
+func TestOutboxFullKeepsMessagesWhole(t *testing.T) {
+	conn := &discardConn{hold: make(chan struct{})}
+	outbox := NewOutbox(conn, 2, NewReliable(1, time.Second), log.New(io.Discard, "", 0))
+	slow := User{Name: "slow", Addr: "198.51.100.2:6000"}
+	mess := Message{Cmd: "list", Sender: "server", Data: strings.Repeat("x", 3*FragmentSize), Receiver: "slow"}
+	frames, err := EncodeFrames(nil, mess)
+	if err != nil || len(frames) < 2 {
+		t.Fatalf("%d frames (%v), want a fragmented message", len(frames), err)
+	}
+	sent := 0
+	for i := 0; i < 10; i++ {
+		err := outbox.Send(slow, mess)
+		if err == nil {
+			sent++
+		} else if !errors.Is(err, ErrOutboxFull) {
+			t.Fatal(err)
+		}
+	}
+	if sent == 10 {
+		t.Fatal("all 10 messages queued, want the queue to fill up")
+	}
+	close(conn.hold)
+	want := sent * len(frames)
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		conn.lock.Lock()
+		written := conn.written
+		conn.lock.Unlock()
+		if written >= want {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.written != want {
+		t.Errorf("%d datagrams written, want %d for %d whole messages of %d frames", conn.written, want, sent, len(frames))
+	}
+}
+
+/****************************************************
+*@brief 向一万个模拟客户端各发送一条消息，队列满时
+计入full/op而不阻塞
+*****************************************************/
+func BenchmarkOutbox(b *testing.B) {
+	const clients = 10000
+	conn := &discardConn{}
+	outbox := NewOutbox(conn, 64, NewReliable(1, time.Second), log.New(io.Discard, "", 0))
+	users := make([]User, clients)
+	for i := range users {
+		users[i] = User{
+			Name: fmt.Sprintf("user%d", i),
+			Addr: fmt.Sprintf("10.%d.%d.%d:5000", i>>16&255, i>>8&255, i&255),
+		}
+	}
+	mess := Message{Cmd: "presence", Sender: "server", Data: "alice/online", Receiver: "user"}
+	full := 0
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, user := range users {
+			err := outbox.Send(user, mess)
+			if errors.Is(err, ErrOutboxFull) {
+				full++
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(full)/float64(b.N), "full/op")
+}
+
+/****************************************************
+*@brief 读取、登录与客户端命令并发进入分发器，所有
+请求都得到回复
+*****************************************************/
+func TestDispatcherConcurrent(t *testing.T) {
+	simNet := NewSimNet()
+	serverConn := simNet.Listen("198.51.100.1:8081")
+	d := newTestDispatcher(t, serverConn)
+	userCh := make(chan User)
+	go d.ReadLoop()
+	go d.LoginLoop(userCh)
+	go d.Run()
+	defer serverConn.Close()
+	const clients, rounds = 12, 10
+	for c := 0; c < clients; c++ {
+		name := fmt.Sprintf("user%d", c)
+		d.Users.Claim(name, User{Name: name, Addr: "192.168.1.10:5000", Token: "t" + name, Status: StatusAvailable})
+	}
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		name := fmt.Sprintf("user%d", c)
+		nat := simNet.NAT(NATPortRestricted, fmt.Sprintf("203.0.113.%d", c+1))
+		conn := nat.Listen("192.168.1.10:5000")
+		defer conn.Close()
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			userCh <- User{Name: name}
+			send := func(cmd, data, receiver string) {
+				simSend(t, conn, serverConn.addr, Message{Cmd: cmd, Sender: name, Data: data, Receiver: receiver, Token: "t" + name})
+			}
+			send("beat", "", "server")
+			//关注成功后返回对方的当前状态
+			send("watch", fmt.Sprintf("user%d", (c+1)%clients), "server")
+			requests := []string{"presence"}
+			send("join", "lobby", "server")
+			requests = append(requests, "join")
+			for r := 0; r < rounds; r++ {
+				send("list", "", "server")
+				send("status", []string{StatusAway, StatusBusy}[r%2]+"/round", "server")
+				send("roomchat", "hello", "lobby")
+				send("rooms", "", "server")
+				requests = append(requests, "list", "status", "rooms")
+			}
+			for _, cmd := range requests {
+				if _, _, err := simRead(conn, cmd); err != nil {
+					t.Errorf("%s: %v", name, err)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(userCh)
+	if members := d.Users.RoomMembers("lobby"); len(members) != clients {
+		t.Errorf("lobby has %d members, want %d", len(members), clients)
+	}
+}
+
+/****************************************************
+*@brief 离线留言在登录后的第一次心跳之后经udp投递，
+收件人确认的留言才从留言箱删除，未确认的留言在下次
+登录时重新投递
+*****************************************************/
+func TestMailboxDeliveredAfterAck(t *testing.T) {
+	simNet := NewSimNet()
+	serverConn := simNet.Listen("198.51.100.1:8081")
+	d := newTestDispatcher(t, serverConn, "-retries", "1", "-ackwait", "50ms")
+	go d.ReadLoop()
+	go d.Run()
+	defer serverConn.Close()
+	server := serverConn.addr
+	alice := simNet.NAT(NATPortRestricted, "203.0.113.1").Listen("192.168.1.10:5000")
+
+	for _, text := range []string{"first", "second"} {
+		err := d.Mailbox.Put("alice", Mail{Sender: "bob", Data: text, Time: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending := func() []Mail {
+		mails, err := d.Mailbox.Peek("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mails
+	}
+	//等待留言箱剩下want条留言
+	waitPending := func(want int) []Mail {
+		deadline := time.Now().Add(2 * time.Second)
+		for len(pending()) != want && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		mails := pending()
+		if len(mails) != want {
+			t.Fatalf("%d mails pending, want %d", len(mails), want)
+		}
+		return mails
+	}
+	login := func() {
+		d.Users.Claim("alice", User{Name: "alice", Addr: "192.168.1.10:5000", Token: "ta"})
+		d.Push(Command{Mess: Message{Cmd: "online", Sender: "alice", Receiver: "server"}})
+		simSend(t, alice, server, Message{Cmd: "beat", Sender: "alice", Receiver: "server", Token: "ta"})
+	}
+
+	//只确认第一条，第二条重传用尽后仍保留
+	login()
+	first, _ := simWait(t, alice, "mailbox")
+	second, _ := simWait(t, alice, "mailbox")
+	if len(pending()) != 2 {
+		t.Fatalf("mail was removed before it was acknowledged")
+	}
+	//留言由服务器投递，作者在Payload中，收件人的ack因此发给服务器
+	if payload, typed := ParsePayload(first); first.Sender != "server" || !typed || payload.Note == nil || payload.Note.From != "bob" || payload.Note.Text != "first" {
+		t.Fatalf("got %+v, want a note from bob sent by the server", first)
+	}
+	simAck(t, alice, server, "alice", "ta", first)
+	mails := waitPending(1)
+	if mails[0].Data != "second" {
+		t.Errorf("kept %q, want the unacknowledged mail", mails[0].Data)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if len(pending()) != 1 {
+		t.Errorf("unacknowledged mail %s was removed", second.ID)
+	}
+
+	//重新登录后再次投递，确认后留言箱清空
+	d.Users.Release("alice", d.Outbox)
+	login()
+	again, _ := simWait(t, alice, "mailbox")
+	//跳过上一次登录时的重传
+	for again.ID == second.ID {
+		again, _ = simWait(t, alice, "mailbox")
+	}
+	if again.Data != second.Data {
+		t.Errorf("redelivered %q, want %q", again.Data, second.Data)
+	}
+	simAck(t, alice, server, "alice", "ta", again)
+	waitPending(0)
+	if _, err := os.Stat(d.Mailbox.path("alice")); !os.IsNotExist(err) {
+		t.Errorf("empty mailbox file was not removed: %v", err)
+	}
+}
+
+/****************************************************
+*@brief 一个来源地址发送大量收不齐的分片，超出quota后
+被丢弃，其他来源的长消息仍可以重组
+*****************************************************/
+func TestReassemblerSourceQuota(t *testing.T) {
+	drops := NewDropCounter()
+	fragments := NewReassembler(time.Minute, 16*MaxMessageSize, MaxMessageSize, drops)
+	long := Message{Cmd: "chat", Sender: "bob", Data: strings.Repeat("x", 8*FragmentSize), Receiver: "alice"}
+	rejected := false
+	for i := 0; i < 2*MaxMessageSize/FragmentSize && !rejected; i++ {
+		frames, err := EncodeFrames(nil, long)
+		if err != nil {
+			t.Fatal(err)
+		}
+		//每条消息缺最后一个分片，永远收不齐
+		for _, frame := range frames[:len(frames)-1] {
+			_, err = fragments.Add("203.0.113.9:4000", frame)
+			var frameErr *FrameError
+			if errors.As(err, &frameErr) && frameErr.Reason == "memory" {
+				rejected = true
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !rejected {
+		t.Fatal("one source buffered more than its quota")
+	}
+	frames, err := EncodeFrames(nil, long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	for _, frame := range frames {
+		data, err = fragments.Add("198.51.100.7:5000", frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mess, err := DecodeFrame(data)
+	if err != nil || mess.Data != long.Data {
+		t.Errorf("another source could not send a long message: %v", err)
+	}
+}
+
+/****************************************************
+*@brief 邀请自己的group请求被拒绝，不留下邀请
+*****************************************************/
+func TestGroupWithSelfRejected(t *testing.T) {
+	simNet := NewSimNet()
+	serverConn := simNet.Listen("198.51.100.1:8081")
+	d := newTestDispatcher(t, serverConn)
+	go d.ReadLoop()
+	go d.Run()
+	defer serverConn.Close()
+	alice := simNet.NAT(NATPortRestricted, "203.0.113.1").Listen("192.168.1.10:5000")
+	d.Users.Add("alice", User{Name: "alice", Addr: "192.168.1.10:5000", Token: "ta"})
+	simSend(t, alice, serverConn.addr, Message{Cmd: "group", Sender: "alice", Data: "alice", Receiver: "server", Token: "ta"})
+	mess, _ := simWait(t, alice, "group")
+	if payload, typed := ParsePayload(mess); !typed || payload.Error == nil {
+		t.Errorf("got %v, want an error", mess)
+	}
+	if _, flag := d.Users.TakeInvite("alice", "alice"); flag {
+		t.Error("an invitation to oneself was recorded")
+	}
+}
+
+/****************************************************
+*@brief 管理命令的结果超过一屏而控制台暂不读取时，
+分发器继续处理其他命令，控制台之后仍收到全部结果
+*****************************************************/
+func TestAdminSlowConsole(t *testing.T) {
+	simNet := NewSimNet()
+	serverConn := simNet.Listen("198.51.100.1:8081")
+	defer serverConn.Close()
+	d := newTestDispatcher(t, serverConn)
+	go d.Run()
+	const users = 40
+	for i := 0; i < users; i++ {
+		name := fmt.Sprintf("user%d", i)
+		d.Users.Claim(name, User{Name: name, Addr: fmt.Sprintf("198.51.100.2:%d", 6000+i)})
+	}
+	console, conn := net.Pipe()
+	defer console.Close()
+	go d.ServeAdmin(conn)
+	if _, err := console.Write([]byte("sessions\n")); err != nil {
+		t.Fatal(err)
+	}
+	//控制台不读取，其他命令照常得到结果
+	reply := make(chan []string, 1)
+	d.Push(Command{Mess: Message{Cmd: "admin", Sender: "admin", Data: "bans", Receiver: "server"}, Reply: reply})
+	select {
+	case lines := <-reply:
+		if len(lines) != 1 {
+			t.Errorf("bans replied %q", lines)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the dispatcher is stalled by a slow console")
+	}
+	console.SetReadDeadline(time.Now().Add(2 * time.Second))
+	scanner := bufio.NewScanner(console)
+	lines := 0
+	for lines < users+1 && scanner.Scan() {
+		lines++
+	}
+	if lines != users+1 {
+		t.Errorf("console got %d lines, want %d: %v", lines, users+1, scanner.Err())
+	}
+}
+
+/****************************************************
+*@brief 服务器转发的msg以server为发送者，接收方按客户端
+的方式回复ack后停止重传，发送者不会收到未送达的错误
+*****************************************************/
+func TestMsgAckedByReceiver(t *testing.T) {
+	simNet := NewSimNet()
+	serverConn := simNet.Listen("198.51.100.1:8081")
+	d := newTestDispatcher(t, serverConn, "-retries", "1", "-ackwait", "50ms")
+	go d.ReadLoop()
+	go d.Run()
+	defer serverConn.Close()
+	server := serverConn.addr
+	alice := simNet.NAT(NATPortRestricted, "203.0.113.1").Listen("192.168.1.10:5000")
+	bob := simNet.NAT(NATPortRestricted, "203.0.113.2").Listen("192.168.1.10:5000")
+	d.Users.Add("alice", User{Name: "alice", Addr: "192.168.1.10:5000", Token: "ta"})
+	d.Users.Add("bob", User{Name: "bob", Addr: "192.168.1.10:5000", Token: "tb"})
+	simSend(t, alice, server, Message{Cmd: "beat", Sender: "alice", Receiver: "server", Token: "ta"})
+	simSend(t, bob, server, Message{Cmd: "beat", Sender: "bob", Receiver: "server", Token: "tb"})
+
+	simSend(t, bob, server, Message{Cmd: "msg", Sender: "bob", Data: "hi", Receiver: "alice", Token: "tb"})
+	mess, _ := simWait(t, alice, "msg")
+	payload, typed := ParsePayload(mess)
+	if mess.Sender != "server" || !typed || payload.Note == nil || payload.Note.From != "bob" || payload.Note.Text != "hi" {
+		t.Fatalf("got %+v, want a note from bob sent by the server", mess)
+	}
+	simAck(t, alice, server, "alice", "ta", mess)
+	//重传全部用尽所需的时间内，bob既收不到转来的ack也收不到未送达
+	simQuiet(t, bob, 500*time.Millisecond, "ack", "msg")
+	simQuiet(t, alice, 100*time.Millisecond, "msg")
+}
+
+/****************************************************
+*@brief join只加入发送者，被点名的用户只收到邀请，自行
+join后才成为成员；roomchat只转发给其他成员，rooms列出
+成员，leave通知剩余成员
+*****************************************************/
+func TestRoomJoinByInvitation(t *testing.T) {
+	simNet := NewSimNet()
+	serverConn := simNet.Listen("198.51.100.1:8081")
+	d := newTestDispatcher(t, serverConn)
+	go d.ReadLoop()
+	go d.Run()
+	defer serverConn.Close()
+	server := serverConn.addr
+	alice := simOnline(t, simNet, d, "alice", "ta", "203.0.113.1")
+	bob := simOnline(t, simNet, d, "bob", "tb", "203.0.113.2")
+	carol := simOnline(t, simNet, d, "carol", "tc", "203.0.113.3")
+
+	simSend(t, alice, server, Message{Cmd: "join", Sender: "alice", Data: "lobby/bob/dave", Receiver: "server", Token: "ta",
+		Payload: NewPayload(Payload{Room: &RoomInfo{Name: "lobby", Members: []string{"bob", "dave"}}})})
+	invite, _ := simWait(t, bob, "join")
+	if invite.Sender != "server" || !strings.Contains(invite.Data, "lobby") {
+		t.Errorf("bob got %v, want an invitation from the server", invite)
+	}
+	if mess, _ := simWait(t, alice, "join"); mess.Sender != "server" {
+		t.Errorf("alice got %v, want an error for the offline dave", mess)
+	}
+	mess, _ := simWait(t, alice, "join")
+	if payload, typed := ParsePayload(mess); mess.Sender != "alice" || !typed || payload.Room == nil || strings.Join(payload.Room.Members, ",") != "alice" {
+		t.Errorf("alice got %v, want to be the only member", mess)
+	}
+	if members := d.Users.RoomMembers("lobby"); len(members) != 1 {
+		t.Fatalf("members %v, bob joined without consent", members)
+	}
+
+	simSend(t, bob, server, Message{Cmd: "join", Sender: "bob", Data: "lobby", Receiver: "server", Token: "tb"})
+	for name, conn := range map[string]*SimConn{"alice": alice, "bob": bob} {
+		if mess, _ := simWait(t, conn, "join"); mess.Sender != "bob" {
+			t.Errorf("%s got %v, want bob joining", name, mess)
+		}
+	}
+
+	simSend(t, carol, server, Message{Cmd: "roomchat", Sender: "carol", Data: "spam", Receiver: "lobby", Token: "tc"})
+	if mess, _ := simWait(t, carol, "roomchat"); mess.Sender != "server" {
+		t.Errorf("carol got %v, want an error", mess)
+	}
+	simSend(t, alice, server, Message{Cmd: "roomchat", Sender: "alice", Data: "hello", Receiver: "lobby", Token: "ta"})
+	if mess, _ := simWait(t, bob, "roomchat"); mess.Sender != "alice" || mess.Data != "hello" {
+		t.Errorf("bob got %v, want alice's message", mess)
+	}
+	simQuiet(t, alice, 100*time.Millisecond, "roomchat")
+
+	simSend(t, carol, server, Message{Cmd: "rooms", Sender: "carol", Receiver: "server", Token: "tc"})
+	mess, _ = simWait(t, carol, "rooms")
+	if payload, typed := ParsePayload(mess); !typed || payload.Rooms == nil || len(payload.Rooms.Rooms) != 1 ||
+		payload.Rooms.Rooms[0].Name != "lobby" || len(payload.Rooms.Rooms[0].Members) != 2 {
+		t.Errorf("carol got %v, want lobby with two members", mess)
+	}
+
+	simSend(t, bob, server, Message{Cmd: "leave", Sender: "bob", Data: "lobby", Receiver: "server", Token: "tb"})
+	if mess, _ := simWait(t, alice, "leave"); mess.Sender != "bob" {
+		t.Errorf("alice got %v, want bob leaving", mess)
+	}
+	if members := d.Users.RoomMembers("lobby"); len(members) != 1 || members[0] != "alice" {
+		t.Errorf("members %v after bob left", members)
+	}
+}
+
+/****************************************************
+*@brief 每种编解码的消息往返编码不变，按ID与名称可以
+找到，经过帧编解码同样不变；长字段覆盖cbor的各种长度头
+*****************************************************/
+func TestCodecRoundTrip(t *testing.T) {
+	messages := map[string]Message{
+		"empty": {},
+		"full": {Cmd: "chat", Data: "hello", Sender: "alice", Receiver: "bob", Token: "t", Key: "k",
+			Nonce: "n", Codec: "cbor", Payload: `{"Note":{"From":"bob"}}`, ID: "a1"},
+		"unicode": {Cmd: "roomchat", Data: "你好/世界", Sender: "阿丽", Receiver: "房间"},
+		"text24":  {Cmd: "msg", Data: strings.Repeat("x", 24)},
+		"text256": {Cmd: "msg", Data: strings.Repeat("x", 256)},
+		"text64k": {Cmd: "msg", Data: strings.Repeat("x", 70000)},
+	}
+	for _, codec := range Codecs {
+		if CodecByID(codec.ID()) != codec || CodecByName(codec.Name()) != codec {
+			t.Errorf("%s: not found by id %d or by name", codec.Name(), codec.ID())
+		}
+		for name, mess := range messages {
+			t.Run(codec.Name()+"/"+name, func(t *testing.T) {
+				data, err := codec.Marshal(mess)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got Message
+				if err = codec.Unmarshal(data, &got); err != nil || got != mess {
+					t.Errorf("got %+v (%v), want %+v", got, err, mess)
+				}
+				frame, err := EncodeFrame(codec, mess)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if frame[3] != codec.ID() {
+					t.Errorf("payload type %d, want %d", frame[3], codec.ID())
+				}
+				if got, err = DecodeFrame(frame); err != nil || got != mess {
+					t.Errorf("frame: got %+v (%v), want %+v", got, err, mess)
+				}
+			})
+		}
+	}
+	if CodecByID(99) != nil || CodecByName("xml") != nil {
+		t.Error("an unknown codec was found")
+	}
+	var frameErr *FrameError
+	if _, err := DecodeFrame([]byte{'I', 'M', FrameVersion, 99, 0}); !errors.As(err, &frameErr) || frameErr.Reason != "payload" {
+		t.Errorf("unknown payload type: got %v, want a payload error", err)
+	}
+}
+
+/****************************************************
+*@brief 截断的数据以及长度超过剩余数据的输入返回错误，
+不会panic
+*****************************************************/
+func TestCodecMalformed(t *testing.T) {
+	unmarshal := func(codec Codec, data []byte) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+				t.Errorf("%s: %x: %v", codec.Name(), data, err)
+			}
+		}()
+		var mess Message
+		return codec.Unmarshal(data, &mess)
+	}
+	cases := []struct {
+		name  string
+		codec Codec
+		data  []byte
+	}{
+		{"binary field cut", BinaryCodec{}, []byte{4, 'c', 'h'}},
+		{"binary length over data", BinaryCodec{}, []byte{100, 'x'}},
+		{"binary huge length", BinaryCodec{}, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f, 'x'}},
+		{"binary varint overflow", BinaryCodec{}, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"binary varint cut", BinaryCodec{}, []byte{0x80}},
+		{"cbor empty", CBORCodec{}, nil},
+		{"cbor not a map", CBORCodec{}, []byte{0x63, 'C', 'm', 'd'}},
+		{"cbor missing pair", CBORCodec{}, []byte{0xa1}},
+		{"cbor huge map", CBORCodec{}, []byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"cbor head cut", CBORCodec{}, []byte{0xa1, 0x7a, 0x00}},
+		{"cbor text cut", CBORCodec{}, []byte{0xa1, 0x63, 'C', 'm'}},
+		{"cbor huge text", CBORCodec{}, []byte{0xa1, 0x7b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 'C'}},
+		{"cbor indefinite", CBORCodec{}, []byte{0xbf, 0x63, 'C', 'm', 'd', 0xff}},
+		{"cbor value not text", CBORCodec{}, []byte{0xa1, 0x63, 'C', 'm', 'd', 0x01}},
+		{"json cut", JSONCodec{}, []byte(`{"Cmd":"ch`)},
+	}
+	for _, c := range cases {
+		if err := unmarshal(c.codec, c.data); err == nil {
+			t.Errorf("%s: no error", c.name)
+		}
+	}
+	//完整消息的每个前缀：cbor与json一律报错，binary在字段边界可能
+	//按旧版本消息解码，但不能panic
+	full := Message{Cmd: "chat", Data: strings.Repeat("x", 300), Sender: "alice", Receiver: "bob", ID: "a1"}
+	for _, codec := range Codecs {
+		data, err := codec.Marshal(full)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(data); i++ {
+			err := unmarshal(codec, data[:i])
+			if err == nil && codec.Name() != "binary" {
+				t.Errorf("%s: a %d of %d byte prefix decoded", codec.Name(), i, len(data))
+			}
+		}
+		frame, _ := EncodeFrame(codec, full)
+		for i := 0; i < len(frame); i++ {
+			if _, err := DecodeFrame(frame[:i]); err == nil && (i < FrameHeader || codec.Name() != "binary") {
+				t.Errorf("%s: a %d byte frame prefix decoded", codec.Name(), i)
+			}
+		}
+	}
+}
+
+/****************************************************
+*@brief 收到ack后停止重传并回调ok；一直未确认时按加倍
+的间隔重传retries次后回调fail；同一发送者的重复消息ID
+被识别，不同发送者互不影响
+*****************************************************/
+func TestReliableAckAndGiveUp(t *testing.T) {
+	r := NewReliable(2, 50*time.Millisecond)
+	sends := make(chan Message, 16)
+	send := func(mess Message) error {
+		sends <- mess
+		return nil
+	}
+	ok, fail := make(chan Message, 1), make(chan Message, 1)
+	err := r.SendAcked(Message{Cmd: "mailbox"}, send, func(mess Message) { ok <- mess }, func(mess Message) { fail <- mess })
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := (<-sends).ID
+	r.Ack(id)
+	select {
+	case mess := <-ok:
+		if mess.ID != id {
+			t.Errorf("ok for %s, want %s", mess.ID, id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ok was not called")
+	}
+	select {
+	case <-sends:
+		t.Error("resent after the ack")
+	case <-fail:
+		t.Error("failed after the ack")
+	case <-time.After(400 * time.Millisecond):
+	}
+
+	err = r.SendAcked(Message{Cmd: "mailbox"}, send, func(mess Message) { ok <- mess }, func(mess Message) { fail <- mess })
+	if err != nil {
+		t.Fatal(err)
+	}
+	times := make([]time.Time, 0)
+	for i := 0; i < 3; i++ {
+		<-sends
+		times = append(times, time.Now())
+	}
+	for i, least := range []time.Duration{45 * time.Millisecond, 95 * time.Millisecond} {
+		if gap := times[i+1].Sub(times[i]); gap < least {
+			t.Errorf("resend %d after %v, want at least %v", i+1, gap, least)
+		}
+	}
+	select {
+	case <-fail:
+	case <-time.After(time.Second):
+		t.Fatal("fail was not called")
+	}
+	select {
+	case <-sends:
+		t.Error("resent more than retries times")
+	case <-ok:
+		t.Error("ok after giving up")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if r.Duplicate("alice", "1") || !r.Duplicate("alice", "1") || r.Duplicate("bob", "1") {
+		t.Error("duplicates not told apart by sender and id")
+	}
+}
+
+/****************************************************
+*@brief 邀请被接受后双方收到会话信息；被拒绝时发起者
+收到declined；超时未处理的邀请在心跳检查时过期并通知
+双方，之后不能再接受
+*****************************************************/
+func TestInviteAcceptDeclineExpire(t *testing.T) {
+	simNet := NewSimNet()
+	serverConn := simNet.Listen("198.51.100.1:8081")
+	d := newTestDispatcher(t, serverConn, "-invitewait", "200ms", "-minbeats", "1")
+	go d.ReadLoop()
+	go d.Run()
+	defer serverConn.Close()
+	server := serverConn.addr
+	alice := simOnline(t, simNet, d, "alice", "ta", "203.0.113.1")
+	bob := simOnline(t, simNet, d, "bob", "tb", "203.0.113.2")
+	carol := simOnline(t, simNet, d, "carol", "tc", "203.0.113.3")
+
+	simSend(t, alice, server, Message{Cmd: "group", Sender: "alice", Data: "bob", Receiver: "server", Token: "ta"})
+	invite, _ := simWait(t, bob, "invite")
+	if payload, typed := ParsePayload(invite); !typed || payload.Invite == nil || payload.Invite.From != "alice" {
+		t.Errorf("bob got %v, want an invitation from alice", invite)
+	}
+	simAck(t, bob, server, "bob", "tb", invite)
+	simSend(t, carol, server, Message{Cmd: "accept", Sender: "carol", Data: "alice", Receiver: "server", Token: "tc"})
+	if code := simFail(t, carol, "accept"); code != CodeNoInvite {
+		t.Errorf("carol accepted an invitation to bob: code %d", code)
+	}
+	simSend(t, bob, server, Message{Cmd: "accept", Sender: "bob", Data: "alice", Receiver: "server", Token: "tb"})
+	for name, conn := range map[string]*SimConn{"alice": alice, "bob": bob} {
+		mess, _ := simWait(t, conn, "group")
+		if payload, typed := ParsePayload(mess); !typed || payload.Offer == nil {
+			t.Errorf("%s got %v, want a session offer", name, mess)
+		}
+		simAck(t, conn, server, name, "t"+name[:1], mess)
+	}
+
+	simSend(t, carol, server, Message{Cmd: "group", Sender: "carol", Data: "bob", Receiver: "server", Token: "tc"})
+	invite, _ = simWait(t, bob, "invite")
+	simAck(t, bob, server, "bob", "tb", invite)
+	simSend(t, bob, server, Message{Cmd: "decline", Sender: "bob", Data: "carol", Receiver: "server", Token: "tb"})
+	if code := simFail(t, carol, "group"); code != CodeDeclined {
+		t.Errorf("carol got code %d, want declined", code)
+	}
+	if code := simFail(t, bob, "decline"); code != 0 {
+		t.Errorf("bob got code %d, want a confirmation", code)
+	}
+	simSend(t, bob, server, Message{Cmd: "decline", Sender: "bob", Data: "carol", Receiver: "server", Token: "tb"})
+	if code := simFail(t, bob, "decline"); code != CodeNoInvite {
+		t.Errorf("bob declined twice: code %d", code)
+	}
+
+	simSend(t, alice, server, Message{Cmd: "group", Sender: "alice", Data: "carol", Receiver: "server", Token: "ta"})
+	invite, _ = simWait(t, carol, "invite")
+	simAck(t, carol, server, "carol", "tc", invite)
+	time.Sleep(300 * time.Millisecond)
+	d.Push(Command{Mess: Message{Cmd: "check", Sender: "server", Receiver: "server"}})
+	if code := simFail(t, alice, "group"); code != CodeExpired {
+		t.Errorf("alice got code %d, want expired", code)
+	}
+	if code := simFail(t, carol, "invite"); code != CodeExpired {
+		t.Errorf("carol got code %d, want expired", code)
+	}
+	simSend(t, carol, server, Message{Cmd: "accept", Sender: "carol", Data: "alice", Receiver: "server", Token: "tc"})
+	if code := simFail(t, carol, "accept"); code != CodeNoInvite {
+		t.Errorf("an expired invitation was accepted: code %d", code)
+	}
+}
+
+/****************************************************
+*@brief 设置dnd后msg与会话邀请被拒绝，接收方收不到；
+未知状态被拒绝
+*****************************************************/
+func TestStatusDNDBlocksMsg(t *testing.T) {
+	simNet := NewSimNet()
+	serverConn := simNet.Listen("198.51.100.1:8081")
+	d := newTestDispatcher(t, serverConn)
+	go d.ReadLoop()
+	go d.Run()
+	defer serverConn.Close()
+	server := serverConn.addr
+	alice := simOnline(t, simNet, d, "alice", "ta", "203.0.113.1")
+	bob := simOnline(t, simNet, d, "bob", "tb", "203.0.113.2")
+
+	simSend(t, bob, server, Message{Cmd: "status", Sender: "bob", Data: "sleeping", Receiver: "server", Token: "tb"})
+	if code := simFail(t, bob, "status"); code != CodeBadStatus {
+		t.Errorf("an unknown status got code %d", code)
+	}
+	simSend(t, bob, server, Message{Cmd: "status", Sender: "bob", Data: "dnd/focus", Receiver: "server", Token: "tb"})
+	mess, _ := simWait(t, bob, "status")
+	if payload, typed := ParsePayload(mess); !typed || payload.Status == nil || payload.Status.Status != StatusDND || payload.Status.Text != "focus" {
+		t.Fatalf("bob got %v, want dnd confirmed", mess)
+	}
+	simSend(t, alice, server, Message{Cmd: "msg", Sender: "alice", Data: "hi", Receiver: "bob", Token: "ta"})
+	if code := simFail(t, alice, "msg"); code != CodeBusy {
+		t.Errorf("msg to dnd got code %d, want busy", code)
+	}
+	simSend(t, alice, server, Message{Cmd: "group", Sender: "alice", Data: "bob", Receiver: "server", Token: "ta"})
+	if code := simFail(t, alice, "group"); code != CodeBusy {
+		t.Errorf("invitation to dnd got code %d, want busy", code)
+	}
+	simQuiet(t, bob, 100*time.Millisecond, "msg", "invite")
+}
+
+/****************************************************
+*@brief 关注后立即收到联系人状态，之后状态变化与下线
+都会通知；取消关注后不再通知；不能关注未知用户
+*****************************************************/
+func TestWatchNotifications(t *testing.T) {
+	simNet := NewSimNet()
+	serverConn := simNet.Listen("198.51.100.1:8081")
+	d := newTestDispatcher(t, serverConn, "-minbeats", "1")
+	go d.ReadLoop()
+	go d.Run()
+	defer serverConn.Close()
+	server := serverConn.addr
+	alice := simOnline(t, simNet, d, "alice", "ta", "203.0.113.1")
+	bob := simOnline(t, simNet, d, "bob", "tb", "203.0.113.2")
+	presence := func(want string) {
+		t.Helper()
+		mess, _ := simWait(t, alice, "presence")
+		if payload, typed := ParsePayload(mess); !typed || payload.Status == nil || payload.Status.Name != "bob" || payload.Status.Status != want {
+			t.Errorf("alice got %v, want bob %s", mess, want)
+		}
+	}
+
+	simSend(t, alice, server, Message{Cmd: "watch", Sender: "alice", Data: "dave", Receiver: "server", Token: "ta"})
+	if code := simFail(t, alice, "watch"); code != CodeNotRegistered {
+		t.Errorf("watching an unknown user got code %d", code)
+	}
+	simSend(t, alice, server, Message{Cmd: "watch", Sender: "alice", Data: "bob", Receiver: "server", Token: "ta"})
+	presence(StatusAvailable)
+	simSend(t, bob, server, Message{Cmd: "status", Sender: "bob", Data: "away/lunch", Receiver: "server", Token: "tb"})
+	presence(StatusAway)
+
+	simSend(t, alice, server, Message{Cmd: "unwatch", Sender: "alice", Data: "bob", Receiver: "server", Token: "ta"})
+	if code := simFail(t, alice, "unwatch"); code != 0 {
+		t.Errorf("unwatch got code %d", code)
+	}
+	simSend(t, bob, server, Message{Cmd: "status", Sender: "bob", Data: "busy", Receiver: "server", Token: "tb"})
+	simWait(t, bob, "status")
+	simQuiet(t, alice, 100*time.Millisecond, "presence")
+
+	simSend(t, alice, server, Message{Cmd: "watch", Sender: "alice", Data: "bob", Receiver: "server", Token: "ta"})
+	presence(StatusBusy)
+	//第一次检查清零心跳计数，之后只有alice发送心跳，bob超时下线
+	beats := func(want int) {
+		t.Helper()
+		for deadline := time.Now().Add(time.Second); d.Users.GetUser("alice").BeatCount != want; {
+			if time.Now().After(deadline) {
+				t.Fatalf("alice has %d beats, want %d", d.Users.GetUser("alice").BeatCount, want)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	d.Push(Command{Mess: Message{Cmd: "check", Sender: "server", Receiver: "server"}})
+	beats(0)
+	simSend(t, alice, server, Message{Cmd: "beat", Sender: "alice", Receiver: "server", Token: "ta"})
+	beats(1)
+	d.Push(Command{Mess: Message{Cmd: "check", Sender: "server", Receiver: "server"}})
+	presence(StatusOffline)
+}
+
+/****************************************************
+*@brief unix socket的管理控制台创建后只有服务器所属
+用户可以访问，覆盖遗留的socket文件，不留下临时目录
+*****************************************************/
+func TestListenAdminSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin.sock")
+	if err := os.WriteFile(path, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := ListenAdmin("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, want a socket with 0600", info.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("%d entries left in the directory, want only the socket", len(entries))
+	}
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			fmt.Fprintln(conn, "ok")
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "ok\n" {
+		t.Errorf("got %q (%v) through the socket", line, err)
+	}
+}
+
+/****************************************************
+*@brief broadcast发给所有在线用户；kick通知用户后释放；
+ban按用户名或观察到的ip踢出在线用户，并拒绝之后的登录
+*****************************************************/
+func TestAdminKickBanBroadcast(t *testing.T) {
+	simNet := NewSimNet()
+	serverConn := simNet.Listen("198.51.100.1:8081")
+	d := newTestDispatcher(t, serverConn)
+	go d.ReadLoop()
+	go d.Run()
+	defer serverConn.Close()
+	clients := map[string]*SimConn{
+		"alice": simOnline(t, simNet, d, "alice", "ta", "203.0.113.1"),
+		"bob":   simOnline(t, simNet, d, "bob", "tb", "203.0.113.2"),
+		"carol": simOnline(t, simNet, d, "carol", "tc", "203.0.113.3"),
+	}
+	for name := range clients {
+		for deadline := time.Now().Add(time.Second); d.Users.GetUser(name).PublicAddr == ""; {
+			if time.Now().After(deadline) {
+				t.Fatalf("no heartbeat from %s", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	admin := func(line string) string {
+		t.Helper()
+		reply := make(chan []string, 1)
+		d.Push(Command{Mess: Message{Cmd: "admin", Sender: "admin", Data: line, Receiver: "server"}, Reply: reply})
+		return strings.Join(<-reply, "\n")
+	}
+
+	if out := admin("broadcast maintenance at noon"); out != "sent to 3 users" {
+		t.Errorf("broadcast replied %q", out)
+	}
+	for name, conn := range clients {
+		if mess, _ := simWait(t, conn, "broadcast"); mess.Sender != "server" || mess.Data != "maintenance at noon" {
+			t.Errorf("%s got %v", name, mess)
+		}
+	}
+
+	if out := admin("kick bob spam"); out != "kicked <bob>" {
+		t.Errorf("kick replied %q", out)
+	}
+	if mess, _ := simWait(t, clients["bob"], "kick"); !strings.Contains(mess.Data, "spam") {
+		t.Errorf("bob got %v, want the reason", mess)
+	}
+	if d.Users.GetUser("bob").Name != "" {
+		t.Error("bob is still online after the kick")
+	}
+	if out := admin("kick bob"); !strings.Contains(out, "not online") {
+		t.Errorf("kicking an offline user replied %q", out)
+	}
+
+	if out := admin("ban 203.0.113.1 1h"); !strings.Contains(out, "kicked <alice>") {
+		t.Errorf("ip ban replied %q", out)
+	}
+	simWait(t, clients["alice"], "kick")
+	if out := admin("ban carol 1h abuse"); !strings.Contains(out, "kicked <carol>") {
+		t.Errorf("name ban replied %q", out)
+	}
+	if mess, _ := simWait(t, clients["carol"], "kick"); !strings.Contains(mess.Data, "abuse") {
+		t.Errorf("carol got %v, want the reason", mess)
+	}
+	if _, banned := d.Bans.Banned("carol", "198.51.100.9"); !banned {
+		t.Error("carol can log in again")
+	}
+	if _, banned := d.Bans.Banned("dave", "203.0.113.1"); !banned {
+		t.Error("the banned ip can log in again")
+	}
+	if out := admin("ban carol soon"); !strings.Contains(out, "invalid duration") {
+		t.Errorf("a bad duration replied %q", out)
+	}
+	if out := admin("unban carol"); out != "unbanned <carol>" {
+		t.Errorf("unban replied %q", out)
+	}
+	if _, banned := d.Bans.Banned("carol", "198.51.100.9"); banned {
+		t.Error("carol is still banned")
+	}
+}
+
+/****************************************************
+*@brief 中转模式下服务器只在会话双方之间转发chat，来源
+是服务器地址；会话之外或对方不在线时告知发送者
+*****************************************************/
+func TestRelayChat(t *testing.T) {
+	simNet := NewSimNet()
+	serverConn := simNet.Listen("198.51.100.1:8081")
+	d := newTestDispatcher(t, serverConn)
+	go d.ReadLoop()
+	go d.Run()
+	defer serverConn.Close()
+	server := serverConn.addr
+	alice := simOnline(t, simNet, d, "alice", "ta", "203.0.113.1")
+	bob := simOnline(t, simNet, d, "bob", "tb", "203.0.113.2")
+	carol := simOnline(t, simNet, d, "carol", "tc", "203.0.113.3")
+	simSession(t, d, alice, bob, "alice", "ta", "bob", "tb")
+
+	simSend(t, alice, server, Message{Cmd: "chat", Sender: "alice", Data: "relayed", Receiver: "bob", Token: "ta", ID: "a-1"})
+	mess, from := simWait(t, bob, "chat")
+	if mess.Sender != "alice" || mess.Data != "relayed" || mess.ID != "a-1" || from.String() != server.String() {
+		t.Errorf("bob got %v from %v, want alice's message from the server", mess, from)
+	}
+	simSend(t, carol, server, Message{Cmd: "chat", Sender: "carol", Data: "hi", Receiver: "bob", Token: "tc"})
+	if code := simFail(t, carol, "chat"); code != CodeNotTalking {
+		t.Errorf("chat outside a session got code %d", code)
+	}
+	simSend(t, carol, server, Message{Cmd: "chat", Sender: "carol", Data: "hi", Receiver: "dave", Token: "tc"})
+	if code := simFail(t, carol, "chat"); code != CodeNotOnline {
+		t.Errorf("chat to an offline user got code %d", code)
+	}
+	simQuiet(t, bob, 100*time.Millisecond, "chat")
+}
+
+/****************************************************
+*@brief 注册账号只保存加盐的pbkdf2摘要，重新打开后仍能
+校验密码；重复注册与空密码被拒绝
+*****************************************************/
+func TestAccountsPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.txt")
+	accounts, err := NewAccounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = accounts.Register("alice", "secret-pw"); err != nil {
+		t.Fatal(err)
+	}
+	if err = accounts.Register("bob", "secret-pw"); err != nil {
+		t.Fatal(err)
+	}
+	if accounts.Register("alice", "other") == nil || accounts.Register("carol", "") == nil {
+		t.Error("a duplicate name or an empty password was registered")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret-pw") {
+		t.Errorf("the password is stored: %s", data)
+	}
+	accounts, err = NewAccounts(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !accounts.Verify("alice", "secret-pw") || accounts.Verify("alice", "secret") || accounts.Verify("dave", "secret-pw") {
+		t.Error("verify after reopening is wrong")
+	}
+	//相同密码的盐不同，摘要也不同
+	if accounts.accounts["alice"].Hash == accounts.accounts["bob"].Hash {
+		t.Error("two accounts with the same password have the same hash")
+	}
+	if len(accounts.accounts["alice"].Hash) != 64 || accounts.accounts["alice"].Hash != HashPassword("secret-pw", accounts.accounts["alice"].Salt) {
+		t.Errorf("hash %q is not a 32 byte pbkdf2 key", accounts.accounts["alice"].Hash)
+	}
+}
+
+/****************************************************
+*@function startLogin(t *testing.T, tlsConfig *tls.Config, args ...string) (string, *Store, chan User)
+*****************************************************
+*@brief 在回环地址的空闲端口开启登录服务，返回登录地址、
+在线用户组以及登录成功的用户
+*****************************************************/
+func startLogin(t *testing.T, tlsConfig *tls.Config, args ...string) (string, *Store, chan User) {
+	t.Helper()
+	probe, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := probe.Addr().String()
+	probe.Close()
+	dir := t.TempDir()
+	config, err := NewConfig(append([]string{"-login", addr, "-onlinelog", filepath.Join(dir, "onlineusers.txt")}, args...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := NewStore(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := NewAccounts(filepath.Join(dir, "accounts.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailbox, err := NewMailbox(filepath.Join(dir, "mailbox"), config.MailQuota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userCh := make(chan User, 16)
+	go Login(config, userCh, log.New(io.Discard, "", 0), users, accounts, tlsConfig, mailbox, NewBans())
+	for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+	return addr, users, userCh
+}
+
+/****************************************************
+*@function loginSession(t *testing.T, conn net.Conn) (*json.Encoder, *json.Decoder)
+*****************************************************
+*@brief 按客户端的方式发送connect，读取connect与欢迎
+介绍，返回之后收发登录消息的编码器
+*****************************************************/
+func loginSession(t *testing.T, conn net.Conn) (*json.Encoder, *json.Decoder) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+	if err := encoder.Encode(Message{Cmd: "connect", Data: "192.168.1.10:5000", Codec: "binary"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{"connect", "login"} {
+		var mess Message
+		if err := decoder.Decode(&mess); err != nil || mess.Cmd != cmd {
+			t.Fatalf("got %v (%v), want %s", mess, err, cmd)
+		}
+	}
+	return encoder, decoder
+}
+
+/****************************************************
+*@brief 经tcp登录服务注册账号后立即登录；账号下线后
+游客登录与错误密码被拒绝，正确密码登录成功
+*****************************************************/
+func TestLoginWithPassword(t *testing.T) {
+	addr, users, userCh := startLogin(t, nil)
+	attempt := func(encoder *json.Encoder, decoder *json.Decoder, cmd, data string) Message {
+		t.Helper()
+		if err := encoder.Encode(Message{Cmd: cmd, Data: data}); err != nil {
+			t.Fatal(err)
+		}
+		var mess Message
+		if err := decoder.Decode(&mess); err != nil {
+			t.Fatal(err)
+		}
+		return mess
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	encoder, decoder := loginSession(t, conn)
+	if mess := attempt(encoder, decoder, "register", "alice/secret-pw"); mess.Data != "success" || mess.Token == "" {
+		t.Fatalf("register got %v", mess)
+	}
+	select {
+	case user := <-userCh:
+		if user.Name != "alice" || user.Codec != "binary" {
+			t.Errorf("logged in %v", user)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no user from the login")
+	}
+	users.Delete("alice")
+
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	encoder, decoder = loginSession(t, conn)
+	if mess := attempt(encoder, decoder, "login", "alice/wrong"); !strings.Contains(mess.Data, "wrong name or password") {
+		t.Errorf("a wrong password got %q", mess.Data)
+	}
+	if mess := attempt(encoder, decoder, "login", "alice"); !strings.Contains(mess.Data, "registered") {
+		t.Errorf("a guest login with a registered name got %q", mess.Data)
+	}
+	if mess := attempt(encoder, decoder, "register", "alice/other"); !strings.Contains(mess.Data, "already been registered") {
+		t.Errorf("registering again got %q", mess.Data)
+	}
+	if mess := attempt(encoder, decoder, "login", "alice/secret-pw"); mess.Data != "success" || mess.Token == "" {
+		t.Errorf("the right password got %v", mess)
+	}
+}
+
+/****************************************************
+*@brief 开发模式生成的证书写入文件，固定信任该证书的
+客户端可以经TLS登录，不信任或信任其他证书的连接失败；
+未配置证书时不启用TLS
+*****************************************************/
+func TestLoginTLSDevCert(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server-dev.crt")
+	tlsConfig, err := LoadTLSConfig(certFile, "", true, "127.0.0.1:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, _, _ := startLogin(t, tlsConfig)
+	pinned := func(path string) *tls.Config {
+		t.Helper()
+		caPEM, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			t.Fatalf("%s: no certificate", path)
+		}
+		return &tls.Config{RootCAs: pool, ServerName: "127.0.0.1", MinVersion: tls.VersionTLS12}
+	}
+	conn, err := tls.Dial("tcp", addr, pinned(certFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	loginSession(t, conn)
+
+	if conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: "127.0.0.1"}); err == nil {
+		conn.Close()
+		t.Error("the dev certificate was trusted without pinning")
+	}
+	otherFile := filepath.Join(dir, "other.crt")
+	if _, err := LoadTLSConfig(otherFile, "", true, "127.0.0.1:8080"); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err := tls.Dial("tcp", addr, pinned(otherFile)); err == nil {
+		conn.Close()
+		t.Error("a client pinning another certificate connected")
+	}
+
+	if config, err := LoadTLSConfig("", "", false, addr); config != nil || err != nil {
+		t.Errorf("got %v (%v) without certificates, want plain tcp", config, err)
+	}
+	if _, err := LoadTLSConfig(filepath.Join(dir, "missing.crt"), filepath.Join(dir, "missing.key"), false, addr); err == nil {
+		t.Error("missing certificate files were accepted")
+	}
+}
+
+/****************************************************
+*@brief 中转的会话消息记录在双方共用的文件中，重启后
+仍在；history按请求的条数返回最近的记录，最后由server
+返回条数
+*****************************************************/
+func TestHistoryRelayed(t *testing.T) {
+	simNet := NewSimNet()
+	serverConn := simNet.Listen("198.51.100.1:8081")
+	d := newTestDispatcher(t, serverConn)
+	go d.ReadLoop()
+	go d.Run()
+	defer serverConn.Close()
+	server := serverConn.addr
+	alice := simOnline(t, simNet, d, "alice", "ta", "203.0.113.1")
+	bob := simOnline(t, simNet, d, "bob", "tb", "203.0.113.2")
+	simSession(t, d, alice, bob, "alice", "ta", "bob", "tb")
+	for _, text := range []string{"one", "two"} {
+		simSend(t, alice, server, Message{Cmd: "chat", Sender: "alice", Data: text, Receiver: "bob", Token: "ta"})
+		simWait(t, bob, "chat")
+	}
+	simSend(t, bob, server, Message{Cmd: "chat", Sender: "bob", Data: "three", Receiver: "alice", Token: "tb"})
+	simWait(t, alice, "chat")
+
+	simSend(t, alice, server, Message{Cmd: "history", Sender: "alice", Data: "bob/2", Receiver: "server", Token: "ta"})
+	got := make([]string, 0)
+	for {
+		mess, _ := simWait(t, alice, "history")
+		if mess.Sender == "server" {
+			if mess.Data != "2" || mess.Receiver != "bob" {
+				t.Errorf("history ended with %v, want 2 records with bob", mess)
+			}
+			break
+		}
+		parts := strings.SplitN(mess.Data, "/", 2)
+		if len(parts) != 2 {
+			t.Fatalf("history record %v has no time", mess)
+		}
+		got = append(got, mess.Sender+":"+parts[1])
+	}
+	if strings.Join(got, ",") != "alice:two,bob:three" {
+		t.Errorf("history returned %v, want the last two records", got)
+	}
+
+	history, err := NewHistory(d.Config.HistoryDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records, err := history.Last("bob", "alice", 10); err != nil || len(records) != 3 {
+		t.Errorf("reopened history has %v (%v), want 3 records", records, err)
+	}
+}
+
+/****************************************************
+*@brief 结构化负载编码后可还原，非法或缺失的负载按旧
+版本处理；join优先使用Payload中的房间，旧客户端只带
+Data时同样可以加入，回复同时携带Data与Payload
+*****************************************************/
+func TestPayloadTypedAndLegacy(t *testing.T) {
+	room := Payload{Room: &RoomInfo{Name: "lobby", Members: []string{"carol"}}}
+	payload, typed := ParsePayload(Message{Cmd: "join", Payload: NewPayload(room)})
+	if !typed || payload.Room == nil || payload.Room.Name != "lobby" || len(payload.Room.Members) != 1 {
+		t.Errorf("payload round trip gave %v %v", payload, typed)
+	}
+	for _, raw := range []string{"", "{", "[1,2]", "not json"} {
+		if _, typed := ParsePayload(Message{Cmd: "join", Data: "lobby", Payload: raw}); typed {
+			t.Errorf("payload %q parsed as typed", raw)
+		}
+	}
+
+	simNet := NewSimNet()
+	serverConn := simNet.Listen("198.51.100.1:8081")
+	d := newTestDispatcher(t, serverConn)
+	go d.ReadLoop()
+	go d.Run()
+	defer serverConn.Close()
+	server := serverConn.addr
+	alice := simOnline(t, simNet, d, "alice", "ta", "203.0.113.1")
+	bob := simOnline(t, simNet, d, "bob", "tb", "203.0.113.2")
+
+	//Payload优先于Data，邀请不在线的carol失败
+	simSend(t, alice, server, Message{Cmd: "join", Sender: "alice", Data: "ignored", Receiver: "server", Token: "ta", Payload: NewPayload(room)})
+	if code := simFail(t, alice, "join"); code != CodeNotOnline {
+		t.Errorf("inviting offline carol gave code %d, want %d", code, CodeNotOnline)
+	}
+	mess, _ := simWait(t, alice, "join")
+	payload, typed = ParsePayload(mess)
+	if !typed || payload.Room == nil || payload.Room.Name != "lobby" || mess.Data != "lobby/alice" {
+		t.Errorf("alice joined with %v, want room lobby in Data and Payload", mess)
+	}
+
+	//旧客户端只发送Data
+	simSend(t, bob, server, Message{Cmd: "join", Sender: "bob", Data: "lobby", Receiver: "server", Token: "tb"})
+	for _, conn := range []*SimConn{alice, bob} {
+		mess, _ := simWait(t, conn, "join")
+		payload, typed := ParsePayload(mess)
+		if mess.Sender != "bob" || !typed || payload.Room == nil || strings.Join(payload.Room.Members, ",") != "alice,bob" {
+			t.Errorf("legacy join announced %v, want bob joining alice", mess)
+		}
+	}
+}